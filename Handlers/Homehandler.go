@@ -1,7 +1,7 @@
 package RebootForums
 
 import (
-	"database/sql"
+	"bytes"
 	"html/template"
 	"log"
 	"net/http"
@@ -11,35 +11,41 @@ import (
 	"time"
 )
 
-// GetRecentPosts fetches recent posts from the database
-func GetRecentPosts(limit int) ([]Post, error) {
-	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at, p.image_filename
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        ORDER BY p.created_at DESC
-        LIMIT ?
-    `
-	rows, err := DB.Query(query, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+// GetRecentPosts fetches a page of posts from every category
+func GetRecentPosts(opts FeedOptions) (FeedPage, error) {
+	return fetchPosts("", nil, opts)
+}
 
-	var posts []Post
-	for rows.Next() {
-		var p Post
-		var imageFilename sql.NullString
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.CreatedAt, &imageFilename)
-		if err != nil {
-			return nil, err
-		}
-		if imageFilename.Valid {
-			p.ImageFilename = imageFilename.String
+// SortOption is a feed sort mode offered on the home page
+type SortOption struct {
+	Name  string
+	Label string
+	URL   string
+}
+
+var homeSortModes = []struct{ Name, Label string }{
+	{SortNewest, "Newest"},
+	{SortHot, "Hot"},
+	{SortMostLiked, "Most Liked"},
+	{SortMostCommented, "Most Commented"},
+}
+
+// homeURL returns the home page URL for the current filters with the given parameters replaced
+func homeURL(r *http.Request, set map[string]string) string {
+	query := r.URL.Query()
+	query.Del("after")
+	query.Del("before")
+	for key, value := range set {
+		if value == "" {
+			query.Del(key)
+		} else {
+			query.Set(key, value)
 		}
-		posts = append(posts, p)
 	}
-	return posts, nil
+	if len(query) == 0 {
+		return "/"
+	}
+	return "/?" + query.Encode()
 }
 
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
@@ -48,8 +54,8 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromSession(r)
-	loggedIn := err == nil && user != nil
+	user := CurrentUser(r)
+	loggedIn := user != nil
 	var username string
 	var isGuest bool
 	var sessionDuration time.Duration
@@ -69,9 +75,12 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	categoryParam := r.URL.Query().Get("category")
 	filter := r.URL.Query().Get("filter")
 
-	var posts []Post
+	opts := ParseFeedOptions(r)
+
+	var page FeedPage
 	var fetchErr error
 	var selectedCategoryID int
+	var err error
 
 	if categoryParam != "" {
 		selectedCategoryID, err = strconv.Atoi(categoryParam)
@@ -79,21 +88,44 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 			Error400Handler(w, r)
 			return
 		}
-		posts, fetchErr = GetPostsByCategory(selectedCategoryID)
+		page, fetchErr = GetPostsByCategory(selectedCategoryID, opts)
 	} else if filter == "created" && loggedIn {
-		posts, fetchErr = GetPostsByUser(user.ID)
+		page, fetchErr = GetPostsByUser(user.ID, opts)
 	} else if filter == "liked" && loggedIn {
-		posts, fetchErr = GetLikedPostsByUser(user.ID)
+		page, fetchErr = GetLikedPostsByUser(user.ID, opts)
 	} else {
-		posts, fetchErr = GetRecentPosts(10)
+		page, fetchErr = GetRecentPosts(opts)
 	}
 
 	if fetchErr != nil {
+		if opts.After != "" || opts.Before != "" {
+			// Most likely a malformed or stale cursor
+			log.Printf("Failed to fetch posts page: %v", fetchErr)
+			Error400Handler(w, r)
+			return
+		}
 		log.Printf("Failed to fetch posts: %v", fetchErr)
 		Error500Handler(w, r)
 		return
 	}
 
+	sortOptions := make([]SortOption, 0, len(homeSortModes))
+	for _, mode := range homeSortModes {
+		sortOptions = append(sortOptions, SortOption{
+			Name:  mode.Name,
+			Label: mode.Label,
+			URL:   homeURL(r, map[string]string{"sort": mode.Name}),
+		})
+	}
+
+	var nextURL, prevURL string
+	if page.NextCursor != "" {
+		nextURL = homeURL(r, map[string]string{"after": page.NextCursor})
+	}
+	if page.PrevCursor != "" {
+		prevURL = homeURL(r, map[string]string{"before": page.PrevCursor})
+	}
+
 	categories, err := GetAllCategories()
 	if err != nil {
 		log.Printf("Failed to fetch categories: %v", err)
@@ -101,24 +133,43 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	onlineMembers, onlineGuests, err := GetActiveSessions()
+	if err != nil {
+		log.Printf("Failed to count online visitors: %v", err)
+	}
+
 	data := struct {
 		Posts            []Post
 		Categories       []Category
 		LoggedIn         bool
 		Username         string
+		IsModerator      bool
 		IsGuest          bool
 		SessionDuration  string
+		OnlineMembers    int
+		OnlineGuests     int
 		Filter           string
 		SelectedCategory int
+		Sort             string
+		SortOptions      []SortOption
+		NextURL          string
+		PrevURL          string
 	}{
-		Posts:            posts,
+		Posts:            page.Posts,
 		Categories:       categories,
 		LoggedIn:         loggedIn,
 		Username:         username,
+		IsModerator:      user.IsModerator(),
 		IsGuest:          isGuest,
 		SessionDuration:  sessionDuration.Round(time.Second).String(),
+		OnlineMembers:    onlineMembers,
+		OnlineGuests:     onlineGuests,
 		Filter:           filter,
 		SelectedCategory: selectedCategoryID,
+		Sort:             page.Sort,
+		SortOptions:      sortOptions,
+		NextURL:          nextURL,
+		PrevURL:          prevURL,
 	}
 
 	templatesDir := GetTemplatesDir()
@@ -135,19 +186,21 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFiles(templatePath)
+	tmpl, err := template.New("home.html").Funcs(templateFuncs).Funcs(csrfTemplateFuncs(w)).ParseFiles(templatePath)
 	if err != nil {
 		log.Printf("Failed to parse template: %v", err)
 		Error500Handler(w, r)
 		return
 	}
 
-	err = tmpl.Execute(w, data)
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
 	if err != nil {
 		log.Printf("Failed to execute template: %v", err)
 		Error500Handler(w, r)
 		return
 	}
+	buf.WriteTo(w)
 
 	log.Printf("Successfully rendered home page")
 }
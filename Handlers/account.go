@@ -0,0 +1,324 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MinPasswordLength = 8
+
+// What AccountDeletionMode does with the posts, comments and likes of a deleted account
+const (
+	DeleteAnonymize = "anonymize"
+	DeleteRemove    = "remove"
+)
+
+// settingsError is returned when a settings change is rejected because of its input
+type settingsError string
+
+func (e settingsError) Error() string {
+	return string(e)
+}
+
+func isSettingsError(err error) bool {
+	_, ok := err.(settingsError)
+	return ok
+}
+
+var errWrongPassword = settingsError("Your current password is incorrect")
+
+var errReauthRequired = settingsError("Log in again with Google or GitHub to confirm this change")
+
+// ReauthWindow is how long after logging in through Google or GitHub users without a password
+// can make changes that other users would need their password for
+const ReauthWindow = 10 * time.Minute
+
+// deletedUserPrefix starts the placeholder names of deleted accounts. Registration rejects
+// usernames with it, so the placeholder of an account is never taken.
+const deletedUserPrefix = "deleted-user-"
+
+// isReservedUsername reports whether a username is kept for deleted accounts
+func isReservedUsername(username string) bool {
+	return strings.HasPrefix(strings.ToLower(username), deletedUserPrefix)
+}
+
+// hasPassword reports whether the user can log in with a password. Accounts created
+// through Google or GitHub have none until they set one.
+func hasPassword(userID int) (bool, error) {
+	var hashed string
+	err := DB.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hashed)
+	return hashed != "", err
+}
+
+// recentLogin reports whether the user logged in to the session with sessionID within ReauthWindow
+func recentLogin(userID, sessionID int) (bool, error) {
+	var createdAt time.Time
+	err := DB.QueryRow("SELECT created_at FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return time.Since(createdAt) < ReauthWindow, nil
+}
+
+// checkPassword verifies the user's current password. Users without a password have nothing to
+// type, so they confirm who they are by having logged in to the session with sessionID recently;
+// otherwise a stolen session would be enough to take over or delete their account.
+func checkPassword(userID, sessionID int, password string) error {
+	var hashed string
+	if err := DB.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hashed); err != nil {
+		return err
+	}
+	if hashed == "" {
+		recent, err := recentLogin(userID, sessionID)
+		if err != nil {
+			return err
+		}
+		if !recent {
+			return errReauthRequired
+		}
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) != nil {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// hashNewPassword checks a new password and its confirmation and returns its bcrypt hash
+func hashNewPassword(password, confirm string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", settingsError(fmt.Sprintf("Your new password must be at least %d characters long", MinPasswordLength))
+	}
+	if password != confirm {
+		return "", settingsError("The new passwords don't match")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// ChangePassword replaces the user's password after checking the current one, and logs out
+// every other session of the user. keepSession is the session token that stays logged in, and
+// sessionID its ID.
+func ChangePassword(userID, sessionID int, current, password, confirm, keepSession string) error {
+	if err := checkPassword(userID, sessionID, current); err != nil {
+		return err
+	}
+	hashed, err := hashNewPassword(password, confirm)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", hashed, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", userID, hashSessionToken(keepSession)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validateEmail checks that an email address is well-formed and returns it without surrounding spaces
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", settingsError("Please enter a valid email address")
+	}
+	return email, nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// emailInUse reports whether another account already uses the email address
+func emailInUse(db queryRower, userID int, email string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ? AND id != ?)", email, userID).Scan(&exists)
+	return exists, err
+}
+
+// CheckEmailChange checks the user's password and the new address before a confirmation link is
+// sent to it, and returns the address cleaned up. The address only changes once the link is opened.
+func CheckEmailChange(user *User, sessionID int, password, email string) (string, error) {
+	if err := checkPassword(user.ID, sessionID, password); err != nil {
+		return "", err
+	}
+	email, err := validateEmail(email)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(email, user.Email) {
+		return "", settingsError("That is already your email address")
+	}
+	inUse, err := emailInUse(DB, user.ID, email)
+	if err != nil {
+		return "", err
+	}
+	if inUse {
+		return "", settingsError("That email address is already in use")
+	}
+	return email, nil
+}
+
+// ConfirmEmailChange uses an email change token and switches the user to the new address.
+// It returns the ID of the user whose address changed.
+func ConfirmEmailChange(token string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := consumeUserToken(tx, token, TokenEmailChange)
+	if err != nil {
+		return 0, err
+	}
+	// Someone else may have registered the address since the change was requested
+	inUse, err := emailInUse(tx, userID, email)
+	if err != nil {
+		return 0, err
+	}
+	if inUse {
+		return 0, settingsError("That email address is already in use")
+	}
+	// Opening the link proves the new address belongs to the user
+	_, err = tx.Exec("UPDATE users SET email = ?, email_verified_at = ? WHERE id = ?", email, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// DeleteAccount deletes a user's account. The user is logged out everywhere, their access
+// tokens, pending confirmations, upload history and avatar are removed, and the account is
+// renamed to a placeholder without an email address or password. The row itself stays, so
+// reports and the moderation log keep pointing at a user.
+//
+// With DeleteAnonymize the user's posts, comments and likes stay under the placeholder name;
+// with DeleteRemove they are deleted like the user had deleted each of them.
+func DeleteAccount(userID int, mode string) error {
+	if mode != DeleteAnonymize && mode != DeleteRemove {
+		return fmt.Errorf("unknown account deletion mode %q", mode)
+	}
+	if mode == DeleteRemove {
+		if err := removeUserContent(userID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var avatar sql.NullString
+	if err := tx.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&avatar); err != nil {
+		return err
+	}
+
+	statements := []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM access_tokens WHERE user_id = ?",
+		"DELETE FROM user_tokens WHERE user_id = ?",
+		"DELETE FROM upload_log WHERE user_id = ?",
+	}
+	if mode == DeleteRemove {
+		statements = append(statements, "DELETE FROM likes WHERE user_id = ?")
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			return err
+		}
+	}
+
+	placeholder := fmt.Sprintf("%s%d", deletedUserPrefix, userID)
+	_, err = tx.Exec(`
+        UPDATE users
+        SET username = ?, email = ?, password = '', role = ?, bio = '', avatar = NULL,
+            email_verified_at = NULL, deleted_at = ?
+        WHERE id = ?
+    `, placeholder, placeholder+"@invalid", RoleMember, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	var unreferenced []string
+	if avatar.Valid && avatar.String != "" {
+		if unreferenced, err = releaseImageRefs(tx, []string{avatar.String}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteUnreferencedImages(unreferenced)
+	return nil
+}
+
+// removeUserContent deletes all posts and comments of a user. Each is deleted in its own
+// transaction, so a failure leaves the account in place to try again.
+func removeUserContent(userID int) error {
+	postIDs, err := queryIDs("SELECT id FROM posts WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, postID := range postIDs {
+		if err := deletePost(postID, nil); err != nil {
+			return fmt.Errorf("deleting post %d: %w", postID, err)
+		}
+	}
+
+	// Newest first, so the user's replies are gone before the comments they reply to
+	commentIDs, err := queryIDs("SELECT id FROM comments WHERE user_id = ? AND is_deleted = 0 ORDER BY id DESC", userID)
+	if err != nil {
+		return err
+	}
+	for _, commentID := range commentIDs {
+		err := deleteComment(commentID, nil)
+		if err == sql.ErrNoRows {
+			// Already removed together with a placeholder above it
+			continue
+		} else if err != nil {
+			return fmt.Errorf("deleting comment %d: %w", commentID, err)
+		}
+	}
+	log.Printf("Removed %d post(s) and %d comment(s) of deleted user %d", len(postIDs), len(commentIDs), userID)
+	return nil
+}
+
+// queryIDs returns the integer IDs a query selects
+func queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
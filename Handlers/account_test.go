@@ -0,0 +1,127 @@
+package RebootForums
+
+import (
+	"image/color"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countRows returns how many rows of a table match a condition
+func countRows(t *testing.T, table, where string, args ...interface{}) int {
+	t.Helper()
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDeleteAccount(t *testing.T) {
+	tests := []struct {
+		mode        string
+		wantContent bool // whether the user's posts, comments and likes stay
+	}{
+		{DeleteAnonymize, true},
+		{DeleteRemove, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useTestDB(t)
+			useTestStore(t)
+			userID := createTestUser(t, "leaving")
+			other := createTestUser(t, "staying")
+
+			ownPost := createTestPost(t, userID, "own post", time.Now())
+			othersPost := createTestPost(t, other, "other post", time.Now())
+			answered := createTestComment(t, userID, othersPost, 0, "answered")
+			reply := createTestComment(t, other, othersPost, answered, "reply")
+			leaf := createTestComment(t, userID, othersPost, 0, "leaf")
+			if _, err := DB.Exec("INSERT INTO likes (user_id, post_id, is_like) VALUES (?, ?, 1)", userID, othersPost); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := UpsertSession(&userID, "session", false, false, "", ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := CreateAccessToken(userID, "script", []string{ScopeRead}, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := createUserToken(DB, userID, TokenPasswordReset, "leaving@example.com", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			avatar := uploadTestImage(t, testPNG(t, color.White))
+			if err := updateProfile(userID, "bio", avatar, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := recordUpload(userID, avatar, 10); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := DeleteAccount(userID, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			var username, email, password string
+			err := DB.QueryRow("SELECT username, email, password FROM users WHERE id = ?", userID).Scan(&username, &email, &password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "deleted-user-" + strconv.Itoa(userID); username != want {
+				t.Errorf("username = %q, want %q", username, want)
+			}
+			if email == "leaving@example.com" || password != "" {
+				t.Errorf("the account kept its email address %q or password %q", email, password)
+			}
+			for _, table := range []string{"sessions", "access_tokens", "user_tokens", "upload_log"} {
+				if n := countRows(t, table, "user_id = ?", userID); n != 0 {
+					t.Errorf("%d row(s) left in %s", n, table)
+				}
+			}
+			if refs := imageRefCount(t, avatar); refs != -1 {
+				t.Errorf("the avatar is still referenced %d time(s)", refs)
+			}
+			if exists, err := Store.Exists(avatar); err != nil || exists {
+				t.Errorf("the avatar is still stored: %v", err)
+			}
+
+			// The other user's reply stays either way
+			if c, err := getComment(othersPost, reply); err != nil || c.Author != "staying" || c.Content != "reply" {
+				t.Errorf("the other user's reply = %+v, %v", c, err)
+			}
+			parent, err := getComment(othersPost, answered)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantContent {
+				if n := countRows(t, "posts", "user_id = ?", userID); n != 1 {
+					t.Errorf("%d post(s) left, want 1", n)
+				}
+				if n := countRows(t, "comments", "user_id = ? AND is_deleted = 0", userID); n != 2 {
+					t.Errorf("%d comment(s) left, want 2", n)
+				}
+				if n := countRows(t, "likes", "user_id = ?", userID); n != 1 {
+					t.Errorf("%d like(s) left, want 1", n)
+				}
+				if parent.Author != username || parent.Content != "answered" {
+					t.Errorf("the answered comment shows as %q by %q, want it under %q", parent.Content, parent.Author, username)
+				}
+				return
+			}
+
+			if n := countRows(t, "posts", "id = ?", ownPost); n != 0 {
+				t.Error("the user's post is still there")
+			}
+			if n := countRows(t, "comments", "id = ?", leaf); n != 0 {
+				t.Error("the user's comment without replies is still there")
+			}
+			if n := countRows(t, "likes", "user_id = ?", userID); n != 0 {
+				t.Errorf("%d like(s) left", n)
+			}
+			if !parent.IsDeleted || parent.Author != "[deleted]" || parent.Content != "[deleted]" {
+				t.Errorf("the answered comment = %+v, want a [deleted] placeholder", parent)
+			}
+		})
+	}
+}
@@ -0,0 +1,684 @@
+package RebootForums
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxAPIBodySize     = 1 << 20 // 1 MB
+	CommentsPerPage    = 50
+	MaxCommentsPerPage = 200
+)
+
+type apiContextKey string
+
+const (
+	apiUserKey  apiContextKey = "api_user"
+	apiTokenKey apiContextKey = "api_token"
+)
+
+// APIPost is the JSON representation of a post
+type APIPost struct {
+	ID           int        `json:"id"`
+	Title        string     `json:"title"`
+	Content      string     `json:"content"`
+	Author       string     `json:"author"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	Likes        int        `json:"likes"`
+	Dislikes     int        `json:"dislikes"`
+	CommentCount int        `json:"comment_count"`
+	ViewCount    int        `json:"view_count"`
+	ImageURL     string     `json:"image_url,omitempty"`
+	ThumbnailURL string     `json:"thumbnail_url,omitempty"`
+	Images       []APIImage `json:"images,omitempty"`
+	Categories   []string   `json:"categories,omitempty"`
+	Hidden       bool       `json:"hidden"`
+	Locked       bool       `json:"locked"`
+}
+
+// APIImage is the JSON representation of an image in a post's gallery
+type APIImage struct {
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	Caption      string `json:"caption,omitempty"`
+	Animated     bool   `json:"animated"`
+}
+
+// APIComment is the JSON representation of a comment
+type APIComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Author    string    `json:"author"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Likes     int       `json:"likes"`
+	Dislikes  int       `json:"dislikes"`
+	Deleted   bool      `json:"deleted"`
+	Hidden    bool      `json:"hidden"`
+}
+
+// APICategory is the JSON representation of a category
+type APICategory struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// APIUser is the JSON representation of the authenticated user
+type APIUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// APILikeCounts is returned after liking or disliking a post or comment
+type APILikeCounts struct {
+	Likes    int `json:"likes"`
+	Dislikes int `json:"dislikes"`
+}
+
+// APIPagination holds the cursors for the neighbouring pages of a list
+type APIPagination struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+type apiResponse struct {
+	Data       interface{}    `json:"data"`
+	Pagination *APIPagination `json:"pagination,omitempty"`
+}
+
+// APIError is the body of every failed API response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type createPostRequest struct {
+	Title      string `json:"title"`
+	Content    string `json:"content"`
+	Categories []int  `json:"categories"`
+}
+
+type createCommentRequest struct {
+	Content  string `json:"content"`
+	ParentID int    `json:"parent_id"`
+}
+
+type likeRequest struct {
+	IsLike bool `json:"is_like"`
+}
+
+type moderateRequest struct {
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	Categories []int  `json:"categories"`
+}
+
+type reportRequest struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+// APIHandler serves the versioned JSON API under /api/v1/.
+// Clients authenticate with a personal access token in an "Authorization: Bearer" header;
+// the browser session cookie is not accepted.
+func APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts", apiListPosts)
+	mux.HandleFunc("POST /api/v1/posts", apiRequireScope(ScopeWrite, apiCreatePost))
+	mux.HandleFunc("GET /api/v1/posts/{id}", apiGetPost)
+	mux.HandleFunc("GET /api/v1/posts/{id}/comments", apiListComments)
+	mux.HandleFunc("POST /api/v1/posts/{id}/comments", apiRequireScope(ScopeWrite, apiCreateComment))
+	mux.HandleFunc("POST /api/v1/posts/{id}/like", apiRequireScope(ScopeWrite, apiLikePost))
+	mux.HandleFunc("POST /api/v1/comments/{id}/like", apiRequireScope(ScopeWrite, apiLikeComment))
+	mux.HandleFunc("POST /api/v1/posts/{id}/report", apiRequireScope(ScopeWrite, apiReportPost))
+	mux.HandleFunc("POST /api/v1/comments/{id}/report", apiRequireScope(ScopeWrite, apiReportComment))
+	mux.HandleFunc("POST /api/v1/posts/{id}/moderate", apiRequireScope(ScopeModerate, apiModeratePost))
+	mux.HandleFunc("POST /api/v1/comments/{id}/moderate", apiRequireScope(ScopeModerate, apiModerateComment))
+	mux.HandleFunc("GET /api/v1/categories", apiListCategories)
+	mux.HandleFunc("GET /api/v1/me", apiRequireScope(ScopeRead, apiMe))
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "No such endpoint")
+	})
+	return apiAuth(mux)
+}
+
+// apiAuth resolves the bearer token of a request into the user stored in its context
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, token, err := GetUserFromAccessToken(r)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not check access token")
+			return
+		}
+		if user == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "Invalid, expired or revoked access token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiUserKey, user)
+		ctx = context.WithValue(ctx, apiTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiRequireScope rejects requests that weren't authenticated with an access token granting scope
+func apiRequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := r.Context().Value(apiTokenKey).(*AccessToken)
+		if apiUser(r) == nil || token == nil {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "An access token is required")
+			return
+		}
+		if !token.HasScope(scope) {
+			writeAPIError(w, http.StatusForbidden, "forbidden", "This access token lacks the "+scope+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiUser returns the user authenticated for an API request, or nil
+func apiUser(r *http.Request) *User {
+	user, _ := r.Context().Value(apiUserKey).(*User)
+	return user
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding API response: %v", err)
+	}
+}
+
+func writeAPIData(w http.ResponseWriter, status int, data interface{}, pagination *APIPagination) {
+	writeAPIJSON(w, status, apiResponse{Data: data, Pagination: pagination})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIJSON(w, status, apiErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// decodeAPIRequest reads a JSON request body into v
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiPathID parses the {id} path parameter
+func apiPathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid ID")
+		return 0, false
+	}
+	return id, true
+}
+
+func toAPIPost(p Post) APIPost {
+	post := APIPost{
+		ID:           p.ID,
+		Title:        p.Title,
+		Content:      p.Content,
+		Author:       p.Author,
+		CreatedAt:    p.CreatedAt,
+		UpdatedAt:    p.UpdatedAt,
+		Likes:        p.Likes,
+		Dislikes:     p.Dislikes,
+		CommentCount: p.CommentCount,
+		ViewCount:    p.ViewCount,
+		Hidden:       p.IsHidden,
+		Locked:       p.IsLocked,
+	}
+	if p.CoverImage != "" {
+		post.ImageURL = GetImageURL(p.CoverImage, ImageFull)
+		post.ThumbnailURL = GetImageURL(p.CoverImage, ImageThumb)
+	}
+	for _, img := range p.Images {
+		post.Images = append(post.Images, APIImage{
+			URL:          GetImageURL(img.Filename, ImageFull),
+			ThumbnailURL: GetImageURL(img.Filename, ImageThumb),
+			Caption:      img.Caption,
+			Animated:     img.Animated,
+		})
+	}
+	return post
+}
+
+func toAPIComment(c Comment) APIComment {
+	return APIComment{
+		ID:        c.ID,
+		PostID:    c.PostID,
+		ParentID:  c.ParentID,
+		Author:    c.Author,
+		Content:   c.Content,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		Likes:     c.Likes,
+		Dislikes:  c.Dislikes,
+		Deleted:   c.IsDeleted,
+		Hidden:    c.IsHidden,
+	}
+}
+
+// apiListPosts lists posts, optionally filtered by category or author, with the same
+// sorting and cursors as the home feed
+func apiListPosts(w http.ResponseWriter, r *http.Request) {
+	opts := ParseFeedOptions(r)
+	query := r.URL.Query()
+
+	var page FeedPage
+	var err error
+	switch {
+	case query.Get("category") != "":
+		categoryID, convErr := strconv.Atoi(query.Get("category"))
+		if convErr != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid category ID")
+			return
+		}
+		page, err = GetPostsByCategory(categoryID, opts)
+	case query.Get("author") != "":
+		author, lookupErr := GetUserByUsername(query.Get("author"))
+		if lookupErr == sql.ErrNoRows {
+			writeAPIError(w, http.StatusNotFound, "not_found", "Author not found")
+			return
+		} else if lookupErr != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch author")
+			return
+		}
+		page, err = GetPostsByUser(author.ID, opts)
+	default:
+		page, err = GetRecentPosts(opts)
+	}
+	if err != nil {
+		if opts.After != "" || opts.Before != "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid cursor")
+			return
+		}
+		log.Printf("Error fetching posts for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch posts")
+		return
+	}
+
+	posts := make([]APIPost, 0, len(page.Posts))
+	for _, p := range page.Posts {
+		posts = append(posts, toAPIPost(p))
+	}
+	writeAPIData(w, http.StatusOK, posts, &APIPagination{NextCursor: page.NextCursor, PrevCursor: page.PrevCursor})
+}
+
+func apiGetPost(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows || (err == nil && !canViewPost(apiUser(r), post)) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Post not found")
+		return
+	} else if err != nil {
+		log.Printf("Error fetching post for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch post")
+		return
+	}
+
+	categories, err := getPostCategories(postID)
+	if err != nil {
+		log.Printf("Error fetching post categories for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch post")
+		return
+	}
+
+	apiPost := toAPIPost(post)
+	apiPost.Categories = categories
+	writeAPIData(w, http.StatusOK, apiPost, nil)
+}
+
+func apiCreatePost(w http.ResponseWriter, r *http.Request) {
+	if !apiUser(r).CanPost() {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Verify your email address before posting")
+		return
+	}
+
+	var req createPostRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	title := strings.TrimSpace(req.Title)
+	content := strings.TrimSpace(req.Content)
+	if err := validatePost(title, content); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	postID, err := createPost(apiUser(r).ID, title, content, req.Categories, nil)
+	if err != nil {
+		log.Printf("Error creating post from API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not create post")
+		return
+	}
+
+	post, err := getPost(postID)
+	if err != nil {
+		log.Printf("Error fetching created post for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch created post")
+		return
+	}
+	writeAPIData(w, http.StatusCreated, toAPIPost(post), nil)
+}
+
+// apiListComments lists a post's comments oldest first; the "after" cursor is the ID of the last comment seen
+func apiListComments(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r)
+	if !ok {
+		return
+	}
+
+	if post, err := getPost(postID); err == sql.ErrNoRows || (err == nil && !canViewPost(apiUser(r), post)) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Post not found")
+		return
+	} else if err != nil {
+		log.Printf("Error fetching post for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch comments")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = CommentsPerPage
+	}
+	if limit > MaxCommentsPerPage {
+		limit = MaxCommentsPerPage
+	}
+	afterID := 0
+	if query.Get("after") != "" {
+		afterID, err = strconv.Atoi(query.Get("after"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Invalid cursor")
+			return
+		}
+	}
+
+	// One extra comment tells whether there is a next page
+	comments, err := getCommentsAfter(postID, afterID, limit+1)
+	if err != nil {
+		log.Printf("Error fetching comments for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch comments")
+		return
+	}
+	pagination := &APIPagination{}
+	if len(comments) > limit {
+		comments = comments[:limit]
+		pagination.NextCursor = strconv.Itoa(comments[limit-1].ID)
+	}
+	if !apiUser(r).IsModerator() {
+		maskHiddenComments(comments)
+	}
+
+	result := make([]APIComment, 0, len(comments))
+	for _, c := range comments {
+		result = append(result, toAPIComment(c))
+	}
+	writeAPIData(w, http.StatusOK, result, pagination)
+}
+
+func apiCreateComment(w http.ResponseWriter, r *http.Request) {
+	postID, ok := apiPathID(w, r)
+	if !ok {
+		return
+	}
+
+	var req createCommentRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	user := apiUser(r)
+	if !user.CanPost() {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Verify your email address before commenting")
+		return
+	}
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows || (err == nil && !canViewPost(user, post)) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Post not found")
+		return
+	} else if err != nil {
+		log.Printf("Error fetching post for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not create comment")
+		return
+	}
+	if post.IsLocked && !user.IsModerator() {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "This thread is locked")
+		return
+	}
+
+	content := strings.TrimSpace(req.Content)
+	if err := validateCommentContent(content); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	if req.ParentID != 0 {
+		parentPostID, isDeleted, isHidden, err := getCommentStatus(req.ParentID)
+		if err == sql.ErrNoRows || (err == nil && parentPostID != postID) {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "Parent comment not found on this post")
+			return
+		} else if err != nil {
+			log.Printf("Error fetching parent comment for API: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not create comment")
+			return
+		}
+		if isDeleted {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "You cannot reply to a deleted comment")
+			return
+		}
+		if isHidden && !user.IsModerator() {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "You cannot reply to a hidden comment")
+			return
+		}
+		depth, err := getCommentDepth(req.ParentID)
+		if err != nil {
+			log.Printf("Error fetching comment depth for API: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not create comment")
+			return
+		}
+		if depth >= MaxCommentDepth {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("Replies cannot be nested more than %d levels deep", MaxCommentDepth))
+			return
+		}
+	}
+
+	commentID, err := addComment(user.ID, postID, req.ParentID, content)
+	if err != nil {
+		log.Printf("Error adding comment from API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not create comment")
+		return
+	}
+
+	comment, err := getComment(postID, commentID)
+	if err != nil {
+		log.Printf("Error fetching created comment for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch created comment")
+		return
+	}
+	writeAPIData(w, http.StatusCreated, toAPIComment(comment), nil)
+}
+
+func apiLikePost(w http.ResponseWriter, r *http.Request) {
+	apiLike(w, r, true)
+}
+
+func apiLikeComment(w http.ResponseWriter, r *http.Request) {
+	apiLike(w, r, false)
+}
+
+// apiLike toggles a like or dislike with the same semantics as the website's like buttons
+func apiLike(w http.ResponseWriter, r *http.Request, isPost bool) {
+	targetID, ok := apiPathID(w, r)
+	if !ok {
+		return
+	}
+
+	var req likeRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	err := checkLikeTarget(apiUser(r), targetID, isPost)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	} else if err != nil {
+		log.Printf("Error checking like target for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not save like")
+		return
+	}
+
+	if err := UpsertLike(apiUser(r).ID, targetID, req.IsLike, isPost); err != nil {
+		log.Printf("Error upserting like from API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not save like")
+		return
+	}
+
+	likes, dislikes, err := GetLikeCounts(targetID, isPost)
+	if err != nil {
+		log.Printf("Error getting like counts for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch like counts")
+		return
+	}
+	writeAPIData(w, http.StatusOK, APILikeCounts{Likes: likes, Dislikes: dislikes}, nil)
+}
+
+func apiListCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := GetAllCategories()
+	if err != nil {
+		log.Printf("Error fetching categories for API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not fetch categories")
+		return
+	}
+	result := make([]APICategory, 0, len(categories))
+	for _, c := range categories {
+		result = append(result, APICategory{ID: c.ID, Name: c.Name})
+	}
+	writeAPIData(w, http.StatusOK, result, nil)
+}
+
+func apiMe(w http.ResponseWriter, r *http.Request) {
+	user := apiUser(r)
+	writeAPIData(w, http.StatusOK, APIUser{ID: user.ID, Username: user.Username}, nil)
+}
+
+func apiReportPost(w http.ResponseWriter, r *http.Request) {
+	apiReport(w, r, TargetPost)
+}
+
+func apiReportComment(w http.ResponseWriter, r *http.Request) {
+	apiReport(w, r, TargetComment)
+}
+
+// apiReport reports a post or comment with the same rules as the website's report forms
+func apiReport(w http.ResponseWriter, r *http.Request, targetType string) {
+	targetID, ok := apiPathID(w, r)
+	if !ok {
+		return
+	}
+
+	var req reportRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	_, err := CreateReport(apiUser(r), targetType, targetID, req.Reason, req.Details)
+	switch {
+	case err == sql.ErrNoRows:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	case err == errDuplicateReport:
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	case isModerationInputError(err):
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case err != nil:
+		log.Printf("Error creating report from API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not submit report")
+	default:
+		writeAPIData(w, http.StatusCreated, map[string]interface{}{"reported": targetType, "id": targetID}, nil)
+	}
+}
+
+// apiModerate decodes a moderation request; it writes an error and returns false
+// unless the token's user is a moderator
+func apiModerate(w http.ResponseWriter, r *http.Request) (int, moderateRequest, bool) {
+	var req moderateRequest
+	if !apiUser(r).IsModerator() {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Only moderators can moderate content")
+		return 0, req, false
+	}
+	targetID, ok := apiPathID(w, r)
+	if !ok || !decodeAPIRequest(w, r, &req) {
+		return 0, req, false
+	}
+	reason, err := validateModerationReason(req.Reason)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return 0, req, false
+	}
+	req.Reason = reason
+	return targetID, req, true
+}
+
+// writeModerationResult reports the outcome of a moderation action
+func writeModerationResult(w http.ResponseWriter, err error, action string, targetID int) {
+	switch {
+	case err == sql.ErrNoRows:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	case isModerationInputError(err):
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case err != nil:
+		log.Printf("Error moderating from API: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Could not apply moderation action")
+	default:
+		writeAPIData(w, http.StatusOK, map[string]interface{}{"action": action, "id": targetID}, nil)
+	}
+}
+
+func apiModeratePost(w http.ResponseWriter, r *http.Request) {
+	postID, req, ok := apiModerate(w, r)
+	if !ok {
+		return
+	}
+	err := moderatePost(apiUser(r), postID, req.Action, req.Categories, req.Reason)
+	writeModerationResult(w, err, req.Action, postID)
+}
+
+func apiModerateComment(w http.ResponseWriter, r *http.Request) {
+	commentID, req, ok := apiModerate(w, r)
+	if !ok {
+		return
+	}
+	_, err := moderateComment(apiUser(r), commentID, req.Action, req.Reason)
+	writeModerationResult(w, err, req.Action, commentID)
+}
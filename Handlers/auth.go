@@ -35,21 +35,11 @@ var (
 		Scopes:       []string{"user:email"},
 		Endpoint:     github.Endpoint,
 	}
-
-	oauthStateString string
 )
 
-func init() {
-	u, err := uuid.NewV4()
-	if err != nil {
-		log.Fatalf("Failed to generate UUID: %v", err)
-	}
-	oauthStateString = u.String()
-}
-
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		RenderTemplate(w, "register.html", nil)
+		RenderTemplate(w, "register.html", map[string]interface{}{"Next": loginRedirectTarget(r)})
 		return
 	}
 
@@ -62,6 +52,10 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "All fields are required"})
 			return
 		}
+		if isReservedUsername(username) {
+			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "That username is not available"})
+			return
+		}
 
 		var exists bool
 		err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? OR email = ?)", username, email).Scan(&exists)
@@ -82,7 +76,8 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err = DB.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)", username, email, string(hashedPassword))
+		_, err = DB.Exec("INSERT INTO users (username, email, password, created_at) VALUES (?, ?, ?, ?)",
+			username, email, string(hashedPassword), time.Now())
 		if err != nil {
 			log.Printf("Error creating user: %v", err)
 			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating user"})
@@ -98,34 +93,20 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Generate a session token
-		sessionToken, err := generateSessionToken()
-		if err != nil {
-			log.Printf("Error generating session token: %v", err)
+		if err := startSession(w, r, userID, false); err != nil {
+			log.Printf("Error creating session: %v", err)
 			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating session"})
 			return
 		}
 
-		expiryTime := time.Now().Add(24 * time.Hour)
-		err = UpsertSession(&userID, sessionToken, expiryTime, false)
-		if err != nil {
-			log.Printf("Error creating session: %v", err)
-			RenderTemplate(w, "register.html", map[string]interface{}{"Message": "Error creating session"})
-			return
+		// The new user can browse right away, but has to verify their email address to post.
+		// If sending fails they can ask for another link from the verification page.
+		newUser := &User{ID: userID, Username: username, Email: email}
+		if err := sendVerificationEmail(r, newUser); err != nil {
+			log.Printf("Error sending verification email: %v", err)
 		}
 
-		// Set the session cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionToken,
-			Expires:  expiryTime,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
-		})
-
-		// Redirect to the homepage or a different page as needed
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, "/verify-email", http.StatusSeeOther)
 	}
 }
 
@@ -135,19 +116,30 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		error := false
 		if r.URL.Query().Get("registered") == "true" {
 			message = "Registration successful. Please log in."
+		} else if r.URL.Query().Get("reset") == "true" {
+			message = "Your password has been changed. Please log in."
+		} else if r.URL.Query().Get("oauth") == "failed" {
+			message = "Logging in with Google or GitHub didn't complete. Please try again."
+			error = true
+		} else if r.URL.Query().Get("oauth") == "unverified" {
+			message = "Your Google account's email address isn't verified. Verify it with Google, or register with a password."
+			error = true
 		}
-		RenderTemplate(w, "login.html", map[string]interface{}{"Message": message, "Error": error})
+		RenderTemplate(w, "login.html", map[string]interface{}{"Message": message, "Error": error, "Next": loginRedirectTarget(r)})
 		return
 	}
 
 	if r.Method == "POST" {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
+		// The page to go back to once logged in, kept by the form when it is shown again
+		next := safeRedirectTarget(r.FormValue("next"))
 
 		if username == "" || password == "" {
 			RenderTemplate(w, "login.html", map[string]interface{}{
 				"Message": "Username and password are required",
 				"Error":   true,
+				"Next":    next,
 			})
 			return
 		}
@@ -160,12 +152,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 				RenderTemplate(w, "login.html", map[string]interface{}{
 					"Message": "Invalid username or password",
 					"Error":   true,
+					"Next":    next,
 				})
 			} else {
 				log.Printf("Database error during login: %v", err)
 				RenderTemplate(w, "login.html", map[string]interface{}{
 					"Message": "An error occurred. Please try again later.",
 					"Error":   true,
+					"Next":    next,
 				})
 			}
 			return
@@ -175,52 +169,22 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			RenderTemplate(w, "login.html", map[string]interface{}{
 				"Message": "Invalid username or password",
 				"Error":   true,
+				"Next":    next,
 			})
 			return
 		}
 
-		// Delete any existing sessions for this user
-		_, err = DB.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID)
-		if err != nil {
-			log.Printf("Error deleting existing sessions: %v", err)
-			RenderTemplate(w, "login.html", map[string]interface{}{
-				"Message": "An error occurred. Please try again later.",
-				"Error":   true,
-			})
-			return
-		}
-
-		sessionToken, err := generateSessionToken()
-		if err != nil {
-			log.Printf("Error generating session token: %v", err)
-			RenderTemplate(w, "login.html", map[string]interface{}{
-				"Message": "An error occurred. Please try again later.",
-				"Error":   true,
-			})
-			return
-		}
-
-		expiryTime := time.Now().Add(24 * time.Hour)
-		err = UpsertSession(&user.ID, sessionToken, expiryTime, false)
-		if err != nil {
+		if err := startSession(w, r, user.ID, r.FormValue("remember") != ""); err != nil {
 			log.Printf("Error creating session: %v", err)
 			RenderTemplate(w, "login.html", map[string]interface{}{
 				"Message": "An error occurred. Please try again later.",
 				"Error":   true,
+				"Next":    next,
 			})
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionToken,
-			Expires:  expiryTime,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
-		})
-
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, next, http.StatusSeeOther)
 	}
 }
 
@@ -234,7 +198,7 @@ func generateSessionToken() (string, error) {
 
 func GetUserByUsername(username string) (*User, error) {
 	var user User
-	err := DB.QueryRow("SELECT id, username, email, password FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	err := DB.QueryRow("SELECT id, username, email, password, role, email_verified_at IS NOT NULL FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.EmailVerified)
 	if err != nil {
 		log.Printf("Error getting user by username: %v", err)
 		return nil, err
@@ -242,7 +206,14 @@ func GetUserByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
+// LogoutHandler ends the session of the browser. It only accepts POST, so that other sites can't
+// log users out with a link or an image.
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
 	c, err := r.Cookie("session_token")
 	if err != nil {
 		// If there's no session cookie, just redirect to home page
@@ -263,6 +234,7 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 		Expires:  time.Now().Add(-1 * time.Hour), // Set expiry in the past
 		MaxAge:   -1,
 	})
@@ -272,18 +244,21 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
-	url := googleOauthConfig.AuthCodeURL(oauthStateString)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	if err := beginOAuthLogin(w, r, "google", googleOauthConfig); err != nil {
+		log.Printf("Error starting Google login: %v", err)
+		Error500Handler(w, r)
+	}
 }
 
 func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	if r.FormValue("state") != oauthStateString {
-		log.Printf("Invalid oauth state")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	login, err := finishOAuthLogin(w, r, "google")
+	if err != nil {
+		log.Printf("Rejected Google callback: %v", err)
+		http.Redirect(w, r, "/login?oauth=failed", http.StatusSeeOther)
 		return
 	}
 
-	token, err := googleOauthConfig.Exchange(context.Background(), r.FormValue("code"))
+	token, err := exchangeOAuthCode(r, googleOauthConfig, login)
 	if err != nil {
 		log.Printf("Code exchange failed: %s", err.Error())
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -306,8 +281,9 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var userInfo struct {
-		Email string `json:"email"`
-		Name  string `json:"name"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+		Name          string `json:"name"`
 	}
 	if err := json.Unmarshal(contents, &userInfo); err != nil {
 		log.Printf("Failed to parse user info: %s", err.Error())
@@ -315,6 +291,14 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// GetOrCreateUser trusts the address: it logs in the account that uses it and marks it verified.
+	// An address Google hasn't verified could belong to anyone.
+	if userInfo.Email == "" || !userInfo.VerifiedEmail {
+		log.Printf("Rejected Google login with unverified email %q", userInfo.Email)
+		http.Redirect(w, r, "/login?oauth=unverified", http.StatusSeeOther)
+		return
+	}
+
 	user, err := GetOrCreateUser(userInfo.Email, userInfo.Name, "google")
 	if err != nil {
 		log.Printf("Failed to get or create user: %s", err.Error())
@@ -322,26 +306,28 @@ func GoogleCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createSessionAndRedirect(w, r, user)
+	createSessionAndRedirect(w, r, user, login.Next)
 }
 
 func GithubLoginHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("GitHub login handler called")
-	url := githubOauthConfig.AuthCodeURL(oauthStateString)
-	log.Printf("Redirecting to GitHub OAuth URL: %s", url)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	if err := beginOAuthLogin(w, r, "github", githubOauthConfig); err != nil {
+		log.Printf("Error starting GitHub login: %v", err)
+		Error500Handler(w, r)
+	}
 }
 
 func GithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("GitHub callback handler called")
 
-	if r.FormValue("state") != oauthStateString {
-		log.Printf("Invalid oauth state, expected %s, got %s", oauthStateString, r.FormValue("state"))
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	login, err := finishOAuthLogin(w, r, "github")
+	if err != nil {
+		log.Printf("Rejected GitHub callback: %v", err)
+		http.Redirect(w, r, "/login?oauth=failed", http.StatusSeeOther)
 		return
 	}
 
-	token, err := githubOauthConfig.Exchange(context.Background(), r.FormValue("code"))
+	token, err := exchangeOAuthCode(r, githubOauthConfig, login)
 	if err != nil {
 		log.Printf("Code exchange failed: %s", err.Error())
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -377,7 +363,8 @@ func GithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If email is not public, fetch it separately
+	// If email is not public, fetch it separately. GitHub only lets users make a verified address
+	// public, and only the verified primary address is taken from the list.
 	if userInfo.Email == "" {
 		log.Println("Email not found in initial response, fetching emails separately")
 		emailResponse, err := client.Get("https://api.github.com/user/emails")
@@ -422,16 +409,20 @@ func GithubCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	createSessionAndRedirect(w, r, user)
+	createSessionAndRedirect(w, r, user, login.Next)
 }
 
+// GetOrCreateUser returns the account using an email address a provider has verified, creating
+// one when there is none. Callers must only pass addresses the provider reports as verified.
 func GetOrCreateUser(email, name, provider string) (*User, error) {
 	var user User
 	err := DB.QueryRow("SELECT id, username, email FROM users WHERE email = ?", email).Scan(&user.ID, &user.Username, &user.Email)
 	if err == sql.ErrNoRows {
-		// User doesn't exist, create a new one
+		// User doesn't exist, create a new one. The provider has verified the email address.
 		username := generateUsername(email, name, provider)
-		result, err := DB.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)", username, email, "")
+		now := time.Now()
+		result, err := DB.Exec("INSERT INTO users (username, email, password, created_at, email_verified_at) VALUES (?, ?, ?, ?, ?)",
+			username, email, "", now, now)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create user: %v", err)
 		}
@@ -446,6 +437,12 @@ func GetOrCreateUser(email, name, provider string) (*User, error) {
 		}
 	} else if err != nil {
 		return nil, fmt.Errorf("failed to query user: %v", err)
+	} else {
+		// Logging in through the provider proves the address of an account that registered with a password
+		_, err = DB.Exec("UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?", time.Now(), user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify user email: %v", err)
+		}
 	}
 
 	return &user, nil
@@ -483,30 +480,13 @@ func generateUsername(email, name, provider string) string {
 	}
 }
 
-func createSessionAndRedirect(w http.ResponseWriter, r *http.Request, user *User) {
-	sessionToken, err := generateSessionToken()
-	if err != nil {
-		log.Printf("Error generating session token: %v", err)
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	expiryTime := time.Now().Add(24 * time.Hour)
-	err = UpsertSession(&user.ID, sessionToken, expiryTime, false)
-	if err != nil {
+// createSessionAndRedirect logs in the user of an OAuth callback and sends them on to next
+func createSessionAndRedirect(w http.ResponseWriter, r *http.Request, user *User, next string) {
+	if err := startSession(w, r, user.ID, false); err != nil {
 		log.Printf("Error creating session: %v", err)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    sessionToken,
-		Expires:  expiryTime,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   r.TLS != nil,
-	})
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, next, http.StatusSeeOther)
 }
@@ -1,7 +1,7 @@
 package RebootForums
 
 import (
-	//	"database/sql"
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,14 +10,48 @@ import (
 	"time"
 )
 
-func getCommentsByPostID(postID int) ([]Comment, error) {
-	rows, err := DB.Query(`
-        SELECT c.id, c.content, u.username, c.created_at
+// commentSelect selects the columns scanComment reads: comments c with their author and like
+// counts. Like counts are only computed for the comments of the post bound to :post.
+const commentSelect = `
+        SELECT c.id, c.post_id, c.parent_id, c.content, u.username, c.is_deleted, c.is_hidden, c.created_at, c.updated_at,
+               COALESCE(lk.likes, 0), COALESCE(lk.dislikes, 0)
         FROM comments c
         JOIN users u ON c.user_id = u.id
-        WHERE c.post_id = ?
-        ORDER BY c.created_at ASC
-    `, postID)
+        LEFT JOIN (
+            SELECT l.comment_id,
+                   SUM(CASE WHEN l.is_like = 1 THEN 1 ELSE 0 END) AS likes,
+                   SUM(CASE WHEN l.is_like = 0 THEN 1 ELSE 0 END) AS dislikes
+            FROM likes l
+            JOIN comments lc ON lc.id = l.comment_id
+            WHERE lc.post_id = :post
+            GROUP BY l.comment_id
+        ) lk ON lk.comment_id = c.id`
+
+// scanComment reads a row selected with commentSelect. Deleted comments lose their author and content.
+func scanComment(row interface{ Scan(...interface{}) error }) (Comment, error) {
+	var comment Comment
+	var parentID sql.NullInt64
+	var updatedAt sql.NullTime
+	err := row.Scan(&comment.ID, &comment.PostID, &parentID, &comment.Content, &comment.Author, &comment.IsDeleted,
+		&comment.IsHidden, &comment.CreatedAt, &updatedAt, &comment.Likes, &comment.Dislikes)
+	if err != nil {
+		return comment, err
+	}
+	comment.ParentID = int(parentID.Int64)
+	if comment.IsDeleted {
+		comment.Author = "[deleted]"
+		comment.Content = "[deleted]"
+	}
+	comment.UpdatedAt = comment.CreatedAt
+	if updatedAt.Valid {
+		comment.UpdatedAt = updatedAt.Time
+	}
+	return comment, nil
+}
+
+// queryComments runs a query selecting commentSelect and returns the comments it finds
+func queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := DB.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -25,18 +59,94 @@ func getCommentsByPostID(postID int) ([]Comment, error) {
 
 	var comments []Comment
 	for rows.Next() {
-		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.Author, &comment.CreatedAt); err != nil {
-			return nil, err
-		}
-		// Get like counts for each comment
-		comment.Likes, comment.Dislikes, err = GetLikeCounts(comment.ID, false) // false indicates it's a comment
+		comment, err := scanComment(rows)
 		if err != nil {
 			return nil, err
 		}
 		comments = append(comments, comment)
 	}
-	return comments, nil
+	return comments, rows.Err()
+}
+
+func getCommentsByPostID(postID int) ([]Comment, error) {
+	return queryComments(commentSelect+`
+        WHERE c.post_id = :post
+        ORDER BY c.created_at ASC
+    `, sql.Named("post", postID))
+}
+
+// getCommentsAfter returns up to limit comments of a post with IDs above afterID, in ID order
+func getCommentsAfter(postID, afterID, limit int) ([]Comment, error) {
+	return queryComments(commentSelect+`
+        WHERE c.post_id = :post AND c.id > :after
+        ORDER BY c.id ASC
+        LIMIT :limit
+    `, sql.Named("post", postID), sql.Named("after", afterID), sql.Named("limit", limit))
+}
+
+// getComment returns a comment of a post
+func getComment(postID, commentID int) (Comment, error) {
+	return scanComment(DB.QueryRow(commentSelect+`
+        WHERE c.post_id = :post AND c.id = :id
+    `, sql.Named("post", postID), sql.Named("id", commentID)))
+}
+
+// getCommentTree returns the comments of a post nested under their parents.
+// Replies nested deeper than MaxCommentDepth are shown flattened at that depth.
+// The content of hidden comments is masked unless showHidden is set.
+func getCommentTree(postID int, showHidden bool) ([]Comment, error) {
+	comments, err := getCommentsByPostID(postID)
+	if err != nil {
+		return nil, err
+	}
+	if !showHidden {
+		maskHiddenComments(comments)
+	}
+	return buildCommentTree(comments, MaxCommentDepth), nil
+}
+
+func buildCommentTree(comments []Comment, maxDepth int) []Comment {
+	children := make(map[int][]Comment)
+	known := make(map[int]bool, len(comments))
+	for _, c := range comments {
+		known[c.ID] = true
+	}
+	for _, c := range comments {
+		parent := c.ParentID
+		if !known[parent] {
+			// Orphaned replies are shown at the top level
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+
+	var attach func(parentID, depth int) []Comment
+	attach = func(parentID, depth int) []Comment {
+		var nodes []Comment
+		for _, c := range children[parentID] {
+			c.Depth = depth
+			if depth < maxDepth {
+				c.Replies = attach(c.ID, depth+1)
+				nodes = append(nodes, c)
+			} else {
+				nodes = append(nodes, c)
+				nodes = append(nodes, flattenReplies(c.ID, depth, children)...)
+			}
+		}
+		return nodes
+	}
+	return attach(0, 0)
+}
+
+// flattenReplies collects every descendant of a comment as siblings at the given depth
+func flattenReplies(parentID, depth int, children map[int][]Comment) []Comment {
+	var flat []Comment
+	for _, c := range children[parentID] {
+		c.Depth = depth
+		flat = append(flat, c)
+		flat = append(flat, flattenReplies(c.ID, depth, children)...)
+	}
+	return flat
 }
 
 // func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
@@ -81,11 +191,15 @@ func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		http.Error(w, "You must be logged in to comment", http.StatusUnauthorized)
 		return
 	}
+	if !user.CanPost() {
+		http.Error(w, "Please verify your email address before commenting", http.StatusForbidden)
+		return
+	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
@@ -93,45 +207,368 @@ func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkThreadOpen(w, postID, user) {
+		return
+	}
+
 	content := strings.TrimSpace(r.FormValue("content"))
+	if err := validateCommentContent(content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = addComment(user.ID, postID, 0, content)
+	if err != nil {
+		log.Printf("Error adding comment: %v", err)
+		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+}
+
+// checkThreadOpen writes an error and returns false when comments can't be added to the post
+// because it doesn't exist, is hidden from the user or a moderator locked it. Moderators can
+// still comment on locked threads.
+func checkThreadOpen(w http.ResponseWriter, postID int, user *User) bool {
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows || (err == nil && !canViewPost(user, post)) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Error fetching post for comment: %v", err)
+		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		return false
+	}
+	if post.IsLocked && !user.IsModerator() {
+		http.Error(w, "This thread is locked", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// validateCommentContent checks that a comment is neither empty nor longer than MaxCommentLength
+func validateCommentContent(content string) error {
 	contentLength := len(content)
 
 	if contentLength == 0 {
-		http.Error(w, "Comment cannot be empty", http.StatusBadRequest)
-		return
+		return fmt.Errorf("Comment cannot be empty")
 	}
 
 	if contentLength > MaxCommentLength {
-		http.Error(w, fmt.Sprintf("Comment is too long. Maximum length is %d characters, your comment has %d characters.", MaxCommentLength, contentLength), http.StatusBadRequest)
+		return fmt.Errorf("Comment is too long. Maximum length is %d characters, your comment has %d characters.", MaxCommentLength, contentLength)
+	}
+
+	return nil
+}
+
+// addComment inserts a comment on a post, as a reply to parentID when it is non-zero,
+// and returns its ID
+func addComment(userID, postID, parentID int, content string) (int, error) {
+	var parent sql.NullInt64
+	if parentID != 0 {
+		parent = sql.NullInt64{Int64: int64(parentID), Valid: true}
+	}
+	now := time.Now()
+	result, err := DB.Exec(`
+        INSERT INTO comments (user_id, post_id, parent_id, content, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, userID, postID, parent, content, now, now)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func ReplyCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	err = addComment(user.ID, postID, content)
+	user := CurrentUser(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to reply", http.StatusUnauthorized)
+		return
+	}
+	if !user.CanPost() {
+		http.Error(w, "Please verify your email address before replying", http.StatusForbidden)
+		return
+	}
+
+	parentID, err := strconv.Atoi(r.URL.Path[len("/reply-comment/"):])
 	if err != nil {
-		log.Printf("Error adding comment: %v", err)
-		http.Error(w, "Error adding comment", http.StatusInternalServerError)
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+
+	postID, isDeleted, isHidden, err := getCommentStatus(parentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching parent comment: %v", err)
+		http.Error(w, "Error adding reply", http.StatusInternalServerError)
+		return
+	}
+
+	if isDeleted {
+		http.Error(w, "You cannot reply to a deleted comment", http.StatusBadRequest)
+		return
+	}
+	// Only moderators see what a hidden comment says, so only they can reply to it
+	if isHidden && !user.IsModerator() {
+		http.Error(w, "You cannot reply to a hidden comment", http.StatusBadRequest)
+		return
+	}
+
+	if !checkThreadOpen(w, postID, user) {
+		return
+	}
+
+	depth, err := getCommentDepth(parentID)
+	if err != nil {
+		log.Printf("Error fetching comment depth: %v", err)
+		http.Error(w, "Error adding reply", http.StatusInternalServerError)
+		return
+	}
+
+	if depth >= MaxCommentDepth {
+		http.Error(w, fmt.Sprintf("Replies cannot be nested more than %d levels deep", MaxCommentDepth), http.StatusBadRequest)
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if err := validateCommentContent(content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = addComment(user.ID, postID, parentID, content)
+	if err != nil {
+		log.Printf("Error adding reply: %v", err)
+		http.Error(w, "Error adding reply", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/post/%d#comment-%d", postID, parentID), http.StatusSeeOther)
+}
+
+// getCommentStatus returns the post a comment belongs to, and whether it was deleted or hidden
+func getCommentStatus(commentID int) (postID int, isDeleted, isHidden bool, err error) {
+	err = DB.QueryRow("SELECT post_id, is_deleted, is_hidden FROM comments WHERE id = ?", commentID).Scan(&postID, &isDeleted, &isHidden)
+	return
+}
+
+// getCommentDepth returns how many ancestors a comment has; top-level comments have depth 0
+func getCommentDepth(commentID int) (int, error) {
+	var depth int
+	err := DB.QueryRow(`
+        WITH RECURSIVE ancestors(id, parent_id, depth) AS (
+            SELECT id, parent_id, 0 FROM comments WHERE id = ?
+            UNION ALL
+            SELECT c.id, c.parent_id, a.depth + 1
+            FROM comments c
+            JOIN ancestors a ON c.id = a.parent_id
+        )
+        SELECT MAX(depth) FROM ancestors
+    `, commentID).Scan(&depth)
+	return depth, err
+}
+
+func EditCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to edit a comment", http.StatusUnauthorized)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.URL.Path[len("/edit-comment/"):])
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+
+	postID, authorID, err := getCommentOwner(commentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, "Error editing comment", http.StatusInternalServerError)
+		return
+	}
+
+	if authorID != user.ID {
+		http.Error(w, "You can only edit your own comments", http.StatusForbidden)
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if err := validateCommentContent(content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = updateComment(commentID, content)
+	if err == sql.ErrNoRows {
+		// Deleted comments are kept as placeholders, but can't be edited
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error updating comment: %v", err)
+		http.Error(w, "Error editing comment", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/post/%d#comment-%d", postID, commentID), http.StatusSeeOther)
+}
+
+func DeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to delete a comment", http.StatusUnauthorized)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.URL.Path[len("/delete-comment/"):])
+	if err != nil {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+
+	postID, authorID, err := getCommentOwner(commentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching comment: %v", err)
+		http.Error(w, "Error deleting comment", http.StatusInternalServerError)
+		return
+	}
+
+	if authorID != user.ID {
+		if !user.IsModerator() {
+			http.Error(w, "You can only delete your own comments", http.StatusForbidden)
+			return
+		}
+		// Moderators deleting someone else's comment go through the audited path
+		_, err = moderateComment(user, commentID, "delete", "")
+	} else {
+		err = deleteComment(commentID, nil)
+	}
+	if err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		http.Error(w, "Error deleting comment", http.StatusInternalServerError)
 		return
 	}
 
 	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
 }
 
-func addComment(userID, postID int, content string) error {
-	_, err := DB.Exec(`
-        INSERT INTO comments (user_id, post_id, content, created_at)
-        VALUES (?, ?, ?, ?)
-    `, userID, postID, content, time.Now())
-	return err
+// getCommentOwner returns the post a comment belongs to and the ID of its author
+func getCommentOwner(commentID int) (postID, userID int, err error) {
+	err = DB.QueryRow("SELECT post_id, user_id FROM comments WHERE id = ?", commentID).Scan(&postID, &userID)
+	return
 }
 
-// //func getPostIDFromCommentID(commentID int) (int, error) {
-// 	var postID int
-// 	err := DB.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID)
-// 	if err != nil {
-// 		if err == sql.ErrNoRows {
-// 			return 0, fmt.Errorf("no comment found with ID %d", commentID)
-// 		}
-// 		return 0, fmt.Errorf("error retrieving post ID for comment %d: %w", commentID, err)
-// 	}
-// 	return postID, nil
-// //}
+// updateComment replaces the content of a comment. It returns sql.ErrNoRows when the comment
+// doesn't exist or has been deleted.
+func updateComment(commentID int, content string) error {
+	result, err := DB.Exec("UPDATE comments SET content = ?, updated_at = ? WHERE id = ? AND is_deleted = 0", content, time.Now(), commentID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// deleteComment removes a comment and its likes. Comments that still have replies are
+// kept as a "[deleted]" placeholder so the thread below them stays readable, and
+// placeholders left without any replies are removed as well. When action is not nil
+// it is recorded in the moderation log in the same transaction.
+func deleteComment(commentID int, action *ModerationAction) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var moderatorID int
+	if action != nil {
+		moderatorID = action.ModeratorID
+		if err := logModerationAction(tx, *action); err != nil {
+			return err
+		}
+	}
+	if _, err := closeReports(tx, ReportRemoved, moderatorID, TargetComment, commentID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM likes WHERE comment_id = ?", commentID)
+	if err != nil {
+		return err
+	}
+
+	var hasReplies bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM comments WHERE parent_id = ?)", commentID).Scan(&hasReplies)
+	if err != nil {
+		return err
+	}
+
+	if hasReplies {
+		_, err = tx.Exec("UPDATE comments SET content = '', is_deleted = 1, updated_at = ? WHERE id = ?", time.Now(), commentID)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	for commentID != 0 {
+		var parentID sql.NullInt64
+		err = tx.QueryRow("SELECT parent_id FROM comments WHERE id = ?", commentID).Scan(&parentID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM comments WHERE id = ?", commentID)
+		if err != nil {
+			return err
+		}
+
+		// Walk up while the parent is a placeholder that no longer has replies
+		commentID = 0
+		if parentID.Valid {
+			var prune bool
+			err = tx.QueryRow(`
+                SELECT is_deleted AND NOT EXISTS(SELECT 1 FROM comments WHERE parent_id = ?)
+                FROM comments WHERE id = ?
+            `, parentID.Int64, parentID.Int64).Scan(&prune)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if prune {
+				commentID = int(parentID.Int64)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,237 @@
+package RebootForums
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckThreadOpen(t *testing.T) {
+	useTestDB(t)
+	author := &User{ID: createTestUser(t, "author"), Username: "author", Role: RoleMember}
+	member := &User{ID: createTestUser(t, "member"), Username: "member", Role: RoleMember}
+	moderator := &User{ID: createTestUser(t, "mod"), Username: "mod", Role: RoleModerator}
+
+	open := createTestPost(t, author.ID, "open", time.Now())
+	locked := createTestPost(t, author.ID, "locked", time.Now())
+	hidden := createTestPost(t, author.ID, "hidden", time.Now())
+	if _, err := DB.Exec("UPDATE posts SET is_locked = 1 WHERE id = ?", locked); err != nil {
+		t.Fatal(err)
+	}
+	// A hidden post that is also locked answers as missing rather than locked
+	if _, err := DB.Exec("UPDATE posts SET is_hidden = 1, is_locked = 1 WHERE id = ?", hidden); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   *User
+		postID int
+		want   int // 0 when comments can be added
+	}{
+		{"open post", member, open, 0},
+		{"missing post", member, 9999, http.StatusNotFound},
+		{"locked post", member, locked, http.StatusForbidden},
+		{"locked post by a moderator", moderator, locked, 0},
+		{"hidden post", member, hidden, http.StatusNotFound},
+		{"hidden post by a moderator", moderator, hidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := checkThreadOpen(w, tt.postID, tt.user)
+			if ok != (tt.want == 0) || (!ok && w.Code != tt.want) {
+				t.Errorf("got %v with status %d, want status %d", ok, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteComment(t *testing.T) {
+	type comment struct {
+		name    string
+		parent  string // empty for top-level comments
+		deleted bool   // already a "[deleted]" placeholder
+	}
+	tests := []struct {
+		name     string
+		thread   []comment
+		del      string
+		wantLeft map[string]bool // the comments left and whether they are placeholders
+	}{
+		{
+			name:     "leaf",
+			thread:   []comment{{name: "a"}, {name: "b"}},
+			del:      "a",
+			wantLeft: map[string]bool{"b": false},
+		},
+		{
+			name:     "leaf under a placeholder",
+			thread:   []comment{{name: "parent", deleted: true}, {name: "reply", parent: "parent"}},
+			del:      "reply",
+			wantLeft: map[string]bool{},
+		},
+		{
+			name: "leaf under a chain of placeholders",
+			thread: []comment{
+				{name: "top", deleted: true},
+				{name: "parent", parent: "top", deleted: true},
+				{name: "reply", parent: "parent"},
+			},
+			del:      "reply",
+			wantLeft: map[string]bool{},
+		},
+		{
+			name: "placeholder with other replies",
+			thread: []comment{
+				{name: "parent", deleted: true},
+				{name: "reply", parent: "parent"},
+				{name: "other", parent: "parent"},
+			},
+			del:      "reply",
+			wantLeft: map[string]bool{"parent": true, "other": false},
+		},
+		{
+			name:     "leaf under a comment",
+			thread:   []comment{{name: "parent"}, {name: "reply", parent: "parent"}},
+			del:      "reply",
+			wantLeft: map[string]bool{"parent": false},
+		},
+		{
+			name:     "parent with replies",
+			thread:   []comment{{name: "parent"}, {name: "reply", parent: "parent"}},
+			del:      "parent",
+			wantLeft: map[string]bool{"parent": true, "reply": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			userID := createTestUser(t, "member")
+			postID := createTestPost(t, userID, "post", time.Now())
+
+			ids := map[string]int{}
+			names := map[int]string{}
+			for _, c := range tt.thread {
+				id := createTestComment(t, userID, postID, ids[c.parent], c.name)
+				ids[c.name], names[id] = id, c.name
+				if c.deleted {
+					if _, err := DB.Exec("UPDATE comments SET content = '', is_deleted = 1 WHERE id = ?", id); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if _, err := DB.Exec("INSERT INTO likes (user_id, comment_id, is_like) VALUES (?, ?, 1)", userID, ids[tt.del]); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := deleteComment(ids[tt.del], nil); err != nil {
+				t.Fatal(err)
+			}
+
+			rows, err := DB.Query("SELECT id, content, is_deleted FROM comments")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			left := map[string]bool{}
+			for rows.Next() {
+				var id int
+				var content string
+				var deleted bool
+				if err := rows.Scan(&id, &content, &deleted); err != nil {
+					t.Fatal(err)
+				}
+				left[names[id]] = deleted
+				if deleted && content != "" {
+					t.Errorf("placeholder %s kept its content %q", names[id], content)
+				}
+			}
+			if !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("left %v, want %v", left, tt.wantLeft)
+			}
+
+			var likes int
+			if err := DB.QueryRow("SELECT COUNT(*) FROM likes WHERE comment_id = ?", ids[tt.del]).Scan(&likes); err != nil {
+				t.Fatal(err)
+			}
+			if likes != 0 {
+				t.Errorf("%d like(s) of the deleted comment left", likes)
+			}
+		})
+	}
+}
+
+// formatCommentTree writes a comment tree as "id:depth" with replies in brackets
+func formatCommentTree(comments []Comment) string {
+	var parts []string
+	for _, c := range comments {
+		part := fmt.Sprintf("%d:%d", c.ID, c.Depth)
+		if len(c.Replies) > 0 {
+			part += "[" + formatCommentTree(c.Replies) + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBuildCommentTree(t *testing.T) {
+	tests := []struct {
+		name     string
+		parents  [][2]int // comment ID and parent ID, 0 for top-level comments
+		maxDepth int
+		want     string
+	}{
+		{
+			name:     "top-level comments",
+			parents:  [][2]int{{1, 0}, {2, 0}},
+			maxDepth: 2,
+			want:     "1:0 2:0",
+		},
+		{
+			name:     "replies within the limit",
+			parents:  [][2]int{{1, 0}, {2, 1}, {3, 2}, {4, 1}},
+			maxDepth: 2,
+			want:     "1:0[2:1[3:2] 4:1]",
+		},
+		{
+			name:     "replies deeper than the limit",
+			parents:  [][2]int{{1, 0}, {2, 1}, {3, 2}, {4, 3}, {5, 4}},
+			maxDepth: 2,
+			want:     "1:0[2:1[3:2 4:2 5:2]]",
+		},
+		{
+			name:     "flattened replies keep thread order",
+			parents:  [][2]int{{1, 0}, {2, 1}, {3, 2}, {4, 2}, {5, 3}},
+			maxDepth: 1,
+			want:     "1:0[2:1 3:1 5:1 4:1]",
+		},
+		{
+			name:     "no nesting",
+			parents:  [][2]int{{1, 0}, {2, 1}, {3, 2}},
+			maxDepth: 0,
+			want:     "1:0 2:0 3:0",
+		},
+		{
+			name:     "orphaned reply",
+			parents:  [][2]int{{1, 0}, {2, 99}},
+			maxDepth: 2,
+			want:     "1:0 2:0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var comments []Comment
+			for _, p := range tt.parents {
+				comments = append(comments, Comment{ID: p[0], ParentID: p[1]})
+			}
+			if got := formatCommentTree(buildCommentTree(comments, tt.maxDepth)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
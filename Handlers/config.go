@@ -0,0 +1,118 @@
+package RebootForums
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MaxCommentDepth is how deeply replies may be nested below a top-level comment
+var MaxCommentDepth = envInt("MAX_COMMENT_DEPTH", 5)
+
+// ReportHideThreshold is how many open reports hide a post or comment until a moderator
+// reviews them; 0 disables automatic hiding
+var ReportHideThreshold = envInt("REPORT_HIDE_THRESHOLD", 3)
+
+// MaxImagesPerPost is how many images a single post can hold
+var MaxImagesPerPost = envInt("MAX_IMAGES_PER_POST", 10)
+
+// MaxPostImagesSize is the combined upload size of a post's images, in bytes
+var MaxPostImagesSize = int64(envInt("MAX_POST_IMAGES_MB", 50)) * 1024 * 1024
+
+// MaxImagePixels is the largest image accepted, in pixels; for animated GIFs it limits all frames together
+var MaxImagePixels = envInt("MAX_IMAGE_MEGAPIXELS", 50) * 1000 * 1000
+
+// DailyUploadCount is how many images a user can upload in 24 hours; 0 disables the quota
+var DailyUploadCount = envInt("DAILY_UPLOAD_COUNT", 100)
+
+// DailyUploadBytes is how much a user can upload in 24 hours, in bytes; 0 disables the quota
+var DailyUploadBytes = int64(envInt("DAILY_UPLOAD_MB", 200)) * 1024 * 1024
+
+// UploadRatePerMinute is how many files an IP address or user can upload a minute, after an
+// initial burst of UploadRateBurst files; 0 disables the rate limit
+var UploadRatePerMinute = envInt("UPLOAD_RATE_PER_MINUTE", 20)
+var UploadRateBurst = envInt("UPLOAD_RATE_BURST", 20)
+
+// UploadDirectory is where the local storage backend keeps uploads
+var UploadDirectory = envString("UPLOAD_DIR", "./uploads")
+
+// UploadGCInterval is how often the background job looks for orphaned uploads; 0 disables it
+var UploadGCInterval = time.Duration(envInt("UPLOAD_GC_INTERVAL_HOURS", 24)) * time.Hour
+
+// UploadGCGrace is how old an orphaned upload must be before it is cleaned up, so that uploads
+// whose post is still being saved are never touched
+var UploadGCGrace = time.Duration(envInt("UPLOAD_GC_GRACE_HOURS", 24)) * time.Hour
+
+// UploadGCMode is what the background job does with orphaned uploads: report, quarantine or delete
+var UploadGCMode = envString("UPLOAD_GC_MODE", GCQuarantine)
+
+// SiteURL is the public address of the forum, e.g. https://forum.example.com, used for links
+// that leave the site such as confirmation links. When unset, links use the host of the request.
+var SiteURL = envString("SITE_URL", "")
+
+// EmailChangeTTL is how long the link confirming a new email address stays valid
+var EmailChangeTTL = time.Duration(envInt("EMAIL_CHANGE_TTL_HOURS", 24)) * time.Hour
+
+// VerifyEmailTTL is how long the link verifying a new account's email address stays valid
+var VerifyEmailTTL = time.Duration(envInt("VERIFY_EMAIL_TTL_HOURS", 48)) * time.Hour
+
+// PasswordResetTTL is how long a password reset link stays valid
+var PasswordResetTTL = time.Duration(envInt("PASSWORD_RESET_TTL_MINUTES", 60)) * time.Minute
+
+// AccountDeletionMode is what happens to the posts, comments and likes of a deleted account:
+// anonymize keeps them under a placeholder name, remove deletes them
+var AccountDeletionMode = envString("ACCOUNT_DELETION_MODE", DeleteAnonymize)
+
+// SingleSession limits every user to one session at a time: logging in ends the user's other
+// sessions, as on older versions of the forum
+var SingleSession = envBool("SINGLE_SESSION", false)
+
+// SessionIdleTimeout is how long a session stays logged in without being used. Every request
+// extends it, up to SessionMaxAge after the user logged in.
+var SessionIdleTimeout = time.Duration(envInt("SESSION_IDLE_HOURS", 24)) * time.Hour
+var SessionMaxAge = time.Duration(envInt("SESSION_MAX_AGE_DAYS", 7)) * 24 * time.Hour
+
+// RememberMeIdleTimeout and RememberMeMaxAge replace the session lifetimes above when the user
+// ticks "Remember me" while logging in
+var RememberMeIdleTimeout = time.Duration(envInt("REMEMBER_ME_IDLE_DAYS", 30)) * 24 * time.Hour
+var RememberMeMaxAge = time.Duration(envInt("REMEMBER_ME_MAX_AGE_DAYS", 90)) * 24 * time.Hour
+
+// OnlineWindow is how recently a member or guest must have been active to count as online
+var OnlineWindow = time.Duration(envInt("ONLINE_WINDOW_MINUTES", 5)) * time.Minute
+
+// envString reads a setting from the environment, falling back to def when unset
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt reads an integer setting from the environment, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// envBool reads a true/false setting from the environment, falling back to def when unset or invalid
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %t", name, value, def)
+		return def
+	}
+	return b
+}
@@ -0,0 +1,129 @@
+package RebootForums
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// csrfFieldName is the form field, and csrfHeaderName the header for fetch calls, that carry the CSRF token.
+// Forms that upload files carry it as a query parameter of their action instead, with the same name.
+const (
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// maxFormBodySize is how large the body of a form without files may be
+const maxFormBodySize = 1 << 20
+
+// csrfTokenFor derives the CSRF token of a session from its session token. Only the browser holding
+// the session cookie, which scripts can't read, and pages rendered for it know the token.
+func csrfTokenFor(sessionToken string) string {
+	sum := sha256.Sum256([]byte("csrf:" + sessionToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// csrfResponseWriter carries the request to RenderTemplate, which adds its CSRF token to forms
+type csrfResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (w *csrfResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// csrfToken returns the CSRF token forms of the response must send back. Visitors without a
+// session are given a guest session for it, so templates must be rendered before anything is
+// written to the response, as RenderTemplate does.
+func (w *csrfResponseWriter) csrfToken() (string, error) {
+	auth, err := ensureGuestSession(w.ResponseWriter, w.r)
+	if err != nil {
+		return "", err
+	}
+	return auth.CSRFToken, nil
+}
+
+// csrfTemplateFuncs returns the template functions that insert the CSRF token of the response:
+// csrfField renders the hidden form field and csrfToken the bare token, for scripts
+func csrfTemplateFuncs(w http.ResponseWriter) template.FuncMap {
+	token := func() (string, error) {
+		if cw, ok := w.(*csrfResponseWriter); ok {
+			return cw.csrfToken()
+		}
+		return "", nil
+	}
+	return template.FuncMap{
+		"csrfToken": token,
+		"csrfField": func() (template.HTML, error) {
+			t, err := token()
+			if err != nil {
+				return "", err
+			}
+			return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(t) + `">`), nil
+		},
+	}
+}
+
+// isMultipartRequest reports whether a request is a form with files
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// maxRequestBodySize returns how large the body of a form submission may be: enough for the
+// images of a post when the form uploads files, and maxFormBodySize otherwise
+func maxRequestBodySize(r *http.Request) int64 {
+	if isMultipartRequest(r) {
+		return MaxPostImagesSize + maxFormBodySize
+	}
+	return maxFormBodySize
+}
+
+// requestCSRFToken returns the CSRF token a request carries. The body of a form with files is
+// never read for it, so rejected uploads are never buffered; those forms send it in the query string.
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeaderName); token != "" {
+		return token
+	}
+	if isMultipartRequest(r) {
+		return r.URL.Query().Get(csrfFieldName)
+	}
+	return r.PostFormValue(csrfFieldName)
+}
+
+// isSafeMethod reports whether requests with the method only read data
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// CSRFMiddleware rejects state-changing requests that don't carry the CSRF token of their session,
+// see requestCSRFToken. It must run inside SessionMiddleware. Requests authenticated with an access
+// token are exempt, since browsers never add one on their own. It also limits the size of request
+// bodies, before anything reads them, to what the forum's forms can legitimately send.
+func CSRFMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isSafeMethod(r.Method) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize(r))
+
+			if auth := currentAuth(r); !auth.ViaToken {
+				token := requestCSRFToken(r)
+				if auth.CSRFToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(auth.CSRFToken)) != 1 {
+					log.Printf("Rejected %s %s without a valid CSRF token", r.Method, r.URL.Path)
+					ErrorCSRFHandler(w, r)
+					return
+				}
+			}
+		}
+		next(&csrfResponseWriter{ResponseWriter: w, r: r}, r)
+	}
+}
@@ -0,0 +1,120 @@
+package RebootForums
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	token := csrfTokenFor("session-token")
+	wrong := csrfTokenFor("another-session")
+
+	form := func(values url.Values) (io.Reader, string) {
+		return strings.NewReader(values.Encode()), "application/x-www-form-urlencoded"
+	}
+	upload := func(values url.Values) (io.Reader, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, vs := range values {
+			for _, v := range vs {
+				mw.WriteField(name, v)
+			}
+		}
+		part, _ := mw.CreateFormFile("images", "cat.png")
+		part.Write([]byte("not really a png"))
+		mw.Close()
+		return &body, mw.FormDataContentType()
+	}
+	oversized := url.Values{"content": {strings.Repeat("x", maxFormBodySize)}, csrfFieldName: {token}}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   func(url.Values) (io.Reader, string)
+		values url.Values
+		header string
+		auth   *RequestAuth // nil for the session whose CSRF token is token
+		want   bool         // whether the request reaches the handler
+	}{
+		{name: "safe method", method: "GET", want: true},
+		{name: "token in form", method: "POST", body: form, values: url.Values{csrfFieldName: {token}}, want: true},
+		{name: "token in header", method: "DELETE", header: token, want: true},
+		{name: "wrong token in form", method: "POST", body: form, values: url.Values{csrfFieldName: {wrong}}},
+		{name: "no token", method: "POST", body: form, values: url.Values{"title": {"hi"}}},
+		{name: "wrong token in header", method: "POST", header: wrong, body: form, values: url.Values{csrfFieldName: {token}}},
+		{name: "token in query of upload", method: "POST", query: "?" + csrfFieldName + "=" + token, body: upload, want: true},
+		{name: "token in body of upload", method: "POST", body: upload, values: url.Values{csrfFieldName: {token}}},
+		{name: "token in query of form", method: "POST", query: "?" + csrfFieldName + "=" + token, body: form},
+		{name: "form larger than the limit", method: "POST", body: form, values: oversized},
+		{name: "request without a session", method: "POST", body: form, values: url.Values{csrfFieldName: {""}}, auth: &RequestAuth{}},
+		{name: "access token", method: "POST", body: form, auth: &RequestAuth{ViaToken: true}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			var contentType string
+			if tt.body != nil {
+				body, contentType = tt.body(tt.values)
+			}
+			r := httptest.NewRequest(tt.method, "/create-post"+tt.query, body)
+			if contentType != "" {
+				r.Header.Set("Content-Type", contentType)
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeaderName, tt.header)
+			}
+			auth := tt.auth
+			if auth == nil {
+				auth = &RequestAuth{SessionID: 1, CSRFToken: token}
+			}
+			r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth))
+
+			reached := false
+			handler := CSRFMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusNoContent)
+			})
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if reached != tt.want {
+				t.Fatalf("reached the handler: %v, want %v", reached, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("status %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestCSRFMiddlewareLimitsUploads(t *testing.T) {
+	token := csrfTokenFor("session-token")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("images", "big.png")
+	part.Write(bytes.Repeat([]byte{0}, int(MaxPostImagesSize+maxFormBodySize)))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/create-post?"+csrfFieldName+"="+token, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, &RequestAuth{SessionID: 1, CSRFToken: token}))
+
+	var readErr error
+	CSRFMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.Copy(io.Discard, r.Body)
+	})(httptest.NewRecorder(), r)
+
+	var tooLarge *http.MaxBytesError
+	if !errors.As(readErr, &tooLarge) {
+		t.Errorf("reading an upload over the limit gave %v, want a MaxBytesError", readErr)
+	}
+}
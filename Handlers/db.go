@@ -28,148 +28,6 @@ func InitDB(dataSourceName string) error {
 	return nil
 }
 
-// CreateTables creates all the necessary tables if they don't exist
-func CreateTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS posts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER,
-			title TEXT NOT NULL,
-			content TEXT NOT NULL,
-			image_filename TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS comments (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			post_id INTEGER,
-			user_id INTEGER,
-			content TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS categories (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS post_categories (
-			post_id INTEGER,
-			category_id INTEGER,
-			PRIMARY KEY (post_id, category_id),
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			FOREIGN KEY (category_id) REFERENCES categories(id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS likes (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			post_id INTEGER,
-			comment_id INTEGER,
-			is_like BOOLEAN NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id),
-			FOREIGN KEY (post_id) REFERENCES posts(id),
-			FOREIGN KEY (comment_id) REFERENCES comments(id),
-			UNIQUE(user_id, post_id, comment_id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER,
-			token TEXT UNIQUE NOT NULL,
-			expiry DATETIME NOT NULL,
-			is_guest BOOLEAN NOT NULL DEFAULT 0,
-			last_activity DATETIME NOT NULL,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)`,
-	}
-
-	for _, query := range queries {
-		_, err := DB.Exec(query)
-		if err != nil {
-			log.Printf("Error executing query: %s\nError: %v", query, err)
-			return err
-		}
-	}
-
-	log.Println("Tables created successfully")
-
-	// Add default categories
-	err := addDefaultCategories()
-	if err != nil {
-		log.Printf("Error adding default categories: %v", err)
-		return err
-	}
-
-	return nil
-}
-
-// addDefaultCategories adds default categories to the database
-func addDefaultCategories() error {
-	categories := []string{
-		"General Discussion",
-		"Technology",
-		"Sports",
-		"Entertainment",
-		"Science",
-		"Politics",
-		"Health",
-		"Education",
-		"Travel",
-		"Food",
-	}
-
-	for _, category := range categories {
-		_, err := DB.Exec("INSERT OR IGNORE INTO categories (name) VALUES (?)", category)
-		if err != nil {
-			return err
-		}
-	}
-
-	log.Println("Default categories added successfully")
-	return nil
-}
-
-// AddUpdatedAtColumn adds the updated_at column to the posts table if it doesn't exist
-func AddUpdatedAtColumn() error {
-	_, err := DB.Exec(`
-		ALTER TABLE posts ADD COLUMN updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	`)
-	if err != nil {
-		// If the error is because the column already exists, we can ignore it
-		if err.Error() != "duplicate column name: updated_at" {
-			log.Printf("Error adding updated_at column: %v", err)
-			return err
-		}
-	}
-	log.Println("updated_at column added to posts table (if it didn't exist)")
-	return nil
-}
-
-// AddImageFilenameToPostsTable adds the image_filename column to the posts table if it doesn't exist
-func AddImageFilenameToPostsTable() error {
-	_, err := DB.Exec(`
-		ALTER TABLE posts ADD COLUMN image_filename TEXT;
-	`)
-	if err != nil {
-		// If the error is because the column already exists, we can ignore it
-		if err.Error() != "duplicate column name: image_filename" {
-			log.Printf("Error adding image_filename column to posts table: %v", err)
-			return err
-		}
-	}
-	log.Println("image_filename column added to posts table (if it didn't exist)")
-	return nil
-}
-
 // GetLikeCounts returns the number of likes and dislikes for a post or comment
 func GetLikeCounts(targetID int, isPost bool) (likes int, dislikes int, err error) {
 	var query string
@@ -195,6 +53,33 @@ func GetLikeCounts(targetID int, isPost bool) (likes int, dislikes int, err erro
 	return
 }
 
+// checkLikeTarget returns sql.ErrNoRows unless the user can see the post or comment they want
+// to like. Comments that were deleted or hidden by a moderator, and comments under posts the
+// user can't see, can't be liked.
+func checkLikeTarget(user *User, targetID int, isPost bool) error {
+	postID := targetID
+	if !isPost {
+		var isDeleted, isHidden bool
+		var err error
+		postID, isDeleted, isHidden, err = getCommentStatus(targetID)
+		if err != nil {
+			return err
+		}
+		if isDeleted || isHidden {
+			return sql.ErrNoRows
+		}
+	}
+
+	post, err := getPost(postID)
+	if err != nil {
+		return err
+	}
+	if !canViewPost(user, post) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func UpsertLike(userID, targetID int, isLike bool, isPost bool) error {
 	tx, err := DB.Begin()
 	if err != nil {
@@ -243,75 +128,17 @@ func UpsertLike(userID, targetID int, isLike bool, isPost bool) error {
 	return tx.Commit()
 }
 
-func AddCreatedAtToLikesTable() error {
-	_, err := DB.Exec(`
-        ALTER TABLE likes ADD COLUMN created_at DATETIME DEFAULT CURRENT_TIMESTAMP;
-    `)
-	if err != nil {
-		// If the error is because the column already exists, we can ignore it
-		if err.Error() != "duplicate column name: created_at" {
-			log.Printf("Error adding created_at column to likes table: %v", err)
-			return err
-		}
-	}
-	log.Println("created_at column added to likes table (if it didn't exist)")
-	return nil
-}
-
-func GetPostsByCategory(categoryID int) ([]Post, error) {
-	query := `
-        SELECT DISTINCT p.id, p.title, p.content, u.username, p.created_at, p.image_filename
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        JOIN post_categories pc ON p.id = pc.post_id
-        WHERE pc.category_id = ?
-        ORDER BY p.created_at DESC
-    `
-	return fetchPosts(query, categoryID)
+// GetPostsByCategory returns a page of the posts in a category
+func GetPostsByCategory(categoryID int, opts FeedOptions) (FeedPage, error) {
+	return fetchPosts("p.id IN (SELECT post_id FROM post_categories WHERE category_id = :filter)", categoryID, opts)
 }
 
-func GetPostsByUser(userID int) ([]Post, error) {
-	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at, p.image_filename
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        WHERE p.user_id = ?
-        ORDER BY p.created_at DESC
-    `
-	return fetchPosts(query, userID)
+// GetPostsByUser returns a page of the posts written by a user
+func GetPostsByUser(userID int, opts FeedOptions) (FeedPage, error) {
+	return fetchPosts("p.user_id = :filter", userID, opts)
 }
 
-func GetLikedPostsByUser(userID int) ([]Post, error) {
-	query := `
-        SELECT p.id, p.title, p.content, u.username, p.created_at, p.image_filename
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        JOIN likes l ON p.id = l.post_id
-        WHERE l.user_id = ? AND l.is_like = 1
-        ORDER BY p.created_at DESC
-    `
-	return fetchPosts(query, userID)
-}
-
-func fetchPosts(query string, args ...interface{}) ([]Post, error) {
-	rows, err := DB.Query(query, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var posts []Post
-	for rows.Next() {
-		var p Post
-		var imageFilename sql.NullString
-		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.CreatedAt, &imageFilename)
-		if err != nil {
-			return nil, err
-		}
-		if imageFilename.Valid {
-			p.ImageFilename = imageFilename.String
-		}
-		posts = append(posts, p)
-	}
-	return posts, nil
+// GetLikedPostsByUser returns a page of the posts a user has liked
+func GetLikedPostsByUser(userID int, opts FeedOptions) (FeedPage, error) {
+	return fetchPosts("p.id IN (SELECT post_id FROM likes WHERE user_id = :filter AND is_like = 1)", userID, opts)
 }
@@ -0,0 +1,135 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"RebootForums/migrations"
+)
+
+var testDBCount atomic.Int64
+
+// useTestDB points DB at a fresh, fully migrated in-memory database for the rest of the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	// Connections to a shared-cache memory database see the same data while any of them is open
+	name := fmt.Sprintf("file:test%d?mode=memory&cache=shared", testDBCount.Add(1))
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxIdleConns(4)
+	if err := migrations.Up(db); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = previous
+		db.Close()
+	})
+}
+
+// createTestUser adds a member and returns their ID
+func createTestUser(t *testing.T, username string) int {
+	t.Helper()
+	result, err := DB.Exec("INSERT INTO users (username, email, password, created_at) VALUES (?, ?, '', ?)",
+		username, username+"@example.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// createTestPost adds a post by userID created at the given time and returns its ID
+func createTestPost(t *testing.T, userID int, title string, createdAt time.Time) int {
+	t.Helper()
+	result, err := DB.Exec("INSERT INTO posts (user_id, title, content, created_at, updated_at) VALUES (?, ?, '', ?, ?)",
+		userID, title, createdAt, createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// createTestComment adds a comment by userID under postID, replying to parentID unless it is 0,
+// and returns its ID
+func createTestComment(t *testing.T, userID, postID, parentID int, content string) int {
+	t.Helper()
+	var parent interface{}
+	if parentID != 0 {
+		parent = parentID
+	}
+	result, err := DB.Exec("INSERT INTO comments (post_id, user_id, parent_id, content, created_at) VALUES (?, ?, ?, ?, ?)",
+		postID, userID, parent, content, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+func TestCheckLikeTarget(t *testing.T) {
+	useTestDB(t)
+	author := &User{ID: createTestUser(t, "author"), Username: "author", Role: RoleMember}
+	member := &User{ID: createTestUser(t, "member"), Username: "member", Role: RoleMember}
+	moderator := &User{ID: createTestUser(t, "mod"), Username: "mod", Role: RoleModerator}
+
+	visible := createTestPost(t, author.ID, "visible", time.Now())
+	hidden := createTestPost(t, author.ID, "hidden", time.Now())
+	comment := createTestComment(t, member.ID, visible, 0, "hi")
+	hiddenComment := createTestComment(t, member.ID, visible, 0, "rude")
+	deletedComment := createTestComment(t, member.ID, visible, 0, "")
+	underHidden := createTestComment(t, member.ID, hidden, 0, "hi")
+	mustExec := func(query string, args ...interface{}) {
+		if _, err := DB.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec("UPDATE posts SET is_hidden = 1 WHERE id = ?", hidden)
+	mustExec("UPDATE comments SET is_hidden = 1 WHERE id = ?", hiddenComment)
+	mustExec("UPDATE comments SET is_deleted = 1 WHERE id = ?", deletedComment)
+
+	tests := []struct {
+		name     string
+		user     *User
+		targetID int
+		isPost   bool
+		want     error
+	}{
+		{"visible post", member, visible, true, nil},
+		{"hidden post", member, hidden, true, sql.ErrNoRows},
+		{"hidden post by its author", author, hidden, true, nil},
+		{"hidden post by a moderator", moderator, hidden, true, nil},
+		{"missing post", member, 9999, true, sql.ErrNoRows},
+		{"comment", member, comment, false, nil},
+		{"hidden comment", member, hiddenComment, false, sql.ErrNoRows},
+		{"hidden comment by a moderator", moderator, hiddenComment, false, sql.ErrNoRows},
+		{"deleted comment", member, deletedComment, false, sql.ErrNoRows},
+		{"comment under a hidden post", member, underHidden, false, sql.ErrNoRows},
+		{"missing comment", member, 9999, false, sql.ErrNoRows},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkLikeTarget(tt.user, tt.targetID, tt.isPost); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package RebootForums
 
 import (
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func Error400Handler(w http.ResponseWriter, r *http.Request) {
@@ -14,6 +18,15 @@ func Error400Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func Error403Handler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	err := RenderTemplate(w, "error_403.html", nil)
+	if err != nil {
+		log.Printf("Error rendering 403 template: %v", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
+
 func Error404Handler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	err := RenderTemplate(w, "error_404.html", nil)
@@ -32,6 +45,55 @@ func Error500Handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ErrorCSRFHandler rejects a form that was sent without the CSRF token of the user's session,
+// usually because the page was opened before logging in or out, or came from another site
+func ErrorCSRFHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	err := RenderTemplate(w, "error_csrf.html", nil)
+	if err != nil {
+		log.Printf("Error rendering CSRF template: %v", err)
+		http.Error(w, "Forbidden: invalid or missing CSRF token", http.StatusForbidden)
+	}
+}
+
+// Error429Handler tells the user they hit a rate limit or quota and when to try again
+func Error429Handler(w http.ResponseWriter, r *http.Request, message string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	data := struct {
+		Message    string
+		RetryAfter string
+	}{
+		Message:    message,
+		RetryAfter: formatWait(retryAfter),
+	}
+	err := RenderTemplate(w, "error_429.html", data)
+	if err != nil {
+		log.Printf("Error rendering 429 template: %v", err)
+		http.Error(w, message, http.StatusTooManyRequests)
+	}
+}
+
+// formatWait describes a waiting time in words, rounded up to the next second, minute or hour
+func formatWait(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return plural(int(math.Ceil(d.Seconds())), "second")
+	case d < time.Hour:
+		return plural(int(math.Ceil(d.Minutes())), "minute")
+	default:
+		return plural(int(math.Ceil(d.Hours())), "hour")
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", max(n, 0), unit)
+}
+
 // CustomNotFoundHandler is a wrapper to use Error404Handler for undefined routes
 func CustomNotFoundHandler(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,291 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sort modes for post feeds
+const (
+	SortNewest        = "new"
+	SortMostLiked     = "top"
+	SortMostCommented = "comments"
+	SortHot           = "hot"
+)
+
+const (
+	PostsPerPage    = 10
+	MaxPostsPerPage = 50
+)
+
+// FeedOptions selects the page and ordering of a post feed
+type FeedOptions struct {
+	Sort   string
+	Limit  int
+	After  string // cursor of the last post on the previous page
+	Before string // cursor of the first post on the next page
+}
+
+// FeedPage is one page of a post feed along with the cursors of its neighbours
+type FeedPage struct {
+	Posts      []Post
+	Sort       string
+	NextCursor string
+	PrevCursor string
+}
+
+// feedCursor is the keyset position of a post within a sorted feed.
+// Ref is the reference time (as a Julian day) used to score "hot" posts,
+// so the ranking stays stable while paging.
+type feedCursor struct {
+	Sort    string
+	Score   float64
+	Created float64
+	ID      int
+	Ref     float64
+}
+
+// ParseFeedOptions reads the sort, limit and cursor query parameters of a feed request
+func ParseFeedOptions(r *http.Request) FeedOptions {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil {
+		limit = 0
+	}
+	return FeedOptions{
+		Sort:   query.Get("sort"),
+		Limit:  limit,
+		After:  query.Get("after"),
+		Before: query.Get("before"),
+	}
+}
+
+func (o FeedOptions) normalize() FeedOptions {
+	switch o.Sort {
+	case SortNewest, SortMostLiked, SortMostCommented, SortHot:
+	default:
+		o.Sort = SortNewest
+	}
+	if o.Limit <= 0 {
+		o.Limit = PostsPerPage
+	}
+	if o.Limit > MaxPostsPerPage {
+		o.Limit = MaxPostsPerPage
+	}
+	return o
+}
+
+func (c feedCursor) encode() string {
+	raw := strings.Join([]string{
+		c.Sort,
+		strconv.FormatFloat(c.Score, 'g', -1, 64),
+		strconv.FormatFloat(c.Created, 'g', -1, 64),
+		strconv.Itoa(c.ID),
+		strconv.FormatFloat(c.Ref, 'g', -1, 64),
+	}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeFeedCursor(s string) (feedCursor, error) {
+	var c feedCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor: %v", err)
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 5 {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	c.Sort = parts[0]
+	if c.Score, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return c, fmt.Errorf("invalid cursor score: %v", err)
+	}
+	if c.Created, err = strconv.ParseFloat(parts[2], 64); err != nil {
+		return c, fmt.Errorf("invalid cursor time: %v", err)
+	}
+	if c.ID, err = strconv.Atoi(parts[3]); err != nil {
+		return c, fmt.Errorf("invalid cursor id: %v", err)
+	}
+	if c.Ref, err = strconv.ParseFloat(parts[4], 64); err != nil {
+		return c, fmt.Errorf("invalid cursor reference time: %v", err)
+	}
+	return c, nil
+}
+
+// julianDay converts a time to the Julian day number SQLite's julianday() returns
+func julianDay(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+}
+
+// feedScore returns the SQL expression each sort mode ranks posts by.
+// Hot posts are scored by likes minus dislikes plus comments, decayed by age in hours.
+func feedScore(sort string) string {
+	switch sort {
+	case SortMostLiked:
+		return "CAST(COALESCE(lk.likes, 0) AS REAL)"
+	case SortMostCommented:
+		return "CAST(COALESCE(cm.comments, 0) AS REAL)"
+	case SortHot:
+		return `(COALESCE(lk.likes, 0) - COALESCE(lk.dislikes, 0) + COALESCE(cm.comments, 0)) /
+            (((:ref - julianday(p.created_at)) * 24 + 2) * ((:ref - julianday(p.created_at)) * 24 + 2))`
+	default:
+		return "julianday(p.created_at)"
+	}
+}
+
+// fetchPosts returns one page of posts matching the where clause, sorted and paginated by opts.
+// The where clause may reference the posts table as p and the named parameter :filter.
+func fetchPosts(where string, filterArg interface{}, opts FeedOptions) (FeedPage, error) {
+	opts = opts.normalize()
+	page := FeedPage{Sort: opts.Sort}
+
+	var cursor *feedCursor
+	backwards := false
+	for _, raw := range []string{opts.After, opts.Before} {
+		if raw == "" {
+			continue
+		}
+		c, err := decodeFeedCursor(raw)
+		if err != nil {
+			return page, err
+		}
+		if c.Sort != opts.Sort {
+			return page, fmt.Errorf("cursor does not match sort mode %q", opts.Sort)
+		}
+		cursor = &c
+		backwards = raw == opts.Before
+		break
+	}
+
+	ref := julianDay(time.Now())
+	if cursor != nil && cursor.Ref != 0 {
+		ref = cursor.Ref
+	}
+
+	// Posts hidden by moderators are left out of every feed
+	conditions := []string{"p.is_hidden = 0"}
+	if where != "" {
+		conditions = append(conditions, where)
+	}
+	order := "score DESC, created DESC, p.id DESC"
+	if cursor != nil {
+		if backwards {
+			conditions = append(conditions, "(score, created, p.id) > (:score, :created, :id)")
+			order = "score ASC, created ASC, p.id ASC"
+		} else {
+			conditions = append(conditions, "(score, created, p.id) < (:score, :created, :id)")
+		}
+	}
+
+	query := fmt.Sprintf(`
+        SELECT p.id, p.title, p.content, u.username, p.created_at, p.updated_at,
+               (SELECT filename FROM post_images WHERE post_id = p.id ORDER BY position, id LIMIT 1),
+               (SELECT COUNT(*) FROM post_images WHERE post_id = p.id),
+               COALESCE((SELECT i.animated FROM post_images pi JOIN images i ON i.filename = pi.filename
+                         WHERE pi.post_id = p.id ORDER BY pi.position, pi.id LIMIT 1), 0),
+               COALESCE(lk.likes, 0), COALESCE(lk.dislikes, 0), COALESCE(cm.comments, 0), p.view_count,
+               %s AS score, julianday(p.created_at) AS created
+        FROM posts p
+        JOIN users u ON p.user_id = u.id
+        LEFT JOIN (
+            SELECT post_id,
+                   SUM(CASE WHEN is_like = 1 THEN 1 ELSE 0 END) AS likes,
+                   SUM(CASE WHEN is_like = 0 THEN 1 ELSE 0 END) AS dislikes
+            FROM likes
+            WHERE post_id IS NOT NULL
+            GROUP BY post_id
+        ) lk ON lk.post_id = p.id
+        LEFT JOIN (
+            SELECT post_id, COUNT(*) AS comments
+            FROM comments
+            WHERE is_deleted = 0
+            GROUP BY post_id
+        ) cm ON cm.post_id = p.id
+        WHERE %s
+        ORDER BY %s
+        LIMIT :limit
+    `, feedScore(opts.Sort), strings.Join(conditions, " AND "), order)
+
+	args := []interface{}{
+		sql.Named("ref", ref),
+		sql.Named("limit", opts.Limit+1),
+	}
+	if where != "" {
+		args = append(args, sql.Named("filter", filterArg))
+	}
+	if cursor != nil {
+		args = append(args,
+			sql.Named("score", cursor.Score),
+			sql.Named("created", cursor.Created),
+			sql.Named("id", cursor.ID),
+		)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	var cursors []feedCursor
+	for rows.Next() {
+		var p Post
+		var coverImage sql.NullString
+		var updatedAt sql.NullTime
+		c := feedCursor{Sort: opts.Sort, Ref: ref}
+		err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Author, &p.CreatedAt, &updatedAt, &coverImage, &p.ImageCount,
+			&p.CoverAnimated, &p.Likes, &p.Dislikes, &p.CommentCount, &p.ViewCount, &c.Score, &c.Created)
+		if err != nil {
+			return page, err
+		}
+		if coverImage.Valid {
+			p.CoverImage = coverImage.String
+		}
+		p.UpdatedAt = p.CreatedAt
+		if updatedAt.Valid {
+			p.UpdatedAt = updatedAt.Time
+		}
+		c.ID = p.ID
+		posts = append(posts, p)
+		cursors = append(cursors, c)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	hasMore := len(posts) > opts.Limit
+	if hasMore {
+		posts = posts[:opts.Limit]
+		cursors = cursors[:opts.Limit]
+	}
+
+	if backwards {
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+	}
+
+	page.Posts = posts
+	if len(posts) == 0 {
+		return page, nil
+	}
+
+	hasNext, hasPrev := hasMore, cursor != nil
+	if backwards {
+		hasNext, hasPrev = true, hasMore
+	}
+	if hasNext {
+		page.NextCursor = cursors[len(cursors)-1].encode()
+	}
+	if hasPrev {
+		page.PrevCursor = cursors[0].encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,184 @@
+package RebootForums
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFeedCursorRoundTrip(t *testing.T) {
+	tests := []feedCursor{
+		{Sort: SortNewest, Score: 2460600.5, Created: 2460600.5, ID: 1},
+		{Sort: SortMostLiked, Score: 12, Created: 2460600.123456789, ID: 42},
+		{Sort: SortMostCommented, Score: 0, Created: 2460000, ID: 7},
+		{Sort: SortHot, Score: -0.0123456789, Created: 2460600.25, ID: 1000000, Ref: 2460601.987654321},
+	}
+	for _, want := range tests {
+		t.Run(want.Sort, func(t *testing.T) {
+			got, err := decodeFeedCursor(want.encode())
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeFeedCursorInvalid(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"too few parts", encode("new|1|2|3")},
+		{"too many parts", encode("new|1|2|3|4|5")},
+		{"bad score", encode("new|x|2|3|4")},
+		{"bad time", encode("new|1|x|3|4")},
+		{"bad id", encode("new|1|2|3.5|4")},
+		{"bad reference time", encode("new|1|2|3|x")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := decodeFeedCursor(tt.cursor); err == nil {
+				t.Errorf("decoded %+v, want an error", c)
+			}
+		})
+	}
+}
+
+// feedPostIDs returns the IDs of a page's posts in order
+func feedPostIDs(page FeedPage) []int {
+	var ids []int
+	for _, p := range page.Posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestFetchPostsOrdering(t *testing.T) {
+	useTestDB(t)
+
+	var users []int
+	for _, name := range []string{"ann", "bob", "cat", "dan"} {
+		users = append(users, createTestUser(t, name))
+	}
+	now := time.Now().UTC()
+	var posts []int
+	for i := 0; i < 5; i++ {
+		posts = append(posts, createTestPost(t, users[0], "post", now.Add(time.Duration(i-5)*time.Hour)))
+	}
+	hidden := createTestPost(t, users[0], "hidden", now.Add(-time.Minute))
+	if _, err := DB.Exec("UPDATE posts SET is_hidden = 1 WHERE id = ?", hidden); err != nil {
+		t.Fatal(err)
+	}
+
+	votes := []struct {
+		user, post int
+		like       bool
+	}{
+		{users[0], posts[1], true},
+		{users[1], posts[1], true},
+		{users[2], posts[1], true},
+		{users[0], posts[3], true},
+		{users[0], posts[0], true},
+		{users[1], posts[4], false},
+		{users[3], hidden, true},
+	}
+	for _, v := range votes {
+		if _, err := DB.Exec("INSERT INTO likes (user_id, post_id, is_like) VALUES (?, ?, ?)", v.user, v.post, v.like); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, post := range []int{posts[2], posts[2], posts[0]} {
+		if _, err := DB.Exec("INSERT INTO comments (post_id, user_id, content) VALUES (?, ?, 'hi')", post, users[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{SortNewest, []int{posts[4], posts[3], posts[2], posts[1], posts[0]}},
+		// Ties are broken by the newest post first
+		{SortMostLiked, []int{posts[1], posts[3], posts[0], posts[4], posts[2]}},
+		{SortMostCommented, []int{posts[2], posts[0], posts[4], posts[3], posts[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			page, err := fetchPosts("", nil, FeedOptions{Sort: tt.sort, Limit: MaxPostsPerPage})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := feedPostIDs(page); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got posts %v, want %v", got, tt.want)
+			}
+			if page.NextCursor != "" || page.PrevCursor != "" {
+				t.Errorf("a single page has cursors: next %q, prev %q", page.NextCursor, page.PrevCursor)
+			}
+		})
+	}
+
+	// Paging through a feed in either direction visits every post once, in the feed's order
+	for _, sort := range []string{SortNewest, SortMostLiked, SortMostCommented, SortHot} {
+		t.Run("paging "+sort, func(t *testing.T) {
+			all, err := fetchPosts("", nil, FeedOptions{Sort: sort, Limit: MaxPostsPerPage})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := feedPostIDs(all)
+
+			var forward []int
+			var last FeedPage
+			opts := FeedOptions{Sort: sort, Limit: 2}
+			for {
+				page, err := fetchPosts("", nil, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if opts.After == "" && page.PrevCursor != "" {
+					t.Errorf("the first page has a previous cursor")
+				}
+				forward = append(forward, feedPostIDs(page)...)
+				last = page
+				if page.NextCursor == "" {
+					break
+				}
+				opts.After = page.NextCursor
+			}
+			if !reflect.DeepEqual(forward, want) {
+				t.Fatalf("paging forward gave %v, want %v", forward, want)
+			}
+
+			backward := feedPostIDs(last)
+			opts = FeedOptions{Sort: sort, Limit: 2, Before: last.PrevCursor}
+			for opts.Before != "" {
+				page, err := fetchPosts("", nil, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				backward = append(feedPostIDs(page), backward...)
+				opts.Before = page.PrevCursor
+			}
+			if !reflect.DeepEqual(backward, want) {
+				t.Errorf("paging backward gave %v, want %v", backward, want)
+			}
+		})
+	}
+
+	t.Run("cursor of another sort", func(t *testing.T) {
+		page, err := fetchPosts("", nil, FeedOptions{Sort: SortNewest, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fetchPosts("", nil, FeedOptions{Sort: SortMostLiked, After: page.NextCursor}); err == nil {
+			t.Error("a cursor of the newest feed was accepted by the most liked feed")
+		}
+	})
+}
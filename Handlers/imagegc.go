@@ -0,0 +1,311 @@
+package RebootForums
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What CheckUploads does with orphaned uploads
+const (
+	GCReport     = "report"
+	GCQuarantine = "quarantine"
+	GCDelete     = "delete"
+)
+
+// quarantineName is where quarantined uploads are moved, inside the upload directory or bucket prefix.
+// Storage keys never contain a slash, so quarantined files are neither listed nor served.
+const quarantineName = ".quarantine"
+
+// MissingImage is an image the database refers to whose file is not stored
+type MissingImage struct {
+	Filename string
+	PostIDs  []int
+	UserIDs  []int // users with the image as their avatar
+}
+
+// imageRef is what refers to an image: the posts using it and the users with it as their avatar
+type imageRef struct {
+	PostIDs []int
+	UserIDs []int
+}
+
+// imageInUse is the SQL condition under which the image in the images table is used by a post or avatar
+const imageInUse = `(EXISTS (SELECT 1 FROM post_images p WHERE p.filename = images.filename)
+               OR EXISTS (SELECT 1 FROM users u WHERE u.avatar = images.filename))`
+
+// FsckResult is what CheckUploads found and did
+type FsckResult struct {
+	Mode    string
+	Scanned int
+	// Orphans are stored files no image in the database refers to, older than the grace period
+	Orphans []StoredFile
+	// Unattached are images whose upload was never saved with a post, older than the grace period
+	Unattached []string
+	// Missing are images posts or avatars refer to whose full variant is not stored
+	Missing []MissingImage
+	// Recent counts orphaned files left alone because they are within the grace period
+	Recent int
+	// Cleaned counts orphaned files that were quarantined or deleted
+	Cleaned int
+}
+
+// Summary describes the result in one line
+func (r FsckResult) Summary() string {
+	summary := fmt.Sprintf("scanned %d file(s): %d orphaned, %d unattached image(s), %d missing, %d within the grace period",
+		r.Scanned, len(r.Orphans), len(r.Unattached), len(r.Missing), r.Recent)
+	switch r.Mode {
+	case GCQuarantine:
+		summary += fmt.Sprintf(", %d quarantined", r.Cleaned)
+	case GCDelete:
+		summary += fmt.Sprintf(", %d deleted", r.Cleaned)
+	}
+	return summary
+}
+
+// CheckUploads compares the stored uploads with the images the database refers to. It reports
+// files nothing refers to and references whose file is missing. Unless mode is GCReport,
+// orphaned files older than grace are quarantined or deleted, together with the images of
+// uploads that were never saved with a post.
+func CheckUploads(mode string, grace time.Duration) (FsckResult, error) {
+	result := FsckResult{Mode: mode}
+	if mode != GCReport && mode != GCQuarantine && mode != GCDelete {
+		return result, fmt.Errorf("unknown mode %q", mode)
+	}
+	cutoff := time.Now().Add(-grace)
+
+	// Images whose upload took a reference that was never handed to a post, e.g. because
+	// the server stopped while the post was being saved
+	unattached, err := unattachedImages(cutoff)
+	if err != nil {
+		return result, err
+	}
+	result.Unattached = unattached
+	if mode != GCReport {
+		if err := dropUnattachedImages(unattached, cutoff); err != nil {
+			return result, err
+		}
+	}
+
+	referenced, err := referencedImages()
+	if err != nil {
+		return result, err
+	}
+
+	stored := make(map[string]bool)
+	var orphans []StoredFile
+	err = Store.List(func(f StoredFile) error {
+		result.Scanned++
+		if _, ok := referenced[imageFilenameForKey(f.Key)]; ok {
+			stored[f.Key] = true
+			return nil
+		}
+		if f.ModTime.After(cutoff) {
+			result.Recent++
+			return nil
+		}
+		orphans = append(orphans, f)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Orphans = orphans
+
+	for filename, ref := range referenced {
+		// Only the full variant is required; older uploads have no other variants
+		if !stored[filename] && (len(ref.PostIDs) > 0 || len(ref.UserIDs) > 0) {
+			result.Missing = append(result.Missing, MissingImage{Filename: filename, PostIDs: ref.PostIDs, UserIDs: ref.UserIDs})
+		}
+	}
+	sort.Slice(result.Missing, func(i, j int) bool {
+		return result.Missing[i].Filename < result.Missing[j].Filename
+	})
+
+	if mode == GCReport {
+		return result, nil
+	}
+	for _, f := range orphans {
+		cleaned, err := cleanOrphan(f, mode)
+		if err != nil {
+			return result, fmt.Errorf("cleaning up %s: %w", f.Key, err)
+		}
+		if cleaned {
+			result.Cleaned++
+		}
+	}
+	return result, nil
+}
+
+// unattachedImages returns the images no post or avatar uses that were last uploaded before cutoff
+func unattachedImages(cutoff time.Time) ([]string, error) {
+	rows, err := DB.Query(`
+        SELECT filename FROM images
+        WHERE acquired_at < ? AND NOT `+imageInUse+`
+        ORDER BY filename
+    `, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, rows.Err()
+}
+
+// dropUnattachedImages removes the rows of unattached images, which leaves their files orphaned
+func dropUnattachedImages(filenames []string, cutoff time.Time) error {
+	for _, filename := range filenames {
+		// A post or avatar may have started using the image since it was found
+		_, err := DB.Exec(`
+            DELETE FROM images
+            WHERE filename = ? AND acquired_at < ? AND NOT `+imageInUse+`
+        `, filename, cutoff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referencedImages returns every image filename the database refers to, with the posts and avatars using it
+func referencedImages() (map[string]*imageRef, error) {
+	referenced := make(map[string]*imageRef)
+	refOf := func(filename string) *imageRef {
+		if referenced[filename] == nil {
+			referenced[filename] = &imageRef{}
+		}
+		return referenced[filename]
+	}
+
+	rows, err := DB.Query("SELECT filename FROM images")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		refOf(filename)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = DB.Query("SELECT DISTINCT filename, post_id FROM post_images ORDER BY post_id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var filename string
+		var postID int
+		if err := rows.Scan(&filename, &postID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ref := refOf(filename)
+		ref.PostIDs = append(ref.PostIDs, postID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = DB.Query("SELECT avatar, id FROM users WHERE avatar IS NOT NULL AND avatar != '' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filename string
+		var userID int
+		if err := rows.Scan(&filename, &userID); err != nil {
+			return nil, err
+		}
+		ref := refOf(filename)
+		ref.UserIDs = append(ref.UserIDs, userID)
+	}
+	return referenced, rows.Err()
+}
+
+// cleanOrphan quarantines or deletes an orphaned file, unless an upload of the same content
+// has registered its image since the file was found
+func cleanOrphan(f StoredFile, mode string) (bool, error) {
+	unlock := lockImage(f.Key)
+	defer unlock()
+
+	var reused bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE filename = ?)", imageFilenameForKey(f.Key)).Scan(&reused)
+	if err != nil || reused {
+		return false, err
+	}
+
+	if mode == GCQuarantine {
+		quarantine, err := quarantineStorage(Store)
+		if err != nil {
+			return false, err
+		}
+		file, err := Store.Get(f.Key)
+		if err == ErrStoredFileNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		err = quarantine.Put(f.Key, file, f.Size, contentTypeForKey(f.Key))
+		file.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, Store.Delete(f.Key)
+}
+
+// quarantineStorage returns the storage quarantined files of a backend are moved to
+func quarantineStorage(s Storage) (Storage, error) {
+	switch s := s.(type) {
+	case *LocalStorage:
+		return NewLocalStorage(filepath.Join(s.Dir, quarantineName)), nil
+	case *S3Storage:
+		config := s.config
+		config.Prefix = strings.TrimPrefix(path.Join(config.Prefix, quarantineName), "/")
+		return &S3Storage{client: s.client, config: config}, nil
+	default:
+		return nil, fmt.Errorf("quarantine is not supported by %T", s)
+	}
+}
+
+// StartUploadGC periodically cleans up orphaned uploads in the background, as configured
+// by UPLOAD_GC_INTERVAL_HOURS, UPLOAD_GC_GRACE_HOURS and UPLOAD_GC_MODE
+func StartUploadGC() {
+	if UploadGCInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(UploadGCInterval)
+			result, err := CheckUploads(UploadGCMode, UploadGCGrace)
+			if err != nil {
+				log.Printf("Error checking uploads: %v", err)
+				continue
+			}
+			log.Printf("Upload check: %s", result.Summary())
+			for _, missing := range result.Missing {
+				log.Printf("Upload check: %s is missing (posts %v, avatar of users %v)", missing.Filename, missing.PostIDs, missing.UserIDs)
+			}
+		}
+	}()
+}
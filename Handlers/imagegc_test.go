@@ -0,0 +1,160 @@
+package RebootForums
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCheckUploads(t *testing.T) {
+	const grace = time.Hour
+	old := time.Now().Add(-2 * grace)
+
+	// setup stores:
+	//   used.png     an image a post uses, with its thumb variant
+	//   avatar.png   an image a user has as their avatar
+	//   pending.png  an image uploaded long ago but never saved with a post
+	//   fresh.png    an image uploaded moments ago and not saved with a post yet
+	//   orphan.png   a file without an image
+	//   new.png      a file without an image, stored within the grace period
+	// and refers to missing.png from a post without storing it
+	setup := func(t *testing.T) *LocalStorage {
+		useTestDB(t)
+		store := useTestStore(t)
+		userID := createTestUser(t, "ann")
+		postID := createTestPost(t, userID, "post", old)
+
+		for _, img := range []struct {
+			filename string
+			acquired time.Time
+		}{
+			{"used.png", old}, {"avatar.png", old}, {"pending.png", old}, {"fresh.png", time.Now()}, {"missing.png", old},
+		} {
+			_, err := DB.Exec("INSERT INTO images (filename, ref_count, acquired_at) VALUES (?, 1, ?)", img.filename, img.acquired)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, filename := range []string{"used.png", "missing.png"} {
+			_, err := DB.Exec("INSERT INTO post_images (post_id, filename, position, created_at) VALUES (?, ?, 0, ?)", postID, filename, old)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := DB.Exec("UPDATE users SET avatar = 'avatar.png' WHERE id = ?", userID); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"used.png", "used_thumb.png", "avatar.png", "pending.png", "fresh.png", "orphan.png", "new.png"} {
+			putTestFile(t, key)
+			if key == "new.png" {
+				continue
+			}
+			if err := os.Chtimes(filepath.Join(store.Dir, key), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return store
+	}
+
+	tests := []struct {
+		mode            string
+		wantOrphans     []string
+		wantImages      []string
+		wantStored      []string
+		wantQuarantined []string
+	}{
+		{
+			mode:        GCReport,
+			wantOrphans: []string{"orphan.png"},
+			wantImages:  []string{"avatar.png", "fresh.png", "missing.png", "pending.png", "used.png"},
+			wantStored:  []string{"avatar.png", "fresh.png", "new.png", "orphan.png", "pending.png", "used.png", "used_thumb.png"},
+		},
+		{
+			// The unattached image's row is dropped first, which leaves its file orphaned as well
+			mode:            GCQuarantine,
+			wantOrphans:     []string{"orphan.png", "pending.png"},
+			wantImages:      []string{"avatar.png", "fresh.png", "missing.png", "used.png"},
+			wantStored:      []string{"avatar.png", "fresh.png", "new.png", "used.png", "used_thumb.png"},
+			wantQuarantined: []string{"orphan.png", "pending.png"},
+		},
+		{
+			mode:        GCDelete,
+			wantOrphans: []string{"orphan.png", "pending.png"},
+			wantImages:  []string{"avatar.png", "fresh.png", "missing.png", "used.png"},
+			wantStored:  []string{"avatar.png", "fresh.png", "new.png", "used.png", "used_thumb.png"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			store := setup(t)
+			result, err := CheckUploads(tt.mode, grace)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var orphans []string
+			for _, f := range result.Orphans {
+				orphans = append(orphans, f.Key)
+			}
+			sort.Strings(orphans)
+			if !reflect.DeepEqual(orphans, tt.wantOrphans) {
+				t.Errorf("orphans = %q, want %q", orphans, tt.wantOrphans)
+			}
+			if want := []string{"pending.png"}; !reflect.DeepEqual(result.Unattached, want) {
+				t.Errorf("unattached = %q, want %q", result.Unattached, want)
+			}
+			if len(result.Missing) != 1 || result.Missing[0].Filename != "missing.png" || len(result.Missing[0].PostIDs) != 1 {
+				t.Errorf("missing = %+v, want missing.png used by one post", result.Missing)
+			}
+			if result.Scanned != 7 || result.Recent != 1 {
+				t.Errorf("scanned %d with %d recent, want 7 with 1", result.Scanned, result.Recent)
+			}
+			if tt.mode != GCReport && result.Cleaned != len(tt.wantOrphans) {
+				t.Errorf("cleaned %d, want %d", result.Cleaned, len(tt.wantOrphans))
+			}
+
+			var images []string
+			rows, err := DB.Query("SELECT filename FROM images ORDER BY filename")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var filename string
+				if err := rows.Scan(&filename); err != nil {
+					t.Fatal(err)
+				}
+				images = append(images, filename)
+			}
+			rows.Close()
+			if !reflect.DeepEqual(images, tt.wantImages) {
+				t.Errorf("images left = %q, want %q", images, tt.wantImages)
+			}
+
+			if stored := storedKeys(t); !reflect.DeepEqual(stored, tt.wantStored) {
+				t.Errorf("files left = %q, want %q", stored, tt.wantStored)
+			}
+			var quarantined []string
+			err = NewLocalStorage(filepath.Join(store.Dir, quarantineName)).List(func(f StoredFile) error {
+				quarantined = append(quarantined, f.Key)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(quarantined, tt.wantQuarantined) {
+				t.Errorf("quarantined = %q, want %q", quarantined, tt.wantQuarantined)
+			}
+		})
+	}
+
+	t.Run("unknown mode", func(t *testing.T) {
+		setup(t)
+		if _, err := CheckUploads("purge", grace); err == nil {
+			t.Error("an unknown mode was accepted")
+		}
+	})
+}
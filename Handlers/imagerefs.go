@@ -0,0 +1,191 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every stored image has a row in the images table counting its references: one for each
+// post_images row using it, and one for each upload that hasn't been saved with a post yet.
+// Uploads with the same content share one image, named after the content's hash.
+//
+// A reference is taken when an image is uploaded (acquireImage or registerImage) and handed
+// over to the post_images row it is saved as. References are dropped inside the transaction
+// that removes the post_images rows (releaseImageRefs), and the files of images without
+// references are deleted only after that transaction commits (deleteUnreferencedImages).
+
+// imageLocks serialises storing an image's files against deleting them, so that a file is never
+// deleted while an upload of the same content is storing it again. Images are locked one at a
+// time by lockImage, so uploads of different content never wait for each other.
+var imageLocks = keyedMutex{locks: make(map[string]*keyedLock)}
+
+// keyedMutex is a mutex per key. A key's lock is forgotten once nobody holds or waits for it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu      sync.Mutex
+	holders int // goroutines holding or waiting for mu
+}
+
+// lock locks key and returns the function that unlocks it again
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.holders++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		l.holders--
+		if l.holders == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// lockImage locks the image stored under filename, or any stored variant of it, and returns the
+// function that unlocks it. Images are named after the hash of their content, which ImageHandler
+// locks before it stores an upload.
+func lockImage(filename string) func() {
+	filename = imageFilenameForKey(filename)
+	return imageLocks.lock(strings.TrimSuffix(filename, path.Ext(filename)))
+}
+
+// acquireImage takes a reference to the image with the given content hash.
+// It returns false when no image with that content is stored.
+func acquireImage(hash string) (string, bool, error) {
+	result, err := DB.Exec("UPDATE images SET ref_count = ref_count + 1, acquired_at = ? WHERE hash = ?", time.Now(), hash)
+	if err != nil {
+		return "", false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return "", false, err
+	}
+
+	var filename string
+	err = DB.QueryRow("SELECT filename FROM images WHERE hash = ?", hash).Scan(&filename)
+	if err != nil {
+		return "", false, err
+	}
+	return filename, true, nil
+}
+
+// registerImage records a newly stored image with the reference of the upload that stored it.
+// Callers hold the image's lock from storing the files until the image is registered.
+func registerImage(filename, hash string, size int64, animated bool) error {
+	_, err := DB.Exec(`
+        INSERT INTO images (filename, hash, size, animated, variants, ref_count, created_at, acquired_at)
+        VALUES (?, ?, ?, ?, 1, 1, ?, ?)
+    `, filename, hash, size, animated, time.Now(), time.Now())
+	return err
+}
+
+// releaseImageRefs drops one reference to each of the given images as part of tx. It returns
+// the images left without references, whose files are deleted with deleteUnreferencedImages
+// once tx has committed.
+func releaseImageRefs(tx *sql.Tx, filenames []string) ([]string, error) {
+	var unreferenced []string
+	for _, filename := range filenames {
+		_, err := tx.Exec("UPDATE images SET ref_count = ref_count - 1 WHERE filename = ?", filename)
+		if err != nil {
+			return nil, err
+		}
+
+		var refs int
+		err = tx.QueryRow("SELECT ref_count FROM images WHERE filename = ?", filename).Scan(&refs)
+		if err == sql.ErrNoRows {
+			// Untracked files have nothing else referring to them
+			unreferenced = append(unreferenced, filename)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if refs > 0 {
+			continue
+		}
+
+		_, err = tx.Exec("DELETE FROM images WHERE filename = ?", filename)
+		if err != nil {
+			return nil, err
+		}
+		unreferenced = append(unreferenced, filename)
+	}
+	return unreferenced, nil
+}
+
+// releaseImages drops the references of uploads that won't be saved with a post, such as
+// the images of a post that failed to save, and deletes the images nothing else refers to
+func releaseImages(images []PostImage) {
+	filenames := make([]string, len(images))
+	for i, img := range images {
+		filenames[i] = img.Filename
+	}
+	releaseImageFiles(filenames...)
+}
+
+// releaseImageFiles is releaseImages for images given by filename
+func releaseImageFiles(filenames ...string) {
+	if len(filenames) == 0 {
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Printf("Error releasing images: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	unreferenced, err := releaseImageRefs(tx, filenames)
+	if err != nil {
+		log.Printf("Error releasing images: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error releasing images: %v", err)
+		return
+	}
+	deleteUnreferencedImages(unreferenced)
+}
+
+// deleteUnreferencedImages deletes the files of images returned by releaseImageRefs, unless an
+// upload of the same content has stored them again since. Errors are logged, not returned,
+// because the database changes they belong to have already been committed.
+func deleteUnreferencedImages(filenames []string) {
+	for _, filename := range filenames {
+		deleteUnreferencedImage(filename)
+	}
+}
+
+// deleteUnreferencedImage deletes the files of one image for deleteUnreferencedImages
+func deleteUnreferencedImage(filename string) {
+	unlock := lockImage(filename)
+	defer unlock()
+
+	var reused bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE filename = ?)", filename).Scan(&reused)
+	if err != nil {
+		log.Printf("Error checking image references: %v", err)
+		return
+	}
+	if reused {
+		return
+	}
+	if err := DeleteImage(filename); err != nil {
+		log.Printf("Error deleting image file: %v", err)
+	}
+}
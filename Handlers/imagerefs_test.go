@@ -0,0 +1,267 @@
+package RebootForums
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestStore points Store at an empty local storage directory for the rest of the test
+func useTestStore(t *testing.T) *LocalStorage {
+	t.Helper()
+	store := NewLocalStorage(t.TempDir())
+	previous := Store
+	Store = store
+	t.Cleanup(func() { Store = previous })
+	return store
+}
+
+// putTestFile stores a small file under key
+func putTestFile(t *testing.T, key string) {
+	t.Helper()
+	if err := Store.Put(key, strings.NewReader("data"), 4, contentTypeForKey(key)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedKeys lists the keys in Store
+func storedKeys(t *testing.T) []string {
+	t.Helper()
+	var keys []string
+	err := Store.List(func(f StoredFile) error {
+		keys = append(keys, f.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// imageRefCount returns the ref_count of an image, or -1 when it has no row
+func imageRefCount(t *testing.T, filename string) int {
+	t.Helper()
+	refs := -1
+	err := DB.QueryRow("SELECT ref_count FROM images WHERE filename = ?", filename).Scan(&refs)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+func TestAcquireImage(t *testing.T) {
+	useTestDB(t)
+
+	if _, ok, err := acquireImage("unknown"); err != nil || ok {
+		t.Fatalf("acquired an image that isn't stored: %v, %v", ok, err)
+	}
+
+	if err := registerImage("abc.png", "abc", 10, false); err != nil {
+		t.Fatal(err)
+	}
+	for want := 2; want <= 3; want++ {
+		filename, ok, err := acquireImage("abc")
+		if err != nil || !ok || filename != "abc.png" {
+			t.Fatalf("acquireImage = %q, %v, %v; want abc.png", filename, ok, err)
+		}
+		if refs := imageRefCount(t, "abc.png"); refs != want {
+			t.Errorf("ref_count = %d, want %d", refs, want)
+		}
+	}
+}
+
+func TestReleaseImageRefs(t *testing.T) {
+	tests := []struct {
+		name             string
+		refs             map[string]int // images and their reference counts before releasing
+		release          []string
+		wantUnreferenced []string
+		wantRefs         map[string]int // -1 for images whose row is gone
+	}{
+		{
+			name:     "shared image keeps its row",
+			refs:     map[string]int{"a.png": 2},
+			release:  []string{"a.png"},
+			wantRefs: map[string]int{"a.png": 1},
+		},
+		{
+			name:             "last reference",
+			refs:             map[string]int{"a.png": 1, "b.png": 3},
+			release:          []string{"a.png", "b.png"},
+			wantUnreferenced: []string{"a.png"},
+			wantRefs:         map[string]int{"a.png": -1, "b.png": 2},
+		},
+		{
+			name:             "every reference of an image at once",
+			refs:             map[string]int{"a.png": 2},
+			release:          []string{"a.png", "a.png"},
+			wantUnreferenced: []string{"a.png"},
+			wantRefs:         map[string]int{"a.png": -1},
+		},
+		{
+			name:             "untracked file",
+			release:          []string{"legacy.png"},
+			wantUnreferenced: []string{"legacy.png"},
+			wantRefs:         map[string]int{"legacy.png": -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			for filename, refs := range tt.refs {
+				_, err := DB.Exec("INSERT INTO images (filename, ref_count) VALUES (?, ?)", filename, refs)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx, err := DB.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			unreferenced, err := releaseImageRefs(tx, tt.release)
+			if err != nil {
+				tx.Rollback()
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(unreferenced, tt.wantUnreferenced) {
+				t.Errorf("unreferenced = %q, want %q", unreferenced, tt.wantUnreferenced)
+			}
+			for filename, want := range tt.wantRefs {
+				if refs := imageRefCount(t, filename); refs != want {
+					t.Errorf("ref_count of %s = %d, want %d", filename, refs, want)
+				}
+			}
+		})
+	}
+}
+
+// testPNG encodes a small opaque PNG filled with c
+func testPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// memoryFile is an uploaded file held in memory
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+// uploadTestImage runs data through ImageHandler as an upload
+func uploadTestImage(t *testing.T, data []byte) string {
+	t.Helper()
+	filename, err := ImageHandler(memoryFile{bytes.NewReader(data)}, &multipart.FileHeader{Filename: "upload.png", Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestImageUploadsShareStoredFiles(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+
+	red := testPNG(t, color.RGBA{R: 255, A: 255})
+	first := uploadTestImage(t, red)
+	second := uploadTestImage(t, red)
+	if first != second {
+		t.Fatalf("the same content was stored as %s and %s", first, second)
+	}
+	other := uploadTestImage(t, testPNG(t, color.RGBA{B: 255, A: 255}))
+	if other == first {
+		t.Fatal("different content was stored under the same name")
+	}
+	if refs := imageRefCount(t, first); refs != 2 {
+		t.Errorf("ref_count = %d, want 2", refs)
+	}
+	if keys := storedKeys(t); len(keys) != 2*len(imageVariantSizes) {
+		t.Errorf("stored %q, want every variant of two images", keys)
+	}
+
+	// The files stay until the last reference is released
+	releaseImageFiles(first)
+	if exists, err := Store.Exists(first); err != nil || !exists {
+		t.Fatalf("released a shared image's files: %v, %v", exists, err)
+	}
+	releaseImageFiles(first)
+	for variant := range imageVariantSizes {
+		if exists, err := Store.Exists(variantFilename(first, variant)); err != nil || exists {
+			t.Errorf("the %s variant of an unreferenced image is still stored: %v", variant, err)
+		}
+	}
+	if refs := imageRefCount(t, first); refs != -1 {
+		t.Errorf("the unreferenced image still has a row with ref_count %d", refs)
+	}
+
+	// Uploading released content stores it again
+	if again := uploadTestImage(t, red); again != first {
+		t.Errorf("re-uploaded content was stored as %s, want %s", again, first)
+	}
+	if exists, err := Store.Exists(first); err != nil || !exists {
+		t.Errorf("re-uploaded image isn't stored: %v, %v", exists, err)
+	}
+}
+
+func TestDeleteUnreferencedImagesSkipsReusedImages(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+
+	putTestFile(t, "gone.png")
+	putTestFile(t, "reused.png")
+	// An upload registered the same content again after its last reference was released
+	if err := registerImage("reused.png", "reused", 4, false); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteUnreferencedImages([]string{"gone.png", "reused.png"})
+	if keys := storedKeys(t); !reflect.DeepEqual(keys, []string{"reused.png"}) {
+		t.Errorf("stored %q after deleting, want only reused.png", keys)
+	}
+}
+
+func TestKeyedMutexForgetsUnusedKeys(t *testing.T) {
+	k := keyedMutex{locks: make(map[string]*keyedLock)}
+	unlockA := k.lock("a")
+	done := make(chan struct{})
+	go func() {
+		unlock := k.lock("a")
+		unlock()
+		close(done)
+	}()
+	// Other keys don't wait for a
+	k.lock("b")()
+
+	select {
+	case <-done:
+		t.Fatal("a was locked twice at once")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlockA()
+	<-done
+	if len(k.locks) != 0 {
+		t.Errorf("%d lock(s) left after every key was unlocked", len(k.locks))
+	}
+}
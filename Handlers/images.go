@@ -1,100 +1,532 @@
 package RebootForums
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
 
-	"github.com/google/uuid"
+const (
+	MaxImageSize = 20 * 1024 * 1024 // 20 MB
+	jpegQuality  = 85
 )
 
+// ImageVariant names one of the sizes every upload is stored in
+type ImageVariant string
+
 const (
-	MaxImageSize    = 20 * 1024 * 1024 // 20 MB
-	UploadDirectory = "./uploads"
+	ImageThumb ImageVariant = "thumb"
+	ImageFeed  ImageVariant = "feed"
+	ImageFull  ImageVariant = "full"
 )
 
-// ImageHandler handles the image upload process
+// imageVariantSizes is the longest side of each variant in pixels. Images are never enlarged.
+var imageVariantSizes = map[ImageVariant]int{
+	ImageThumb: 200,
+	ImageFeed:  800,
+	ImageFull:  2048,
+}
+
+// acceptedImageTypes are the upload types ImageHandler accepts, as detected from the file's content.
+// AVIF is not accepted because there is no pure-Go AVIF decoder.
+var acceptedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// imageExtensions maps the types images are stored as to the extension they are stored with
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// processedImage is an upload re-encoded in every variant size
+type processedImage struct {
+	variants map[ImageVariant][]byte
+	// filetype is the type the variants are stored as. WebP uploads are stored as JPEG,
+	// or as PNG when they have transparency, since there is no pure-Go WebP encoder.
+	filetype string
+	// animated is set for animated GIFs. Their full variant keeps the animation; the
+	// smaller variants are static posters of the first frame.
+	animated bool
+}
+
+// ImageHandler handles the image upload process. The upload is decoded, turned upright
+// according to its EXIF orientation and re-encoded without metadata in every variant size.
+// Uploads with content that is already stored reuse the stored image instead.
+// It returns the filename of the full variant, which is what gets stored on the post, and
+// takes a reference to the image that the caller saves with a post or releases with releaseImages.
 func ImageHandler(file multipart.File, handler *multipart.FileHeader) (string, error) {
 	// Check file size
 	if handler.Size > MaxImageSize {
 		return "", fmt.Errorf("image is too large (max %d MB)", MaxImageSize/(1024*1024))
 	}
 
-	// Validate file type
-	buff := make([]byte, 512)
-	_, err := file.Read(buff)
+	data, err := io.ReadAll(io.LimitReader(file, MaxImageSize+1))
 	if err != nil {
 		return "", err
 	}
-
-	filetype := http.DetectContentType(buff)
-	if filetype != "image/jpeg" && filetype != "image/png" && filetype != "image/gif" {
-		return "", fmt.Errorf("invalid file type: only JPEG, PNG and GIF are allowed")
+	if len(data) > MaxImageSize {
+		return "", fmt.Errorf("image is too large (max %d MB)", MaxImageSize/(1024*1024))
 	}
 
-	// Reset the read pointer
-	_, err = file.Seek(0, io.SeekStart)
+	// Validate the file type from the content; the uploaded filename is never trusted
+	filetype, err := detectImageType(data)
 	if err != nil {
 		return "", err
 	}
 
-	// Decode the image to validate it
-	_, _, err = image.Decode(file)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if filename, ok, err := acquireImage(hash); err != nil || ok {
+		return filename, err
+	}
+
+	// Check the dimensions before decoding, so that a small file claiming to be a huge image
+	// can't make the server allocate memory for all of its pixels
+	if err := checkImageDimensions(data, filetype); err != nil {
+		return "", err
+	}
+
+	processed, err := processImage(data, filetype)
 	if err != nil {
 		return "", fmt.Errorf("invalid image file: %v", err)
 	}
 
-	// Reset the read pointer again
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return "", err
+	unlock := imageLocks.lock(hash)
+	defer unlock()
+
+	// Another upload of the same content may have been stored while this one was processed
+	if filename, ok, err := acquireImage(hash); err != nil || ok {
+		return filename, err
 	}
 
-	// Generate a unique filename
-	ext := strings.ToLower(filepath.Ext(handler.Filename))
-	newFilename := uuid.New().String() + ext
+	// Name the image after its content and store every variant next to it
+	newFilename := hash + imageExtensions[processed.filetype]
+	for variant, encoded := range processed.variants {
+		key := variantFilename(newFilename, variant)
+		err = Store.Put(key, bytes.NewReader(encoded), int64(len(encoded)), contentTypeForKey(key))
+		if err != nil {
+			DeleteImage(newFilename)
+			return "", err
+		}
+	}
 
-	// Ensure upload directory exists
-	err = os.MkdirAll(UploadDirectory, os.ModePerm)
-	if err != nil {
+	if err := registerImage(newFilename, hash, int64(len(data)), processed.animated); err != nil {
+		DeleteImage(newFilename)
 		return "", err
 	}
+	return newFilename, nil
+}
+
+// detectImageType returns the type of an upload as detected from its content, which only
+// depends on the first 512 bytes, and rejects the types ImageHandler doesn't accept
+func detectImageType(data []byte) (string, error) {
+	filetype := http.DetectContentType(data)
+	if !acceptedImageTypes[filetype] {
+		return "", fmt.Errorf("invalid file type: only JPEG, PNG, GIF and WebP are allowed")
+	}
+	return filetype, nil
+}
+
+// processImage decodes an upload and returns it re-encoded in every variant size
+func processImage(data []byte, filetype string) (processedImage, error) {
+	processed := processedImage{
+		variants: make(map[ImageVariant][]byte, len(imageVariantSizes)),
+		filetype: filetype,
+	}
+
+	var img image.Image
+	switch filetype {
+	case "image/gif":
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return processed, err
+		}
+		img = gifFirstFrame(anim)
+		// Animated GIFs keep every frame at their original size; only the smaller variants are resized
+		if len(anim.Image) > 1 {
+			var buf bytes.Buffer
+			if err := gif.EncodeAll(&buf, anim); err != nil {
+				return processed, err
+			}
+			processed.variants[ImageFull] = buf.Bytes()
+			processed.animated = true
+		}
+	case "image/jpeg":
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return processed, err
+		}
+		img = decoded
+	case "image/webp":
+		decoded, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return processed, err
+		}
+		img = decoded
+		processed.filetype = "image/png"
+		if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+			processed.filetype = "image/jpeg"
+		}
+	default:
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return processed, err
+		}
+		img = decoded
+	}
+
+	// Resize before rotating, so at most the full variant's pixels are rotated
+	img = resizeImage(img, imageVariantSizes[ImageFull])
+	if filetype == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	for variant, size := range imageVariantSizes {
+		if _, done := processed.variants[variant]; done {
+			continue
+		}
+		encoded, err := encodeImage(resizeImage(img, size), processed.filetype)
+		if err != nil {
+			return processed, err
+		}
+		processed.variants[variant] = encoded
+	}
+	return processed, nil
+}
 
-	// Create the file
-	dst, err := os.Create(filepath.Join(UploadDirectory, newFilename))
+// checkImageDimensions reads an image's dimensions from its header and rejects images with more than
+// MaxImagePixels pixels. Animated GIFs are limited by the pixels of all their frames together.
+func checkImageDimensions(data []byte, filetype string) error {
+	var config image.Config
+	var err error
+	switch filetype {
+	case "image/jpeg":
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	case "image/gif":
+		config, err = gif.DecodeConfig(bytes.NewReader(data))
+	case "image/webp":
+		config, err = webp.DecodeConfig(bytes.NewReader(data))
+	default:
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	}
 	if err != nil {
-		return "", err
+		return fmt.Errorf("invalid image file: %v", err)
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	if filetype == "image/gif" {
+		framePixels, err := gifFramePixels(data)
+		if err != nil {
+			return fmt.Errorf("invalid image file: %v", err)
+		}
+		pixels = max(pixels, framePixels)
+	}
+	if pixels > int64(MaxImagePixels) {
+		return fmt.Errorf("image is too large (max %d megapixels)", MaxImagePixels/(1000*1000))
+	}
+	return nil
+}
+
+// gifFramePixels adds up the pixels of every frame of a GIF by walking its blocks,
+// without decompressing any image data
+func gifFramePixels(data []byte) (int64, error) {
+	errInvalid := errors.New("malformed GIF")
+	if len(data) < 13 {
+		return 0, errInvalid
+	}
+	i := 13
+	// Skip the global color table
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
 	}
-	defer dst.Close()
 
-	// Copy the uploaded file to the created file on the filesystem
-	_, err = io.Copy(dst, file)
+	// skipSubBlocks skips a sequence of data sub-blocks ending with an empty one
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var pixels int64
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: introducer, label and sub-blocks
+			i += 2
+			if !skipSubBlocks() {
+				return 0, errInvalid
+			}
+		case 0x2C: // image descriptor, an optional local color table, the LZW code size and sub-blocks
+			if i+10 > len(data) {
+				return 0, errInvalid
+			}
+			width := int64(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int64(binary.LittleEndian.Uint16(data[i+7:]))
+			pixels += width * height
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++
+			if !skipSubBlocks() {
+				return 0, errInvalid
+			}
+		case 0x3B: // trailer
+			return pixels, nil
+		default:
+			return 0, errInvalid
+		}
+	}
+	// Truncated GIFs are rejected when they are decoded
+	return pixels, nil
+}
+
+// gifFirstFrame draws the first frame of a GIF onto a canvas of the GIF's full size
+func gifFirstFrame(anim *gif.GIF) image.Image {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		return anim.Image[0]
+	}
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, anim.Image[0].Bounds(), anim.Image[0], anim.Image[0].Bounds().Min, draw.Over)
+	return canvas
+}
+
+// resizeImage scales an image down so that its longest side is at most size pixels
+func resizeImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+	return dst
+}
+
+// encodeImage encodes an image in the format it was uploaded in. Encoding never writes metadata.
+func encodeImage(img image.Image, filetype string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch filetype {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// EXIF data always comes before the image data starts
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < entries; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation flips and rotates an image so that it displays upright for an EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// Orientations 5 to 8 swap width and height
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// variantFilename returns the name a variant of an upload is stored under.
+// The full variant keeps the upload's own name.
+func variantFilename(filename string, variant ImageVariant) string {
+	if variant == ImageFull {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + string(variant) + ext
+}
+
+// imagesWithoutVariants holds the images that only have their full variant stored, because they
+// were uploaded before variants were generated. It is filled in by LoadImageVariants.
+var imagesWithoutVariants = map[string]bool{}
+
+// LoadImageVariants records which stored images have their smaller variants, so GetImageURL never
+// has to ask the storage backend. Images whose variants haven't been found yet are looked up in the
+// backend once at startup, so images filled in by `forum storage migrate` are picked up again.
+// New uploads always have every variant. It must be called before the server starts serving.
+func LoadImageVariants() error {
+	rows, err := DB.Query("SELECT filename FROM images WHERE variants IS NULL OR variants = 0")
 	if err != nil {
-		return "", err
+		return err
+	}
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			rows.Close()
+			return err
+		}
+		filenames = append(filenames, filename)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return newFilename, nil
+	missing := make(map[string]bool)
+	for _, filename := range filenames {
+		stored, err := Store.Exists(variantFilename(filename, ImageThumb))
+		if err != nil {
+			return err
+		}
+		if _, err := DB.Exec("UPDATE images SET variants = ? WHERE filename = ?", stored, filename); err != nil {
+			return err
+		}
+		if !stored {
+			missing[filename] = true
+		}
+	}
+	imagesWithoutVariants = missing
+	return nil
 }
 
-// GetImageURL returns the URL for the given image filename
-func GetImageURL(filename string) string {
-	return fmt.Sprintf("/uploads/%s", filename)
+// GetImageURL returns the URL of a variant of the given image. Images uploaded before
+// variants were generated only have the full variant, which is served instead.
+func GetImageURL(filename string, variant ImageVariant) string {
+	if variant == ImageFull || imagesWithoutVariants[filename] {
+		return Store.URL(filename)
+	}
+	return Store.URL(variantFilename(filename, variant))
 }
 
-// DeleteImage deletes the image file with the given filename
+// DeleteImage deletes every variant of the image with the given filename
 func DeleteImage(filename string) error {
-	err := os.Remove(filepath.Join(UploadDirectory, filename))
-	if err != nil && !os.IsNotExist(err) {
-		return err
+	for variant := range imageVariantSizes {
+		if err := Store.Delete(variantFilename(filename, variant)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,90 @@
+package RebootForums
+
+import "testing"
+
+func TestVariantFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		variant  ImageVariant
+		want     string
+	}{
+		{"abc.jpg", ImageFull, "abc.jpg"},
+		{"abc.jpg", ImageThumb, "abc_thumb.jpg"},
+		{"abc.png", ImageFeed, "abc_feed.png"},
+		{"noext", ImageThumb, "noext_thumb"},
+	}
+	for _, tt := range tests {
+		if got := variantFilename(tt.filename, tt.variant); got != tt.want {
+			t.Errorf("variantFilename(%q, %s) = %q, want %q", tt.filename, tt.variant, got, tt.want)
+		}
+		if tt.variant != ImageFull {
+			if got := imageFilenameForKey(tt.want); got != tt.filename {
+				t.Errorf("imageFilenameForKey(%q) = %q, want %q", tt.want, got, tt.filename)
+			}
+		}
+	}
+}
+
+func TestLoadImageVariants(t *testing.T) {
+	useTestDB(t)
+	useTestStore(t)
+	t.Cleanup(func() { imagesWithoutVariants = map[string]bool{} })
+
+	// legacy.png was uploaded before variants were generated and filled.png had its variants
+	// filled in by a storage migration since; new.png was uploaded with variants
+	for _, key := range []string{"legacy.png", "filled.png", "filled_thumb.png", "filled_feed.png", "new.png", "new_thumb.png", "new_feed.png"} {
+		putTestFile(t, key)
+	}
+	for _, img := range []struct {
+		filename string
+		variants interface{}
+	}{
+		{"legacy.png", nil}, {"filled.png", 0}, {"new.png", 1},
+	} {
+		if _, err := DB.Exec("INSERT INTO images (filename, variants) VALUES (?, ?)", img.filename, img.variants); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := LoadImageVariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		variant  ImageVariant
+		want     string
+	}{
+		{"legacy.png", ImageFull, "/uploads/legacy.png"},
+		{"legacy.png", ImageThumb, "/uploads/legacy.png"},
+		{"legacy.png", ImageFeed, "/uploads/legacy.png"},
+		{"filled.png", ImageThumb, "/uploads/filled_thumb.png"},
+		{"new.png", ImageFull, "/uploads/new.png"},
+		{"new.png", ImageFeed, "/uploads/new_feed.png"},
+		// Images without a row have been uploaded since the server started, with variants
+		{"unknown.png", ImageThumb, "/uploads/unknown_thumb.png"},
+	}
+	for _, tt := range tests {
+		if got := GetImageURL(tt.filename, tt.variant); got != tt.want {
+			t.Errorf("GetImageURL(%q, %s) = %q, want %q", tt.filename, tt.variant, got, tt.want)
+		}
+	}
+
+	// What was found is recorded, so only images still without variants are looked up again
+	rows, err := DB.Query("SELECT filename, variants FROM images ORDER BY filename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := map[string]bool{"filled.png": true, "legacy.png": false, "new.png": true}
+	for rows.Next() {
+		var filename string
+		var variants bool
+		if err := rows.Scan(&filename, &variants); err != nil {
+			t.Fatal(err)
+		}
+		if variants != want[filename] {
+			t.Errorf("variants of %s = %v, want %v", filename, variants, want[filename])
+		}
+	}
+}
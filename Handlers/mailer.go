@@ -0,0 +1,151 @@
+package RebootForums
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer backends
+const (
+	MailerLog  = "log"
+	MailerFile = "file"
+	MailerSMTP = "smtp"
+)
+
+// Email is a plain text message to a single recipient
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	Send(msg Email) error
+}
+
+// Mail is the mailer emails are sent with, chosen by MAILER
+var Mail Mailer = LogMailer{}
+
+// MailFrom is the sender of every email
+var MailFrom = envString("MAIL_FROM", "Reboot Forums <noreply@localhost>")
+
+// InitMailer sets Mail to the mailer configured in the environment
+func InitMailer() error {
+	mailer, err := NewMailer(envString("MAILER", MailerLog))
+	if err != nil {
+		return err
+	}
+	Mail = mailer
+	return nil
+}
+
+// NewMailer creates a mailer by name, configured from the environment:
+//
+//	log:  writes emails to the server log
+//	file: MAIL_DIR (default ./mail), one .eml file per email
+//	smtp: SMTP_HOST, SMTP_PORT (default 587), SMTP_USERNAME and SMTP_PASSWORD
+func NewMailer(name string) (Mailer, error) {
+	switch name {
+	case MailerLog:
+		return LogMailer{}, nil
+	case MailerFile:
+		dir := envString("MAIL_DIR", "./mail")
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir}, nil
+	case MailerSMTP:
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mailer")
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     envInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", name)
+	}
+}
+
+// formatEmail renders a message with its headers, ready to be sent over SMTP or saved as .eml
+func formatEmail(msg Email) []byte {
+	var b bytes.Buffer
+	// Header values come from user input such as email addresses, so line breaks are dropped
+	header := func(name, value string) {
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", MailFrom)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// LogMailer writes emails to the server log instead of sending them, for development
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Email) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer saves each email as an .eml file in a directory, for development and tests
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(msg Email) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), sanitizeMailName(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatEmail(msg), 0o600)
+}
+
+// sanitizeMailName makes an email address safe to use in a filename
+func sanitizeMailName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '@' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+// SMTPMailer sends emails through an SMTP server. The connection is upgraded with STARTTLS
+// when the server supports it, and credentials are only sent over TLS or to localhost.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(msg Email) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	from, err := mail.ParseAddress(MailFrom)
+	if err != nil {
+		return fmt.Errorf("invalid MAIL_FROM %q: %w", MailFrom, err)
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, from.Address, []string{msg.To}, formatEmail(msg))
+}
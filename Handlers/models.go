@@ -15,24 +15,72 @@ type Post struct {
 	Content       string
 	Author        string
 	CreatedAt     time.Time
+	UpdatedAt     time.Time
 	Likes         int
 	Dislikes      int
-	ImageFilename string // New field for storing the image filename
+	CommentCount  int
+	ViewCount     int         // distinct members and guests who opened the post
+	CoverImage    string      // filename of the post's first image, shown in feeds
+	ImageCount    int         // number of images in the post's gallery
+	CoverAnimated bool        // the cover is an animated GIF, shown in feeds as a static poster
+	Images        []PostImage // the gallery in display order; only loaded for single posts
+	IsHidden      bool        // hidden by a moderator
+	IsLocked      bool        // locked threads accept no new comments
+}
+
+// PostImage is one image in a post's gallery
+type PostImage struct {
+	ID       int
+	PostID   int
+	Filename string
+	Position int
+	Caption  string // also used as the image's alt text
+	Size     int64  // size of the upload in bytes
+	Animated bool   // an animated GIF, whose smaller variants are static posters
 }
 
 func (p Post) FormattedCreatedAt() string {
 	return p.CreatedAt.Format("January 2, 2006 at 3:04 PM")
 }
 
+// IsEdited reports whether the post was updated after it was created
+func (p Post) IsEdited() bool {
+	return p.UpdatedAt.Sub(p.CreatedAt) > time.Second
+}
+
+func (p Post) FormattedUpdatedAt() string {
+	return p.UpdatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
 // Comment represents a comment on a post
 type Comment struct {
 	ID        int
 	PostID    int
+	ParentID  int // 0 for top-level comments
 	Content   string
 	Author    string
 	CreatedAt time.Time
+	UpdatedAt time.Time
 	Likes     int
 	Dislikes  int
+	IsDeleted bool
+	IsHidden  bool // hidden by a moderator
+	Depth     int
+	Replies   []Comment
+}
+
+// CanReply reports whether replies to this comment stay within MaxCommentDepth
+func (c Comment) CanReply() bool {
+	return !c.IsDeleted && !c.IsHidden && c.Depth < MaxCommentDepth
+}
+
+// IsEdited reports whether the comment was updated after it was created
+func (c Comment) IsEdited() bool {
+	return c.UpdatedAt.Sub(c.CreatedAt) > time.Second
+}
+
+func (c Comment) FormattedUpdatedAt() string {
+	return c.UpdatedAt.Format("January 2, 2006 at 3:04 PM")
 }
 
 // Category represents a forum category
@@ -41,12 +89,177 @@ type Category struct {
 	Name string
 }
 
+// User roles, from least to most privileged
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles lists every user role in order of privilege
+var Roles = []string{RoleMember, RoleModerator, RoleAdmin}
+
 // User represents a forum user
 type User struct {
-	ID       int
-	Username string
-	Email    string
-	Password string
+	ID            int
+	Username      string
+	Email         string
+	Password      string
+	Role          string
+	EmailVerified bool
+}
+
+// Profile is what a user's public profile page shows
+type Profile struct {
+	ID            int
+	Username      string
+	Role          string
+	Bio           string
+	Avatar        string    // filename of the avatar image, empty without one
+	JoinedAt      time.Time // zero for users who joined before join dates were recorded
+	PostCount     int
+	CommentCount  int
+	LikesReceived int
+}
+
+// IsModerator reports whether the user may moderate content; admins are moderators too
+func (u *User) IsModerator() bool {
+	return u != nil && (u.Role == RoleModerator || u.Role == RoleAdmin)
+}
+
+// CanPost reports whether the user may write posts and comments, which needs a verified email address
+func (u *User) CanPost() bool {
+	return u != nil && u.EmailVerified
+}
+
+// IsAdmin reports whether the user may manage roles
+func (u *User) IsAdmin() bool {
+	return u != nil && u.Role == RoleAdmin
+}
+
+// ModerationAction is an entry in the moderation audit log
+type ModerationAction struct {
+	ID          int
+	ModeratorID int
+	Moderator   string
+	Action      string
+	TargetType  string
+	TargetID    int
+	PostID      int // the post the target belongs to, 0 when there is none
+	Details     string
+	CreatedAt   time.Time
+}
+
+func (a ModerationAction) FormattedCreatedAt() string {
+	return a.CreatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+// Report is a user's report of a post or comment
+type Report struct {
+	ID         int
+	ReporterID int
+	Reporter   string
+	TargetType string
+	TargetID   int
+	PostID     int
+	Reason     string
+	Details    string
+	Status     string
+	CreatedAt  time.Time
+}
+
+func (r Report) FormattedCreatedAt() string {
+	return r.CreatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+// ReportedContent groups the open reports about one post or comment for the review queue
+type ReportedContent struct {
+	TargetType   string
+	TargetID     int
+	PostID       int
+	PostTitle    string
+	Excerpt      string
+	Author       string
+	AuthorID     int
+	Warnings     int // warnings the author has received before
+	IsHidden     bool
+	AutoHidden   bool // hidden by the report threshold rather than by a moderator
+	Reports      []Report
+	LastReported time.Time
+}
+
+// AccessToken is a personal access token used to authenticate API clients and scripts.
+// Only a hash of the token is stored.
+type AccessToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time // zero when the token never expires
+	RevokedAt  time.Time // zero while the token hasn't been revoked
+}
+
+// Session is a browser session of a logged-in user, as listed on the sessions page
+type Session struct {
+	ID           int
+	UserAgent    string
+	IPAddress    string
+	CreatedAt    time.Time
+	LastActivity time.Time
+	Current      bool // the session of the request the list was made for
+}
+
+func (s Session) FormattedCreatedAt() string {
+	return s.CreatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+func (s Session) FormattedLastActivity() string {
+	return s.LastActivity.Format("January 2, 2006 at 3:04 PM")
+}
+
+// Device describes the browser and operating system of the session, e.g. "Firefox on Windows"
+func (s Session) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+func (t AccessToken) FormattedCreatedAt() string {
+	return t.CreatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+func (t AccessToken) FormattedLastUsedAt() string {
+	return t.LastUsedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+func (t AccessToken) FormattedExpiresAt() string {
+	return t.ExpiresAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+// HasScope reports whether the token grants the scope. Every token can read.
+func (t AccessToken) HasScope(scope string) bool {
+	if scope == ScopeRead {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t AccessToken) IsExpired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+func (t AccessToken) IsRevoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// IsActive reports whether the token can still be used to authenticate
+func (t AccessToken) IsActive() bool {
+	return !t.IsExpired() && !t.IsRevoked()
 }
 
 // GetAllCategories fetches all categories from the database
@@ -0,0 +1,663 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation actions recorded in the audit log
+const (
+	ModDeletePost    = "delete_post"
+	ModHidePost      = "hide_post"
+	ModUnhidePost    = "unhide_post"
+	ModLockPost      = "lock_post"
+	ModUnlockPost    = "unlock_post"
+	ModMovePost      = "move_post"
+	ModDeleteComment = "delete_comment"
+	ModHideComment   = "hide_comment"
+	ModUnhideComment = "unhide_comment"
+	ModSetRole       = "set_role"
+
+	ModAutoHidePost    = "auto_hide_post"
+	ModAutoHideComment = "auto_hide_comment"
+	ModResolveReports  = "resolve_reports"
+	ModWarnUser        = "warn_user"
+)
+
+// Kinds of moderation targets
+const (
+	TargetPost    = "post"
+	TargetComment = "comment"
+	TargetUser    = "user"
+)
+
+const (
+	ModerationLogPageSize     = 50
+	MaxModerationReasonLength = 200
+)
+
+var moderationActionLabels = map[string]string{
+	ModDeletePost:    "deleted post",
+	ModHidePost:      "hid post",
+	ModUnhidePost:    "unhid post",
+	ModLockPost:      "locked post",
+	ModUnlockPost:    "unlocked post",
+	ModMovePost:      "moved post",
+	ModDeleteComment: "deleted comment",
+	ModHideComment:   "hid comment",
+	ModUnhideComment: "unhid comment",
+	ModSetRole:       "changed role of",
+
+	ModAutoHidePost:    "auto-hid reported post",
+	ModAutoHideComment: "auto-hid reported comment",
+	ModResolveReports:  "resolved reports on",
+	ModWarnUser:        "warned user",
+}
+
+// postModerationActions maps the action names accepted from forms and the API to audit log actions
+var postModerationActions = map[string]string{
+	"delete": ModDeletePost,
+	"hide":   ModHidePost,
+	"unhide": ModUnhidePost,
+	"lock":   ModLockPost,
+	"unlock": ModUnlockPost,
+	"move":   ModMovePost,
+}
+
+var commentModerationActions = map[string]string{
+	"delete": ModDeleteComment,
+	"hide":   ModHideComment,
+	"unhide": ModUnhideComment,
+}
+
+// moderationInputError is returned when a moderation request is rejected because of its input
+type moderationInputError string
+
+func (e moderationInputError) Error() string {
+	return string(e)
+}
+
+// errUnknownModerationAction is returned for action names that aren't in the maps above
+var errUnknownModerationAction = moderationInputError("Unknown moderation action")
+
+func isModerationInputError(err error) bool {
+	_, ok := err.(moderationInputError)
+	return ok
+}
+
+// Label describes the action for the moderation dashboard
+func (a ModerationAction) Label() string {
+	if label, ok := moderationActionLabels[a.Action]; ok {
+		return label
+	}
+	return a.Action
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// logModerationAction records an action in the audit log. A zero ModeratorID records
+// a change made from the command line or by the system itself.
+func logModerationAction(db execer, a ModerationAction) error {
+	var moderatorID, postID sql.NullInt64
+	if a.ModeratorID != 0 {
+		moderatorID = sql.NullInt64{Int64: int64(a.ModeratorID), Valid: true}
+	}
+	if a.PostID != 0 {
+		postID = sql.NullInt64{Int64: int64(a.PostID), Valid: true}
+	}
+	_, err := db.Exec(`
+        INSERT INTO moderation_log (moderator_id, action, target_type, target_id, post_id, details, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, moderatorID, a.Action, a.TargetType, a.TargetID, postID, a.Details, time.Now())
+	return err
+}
+
+// canViewPost reports whether a user may see a post; hidden posts are only visible
+// to moderators and their author
+func canViewPost(user *User, post Post) bool {
+	return !post.IsHidden || user.IsModerator() || (user != nil && user.Username == post.Author)
+}
+
+// maskHiddenComments replaces the content of comments hidden by moderators
+func maskHiddenComments(comments []Comment) {
+	for i := range comments {
+		if comments[i].IsHidden && !comments[i].IsDeleted {
+			comments[i].Content = "[hidden by a moderator]"
+		}
+	}
+}
+
+// moderationDetails joins the details of an action with the moderator's reason
+func moderationDetails(details, reason string) string {
+	if reason == "" {
+		return details
+	}
+	if details == "" {
+		return "Reason: " + reason
+	}
+	return details + ". Reason: " + reason
+}
+
+// validateModerationReason trims the optional reason given for an action
+func validateModerationReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	if len(reason) > MaxModerationReasonLength {
+		return "", moderationInputError(fmt.Sprintf("Reason cannot be longer than %d characters", MaxModerationReasonLength))
+	}
+	return reason, nil
+}
+
+// validateCategoryIDs checks that at least one category was given and that they all exist
+func validateCategoryIDs(ids []int) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, moderationInputError("Select at least one category")
+	}
+	categories, err := GetAllCategories()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string, len(categories))
+	for _, c := range categories {
+		names[c.ID] = c.Name
+	}
+	var selected []string
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			return nil, moderationInputError(fmt.Sprintf("Unknown category %d", id))
+		}
+		selected = append(selected, name)
+	}
+	return selected, nil
+}
+
+// moderatePost applies a moderation action to a post and records it in the audit log
+// in the same transaction. categories is only used by "move".
+func moderatePost(moderator *User, postID int, name string, categories []int, reason string) error {
+	action, ok := postModerationActions[name]
+	if !ok {
+		return errUnknownModerationAction
+	}
+
+	var exists bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE id = ?)", postID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	entry := ModerationAction{
+		ModeratorID: moderator.ID,
+		Action:      action,
+		TargetType:  TargetPost,
+		TargetID:    postID,
+		PostID:      postID,
+		Details:     moderationDetails("", reason),
+	}
+
+	if action == ModDeletePost {
+		return deletePost(postID, &entry)
+	}
+
+	if action == ModMovePost {
+		names, err := validateCategoryIDs(categories)
+		if err != nil {
+			return err
+		}
+		entry.Details = moderationDetails("Moved to "+strings.Join(names, ", "), reason)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch action {
+	case ModHidePost, ModUnhidePost:
+		_, err = tx.Exec("UPDATE posts SET is_hidden = ?, auto_hidden = 0 WHERE id = ?", action == ModHidePost, postID)
+	case ModLockPost, ModUnlockPost:
+		_, err = tx.Exec("UPDATE posts SET is_locked = ? WHERE id = ?", action == ModLockPost, postID)
+	case ModMovePost:
+		err = setPostCategories(tx, postID, categories)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := logModerationAction(tx, entry); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moderateComment applies a moderation action to a comment and records it in the audit log.
+// It returns the post the comment belongs to.
+func moderateComment(moderator *User, commentID int, name, reason string) (int, error) {
+	action, ok := commentModerationActions[name]
+	if !ok {
+		return 0, errUnknownModerationAction
+	}
+
+	postID, _, err := getCommentOwner(commentID)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := ModerationAction{
+		ModeratorID: moderator.ID,
+		Action:      action,
+		TargetType:  TargetComment,
+		TargetID:    commentID,
+		PostID:      postID,
+		Details:     moderationDetails("", reason),
+	}
+
+	if action == ModDeleteComment {
+		return postID, deleteComment(commentID, &entry)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE comments SET is_hidden = ?, auto_hidden = 0 WHERE id = ?", action == ModHideComment, commentID)
+	if err != nil {
+		return 0, err
+	}
+	if err := logModerationAction(tx, entry); err != nil {
+		return 0, err
+	}
+	return postID, tx.Commit()
+}
+
+// SetUserRole changes a user's role. A nil moderator records the change as made from the command line.
+func SetUserRole(moderator *User, username, role string) error {
+	valid := false
+	for _, r := range Roles {
+		if r == role {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return moderationInputError(fmt.Sprintf("Unknown role %q", role))
+	}
+
+	target, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if target.Role == role {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, target.ID); err != nil {
+		return err
+	}
+	// Sessions started with the old role end, so the user logs in again with the new one
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", target.ID); err != nil {
+		return err
+	}
+
+	entry := ModerationAction{
+		Action:     ModSetRole,
+		TargetType: TargetUser,
+		TargetID:   target.ID,
+		Details:    fmt.Sprintf("%s: %s → %s", target.Username, target.Role, role),
+	}
+	if moderator != nil {
+		entry.ModeratorID = moderator.ID
+	}
+	if err := logModerationAction(tx, entry); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetModerationLog returns the most recent moderation actions, newest first
+func GetModerationLog(limit int) ([]ModerationAction, error) {
+	rows, err := DB.Query(`
+        SELECT m.id, COALESCE(m.moderator_id, 0), COALESCE(u.username, 'system'), m.action,
+               m.target_type, m.target_id, COALESCE(m.post_id, 0), m.details, m.created_at
+        FROM moderation_log m
+        LEFT JOIN users u ON u.id = m.moderator_id
+        ORDER BY m.id DESC
+        LIMIT ?
+    `, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []ModerationAction
+	for rows.Next() {
+		var a ModerationAction
+		err := rows.Scan(&a.ID, &a.ModeratorID, &a.Moderator, &a.Action,
+			&a.TargetType, &a.TargetID, &a.PostID, &a.Details, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// getFlaggedPosts lists posts matching a moderation flag column, newest first
+func getFlaggedPosts(column string) ([]Post, error) {
+	rows, err := DB.Query(`
+        SELECT p.id, p.title, u.username, p.created_at
+        FROM posts p
+        JOIN users u ON u.id = p.user_id
+        WHERE p.` + column + ` = 1
+        ORDER BY p.created_at DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Author, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// getHiddenComments lists comments hidden by moderators, newest first
+func getHiddenComments() ([]Comment, error) {
+	rows, err := DB.Query(`
+        SELECT c.id, c.post_id, c.content, u.username, c.created_at
+        FROM comments c
+        JOIN users u ON u.id = c.user_id
+        WHERE c.is_hidden = 1 AND c.is_deleted = 0
+        ORDER BY c.created_at DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Content, &c.Author, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.IsHidden = true
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// getStaff lists moderators and admins
+func getStaff() ([]User, error) {
+	rows, err := DB.Query("SELECT id, username, role FROM users WHERE role != ? ORDER BY role, username", RoleMember)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// ModerationDashboardHandler shows moderators the report queue, recent moderation actions and flagged content (/mod)
+func ModerationDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsModerator() {
+		Error403Handler(w, r)
+		return
+	}
+
+	actions, err := GetModerationLog(ModerationLogPageSize)
+	if err != nil {
+		log.Printf("Error fetching moderation log: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	hiddenPosts, err := getFlaggedPosts("is_hidden")
+	if err != nil {
+		log.Printf("Error fetching hidden posts: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	lockedPosts, err := getFlaggedPosts("is_locked")
+	if err != nil {
+		log.Printf("Error fetching locked posts: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	hiddenComments, err := getHiddenComments()
+	if err != nil {
+		log.Printf("Error fetching hidden comments: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	reports, err := GetReportQueue()
+	if err != nil {
+		log.Printf("Error fetching report queue: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	var staff []User
+	if user.IsAdmin() {
+		staff, err = getStaff()
+		if err != nil {
+			log.Printf("Error fetching staff: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+
+	data := struct {
+		Username       string
+		LoggedIn       bool
+		IsAdmin        bool
+		Actions        []ModerationAction
+		Reports        []ReportedContent
+		HiddenPosts    []Post
+		LockedPosts    []Post
+		HiddenComments []Comment
+		Staff          []User
+		Roles          []string
+		Message        string
+	}{
+		Username:       user.Username,
+		LoggedIn:       true,
+		IsAdmin:        user.IsAdmin(),
+		Actions:        actions,
+		Reports:        reports,
+		HiddenPosts:    hiddenPosts,
+		LockedPosts:    lockedPosts,
+		HiddenComments: hiddenComments,
+		Staff:          staff,
+		Roles:          Roles,
+		Message:        r.URL.Query().Get("message"),
+	}
+
+	err = RenderTemplate(w, "mod.html", data)
+	if err != nil {
+		log.Printf("Error rendering mod template: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+}
+
+// ModeratePostHandler applies the moderation action named in the form to a post (/mod/post/{id})
+func ModeratePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsModerator() {
+		Error403Handler(w, r)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.URL.Path[len("/mod/post/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		Error400Handler(w, r)
+		return
+	}
+	reason, err := validateModerationReason(r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var categories []int
+	for _, value := range r.Form["categories"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			Error400Handler(w, r)
+			return
+		}
+		categories = append(categories, id)
+	}
+
+	action := r.FormValue("action")
+	err = moderatePost(user, postID, action, categories, reason)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if isModerationInputError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error moderating post: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if action == "delete" {
+		http.Redirect(w, r, "/mod", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+}
+
+// ModerateCommentHandler applies the moderation action named in the form to a comment (/mod/comment/{id})
+func ModerateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsModerator() {
+		Error403Handler(w, r)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.URL.Path[len("/mod/comment/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	reason, err := validateModerationReason(r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	postID, err := moderateComment(user, commentID, r.FormValue("action"), reason)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if isModerationInputError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error moderating comment: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/post/%d#comment-%d", postID, commentID), http.StatusSeeOther)
+}
+
+// SetRoleHandler lets admins change a user's role (/mod/set-role)
+func SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsAdmin() {
+		Error403Handler(w, r)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	message := "Role updated"
+	if strings.EqualFold(username, user.Username) {
+		message = "You cannot change your own role"
+	} else {
+		err := SetUserRole(user, username, r.FormValue("role"))
+		if err == sql.ErrNoRows {
+			message = "User not found"
+		} else if isModerationInputError(err) {
+			message = err.Error()
+		} else if err != nil {
+			log.Printf("Error setting user role: %v", err)
+			message = "Could not update role"
+		}
+	}
+
+	http.Redirect(w, r, "/mod?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
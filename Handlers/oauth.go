@@ -0,0 +1,148 @@
+package RebootForums
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// oauthStateCookie holds the state of a login through Google or GitHub between leaving for the
+// provider and coming back to the callback. It is only sent to the /auth/ pages.
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+// errInvalidOAuthState is returned for callbacks that don't belong to a login started by the browser
+var errInvalidOAuthState = errors.New("invalid oauth state")
+
+// oauthLogin is what the state cookie stores about a login attempt: the state sent to the provider,
+// the PKCE verifier for the code exchange and the page to return to afterwards
+type oauthLogin struct {
+	Provider string    `json:"provider"`
+	State    string    `json:"state"`
+	Verifier string    `json:"verifier"`
+	Next     string    `json:"next"`
+	Expires  time.Time `json:"expires"`
+}
+
+// setOAuthStateCookie sets or, for a nil login, clears the state cookie
+func setOAuthStateCookie(w http.ResponseWriter, r *http.Request, login *oauthLogin) error {
+	cookie := &http.Cookie{
+		Name:     oauthStateCookie,
+		Path:     "/auth/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// The provider sends the browser back with a top-level GET, which Lax cookies are sent with
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	}
+	if login != nil {
+		value, err := json.Marshal(login)
+		if err != nil {
+			return err
+		}
+		cookie.Value = base64.RawURLEncoding.EncodeToString(value)
+		cookie.MaxAge = int(oauthStateTTL / time.Second)
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// beginOAuthLogin sends the browser to the provider's consent page. Every attempt gets its own
+// random state and PKCE verifier, kept in the state cookie, so a callback only logs in the browser
+// that started the login and a stolen code can't be exchanged without the verifier.
+func beginOAuthLogin(w http.ResponseWriter, r *http.Request, provider string, config *oauth2.Config) error {
+	state, err := generateUserToken()
+	if err != nil {
+		return err
+	}
+	login := &oauthLogin{
+		Provider: provider,
+		State:    state,
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     loginRedirectTarget(r),
+		Expires:  time.Now().Add(oauthStateTTL),
+	}
+	if err := setOAuthStateCookie(w, r, login); err != nil {
+		return err
+	}
+	http.Redirect(w, r, config.AuthCodeURL(state, oauth2.S256ChallengeOption(login.Verifier)), http.StatusTemporaryRedirect)
+	return nil
+}
+
+// finishOAuthLogin checks the state of a callback from provider against the state cookie, which
+// is cleared so that the attempt can't be replayed. It returns the login the callback completes.
+func finishOAuthLogin(w http.ResponseWriter, r *http.Request, provider string) (*oauthLogin, error) {
+	c, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return nil, errInvalidOAuthState
+	}
+	if err := setOAuthStateCookie(w, r, nil); err != nil {
+		return nil, err
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil, errInvalidOAuthState
+	}
+	var login oauthLogin
+	if err := json.Unmarshal(value, &login); err != nil {
+		return nil, errInvalidOAuthState
+	}
+
+	state := r.FormValue("state")
+	if login.Provider != provider || login.State == "" || time.Now().After(login.Expires) ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		return nil, errInvalidOAuthState
+	}
+	login.Next = safeRedirectTarget(login.Next)
+	return &login, nil
+}
+
+// exchangeOAuthCode trades the code of a callback for a token, proving with the PKCE verifier
+// that the login started here
+func exchangeOAuthCode(r *http.Request, config *oauth2.Config, login *oauthLogin) (*oauth2.Token, error) {
+	return config.Exchange(r.Context(), r.FormValue("code"), oauth2.VerifierOption(login.Verifier))
+}
+
+// loginPages are never returned to after logging in
+var loginPages = []string{"/login", "/register", "/logout", "/auth", "/forgot-password", "/reset-password"}
+
+// safeRedirectTarget returns next if it is a path on this site that makes sense to return to
+// after logging in, and the home page otherwise. Addresses of other sites are never followed.
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return "/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	for _, page := range loginPages {
+		if u.Path == page || strings.HasPrefix(u.Path, page+"/") {
+			return "/"
+		}
+	}
+	return u.RequestURI()
+}
+
+// loginRedirectTarget returns the page a login started by the request should end on: the next
+// query parameter, or else the page of this site that linked to the login page
+func loginRedirectTarget(r *http.Request) string {
+	if next := r.URL.Query().Get("next"); next != "" {
+		return safeRedirectTarget(next)
+	}
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host {
+		return "/"
+	}
+	return safeRedirectTarget(referer.RequestURI())
+}
@@ -0,0 +1,74 @@
+package RebootForums
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSafeRedirectTarget(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/post/12", "/post/12"},
+		{"/search?q=go&page=2", "/search?q=go&page=2"},
+		{"/post/12#comment-3", "/post/12"},
+		{"/settings", "/settings"},
+
+		// Other sites
+		{"https://evil.example/", "/"},
+		{"//evil.example/path", "/"},
+		{"/\\evil.example", "/"},
+		{"\\\\evil.example", "/"},
+		{"evil.example", "/"},
+		{"javascript:alert(1)", "/"},
+		{"/%0d%0aSet-Cookie:x=1", "/%0d%0aSet-Cookie:x=1"},
+		{"/post/1\r\nSet-Cookie: x=1", "/"},
+
+		// Login pages
+		{"/login", "/"},
+		{"/login?next=/post/1", "/"},
+		{"/logout", "/"},
+		{"/register", "/"},
+		{"/auth/google/callback?code=x", "/"},
+		{"/reset-password/abc", "/"},
+		{"/loginhelp", "/loginhelp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.next, func(t *testing.T) {
+			if got := safeRedirectTarget(tt.next); got != tt.want {
+				t.Errorf("safeRedirectTarget(%q) = %q, want %q", tt.next, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginRedirectTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		referer string
+		want    string
+	}{
+		{"next parameter", "/login?next=/post/3", "", "/post/3"},
+		{"next wins over referer", "/login?next=/post/3", "http://example.com/post/4", "/post/3"},
+		{"unsafe next", "/login?next=//evil.example", "http://example.com/post/4", "/"},
+		{"referer of this site", "/login", "http://example.com/post/4?sort=top", "/post/4?sort=top"},
+		{"referer of another site", "/login", "http://evil.example/post/4", "/"},
+		{"referer of a login page", "/login", "http://example.com/register", "/"},
+		{"neither", "/login", "", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com"+tt.url, nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if got := loginRedirectTarget(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package RebootForums
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -22,11 +23,15 @@ func CreatePostFormHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func displayCreatePostForm(w http.ResponseWriter, r *http.Request) {
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	if !user.CanPost() {
+		verifyEmailRequired(w, r, user)
+		return
+	}
 
 	categories, err := GetAllCategories()
 	if err != nil {
@@ -36,13 +41,17 @@ func displayCreatePostForm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Username   string
-		Categories []Category
-		LoggedIn   bool
+		Username    string
+		Categories  []Category
+		MaxImages   int
+		MaxImagesMB int64
+		LoggedIn    bool
 	}{
-		Username:   user.Username,
-		Categories: categories,
-		LoggedIn:   true,
+		Username:    user.Username,
+		Categories:  categories,
+		MaxImages:   MaxImagesPerPost,
+		MaxImagesMB: MaxPostImagesSize / (1024 * 1024),
+		LoggedIn:    true,
 	}
 
 	err = RenderTemplate(w, "create-post.html", data)
@@ -54,65 +63,76 @@ func displayCreatePostForm(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCreatePost(w http.ResponseWriter, r *http.Request) {
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		Error400Handler(w, r)
 		return
 	}
+	if !user.CanPost() {
+		verifyEmailRequired(w, r, user)
+		return
+	}
 
-	title := strings.TrimSpace(r.FormValue("title"))
-	content := strings.TrimSpace(r.FormValue("content"))
-	categoryIDs := r.Form["categories"]
-
-	if title == "" || content == "" {
+	title, content, categories, err := parsePostForm(r)
+	if err != nil {
 		Error400Handler(w, r)
 		return
 	}
 
-	if len(title) == 0 || len(title) > MaxTitleLength {
-		Error400Handler(w, r)
+	images, err := saveUploadedImages(r, user, nil)
+	if err != nil {
+		log.Printf("Error handling image upload: %v", err)
+		handleUploadError(w, r, err)
 		return
 	}
 
-	if len(content) == 0 || len(content) > MaxPostLength {
-		Error400Handler(w, r)
+	postID, err := createPost(user.ID, title, content, categories, images)
+	if err != nil {
+		log.Printf("Error creating post: %v", err)
+		releaseImages(images)
+		Error500Handler(w, r)
 		return
 	}
 
+	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+}
+
+// parsePostForm validates the title, content and categories submitted with a post form
+func parsePostForm(r *http.Request) (string, string, []int, error) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	content := strings.TrimSpace(r.FormValue("content"))
+	categoryIDs := r.Form["categories"]
+
+	if err := validatePost(title, content); err != nil {
+		return "", "", nil, err
+	}
+
 	categories := make([]int, 0, len(categoryIDs))
 	for _, id := range categoryIDs {
 		catID, err := strconv.Atoi(id)
 		if err != nil {
-			Error400Handler(w, r)
-			return
+			return "", "", nil, fmt.Errorf("invalid category ID: %s", id)
 		}
 		categories = append(categories, catID)
 	}
 
-	// Handle file upload
-	file, handler, err := r.FormFile("image")
-	var imageFilename string
-	if err == nil {
-		defer file.Close()
-		imageFilename, err = ImageHandler(file, handler)
-		if err != nil {
-			log.Printf("Error handling image upload: %v", err)
-			Error400Handler(w, r)
-			return
-		}
+	return title, content, categories, nil
+}
+
+// validatePost checks the title and content lengths of a post
+func validatePost(title, content string) error {
+	if len(title) == 0 || len(title) > MaxTitleLength {
+		return fmt.Errorf("title must be between 1 and %d characters", MaxTitleLength)
 	}
 
-	postID, err := createPost(user.ID, title, content, categories, imageFilename)
-	if err != nil {
-		log.Printf("Error creating post: %v", err)
-		Error500Handler(w, r)
-		return
+	if len(content) == 0 || len(content) > MaxPostLength {
+		return fmt.Errorf("content must be between 1 and %d characters", MaxPostLength)
 	}
 
-	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+	return nil
 }
 
-func createPost(userID int, title, content string, categories []int, imageFilename string) (int, error) {
+func createPost(userID int, title, content string, categories []int, images []PostImage) (int, error) {
 	tx, err := DB.Begin()
 	if err != nil {
 		return 0, err
@@ -120,9 +140,9 @@ func createPost(userID int, title, content string, categories []int, imageFilena
 	defer tx.Rollback()
 
 	result, err := tx.Exec(`
-        INSERT INTO posts (user_id, title, content, image_filename, created_at, updated_at)
-        VALUES (?, ?, ?, ?, ?, ?)
-    `, userID, title, content, imageFilename, time.Now(), time.Now())
+        INSERT INTO posts (user_id, title, content, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?)
+    `, userID, title, content, time.Now(), time.Now())
 	if err != nil {
 		return 0, err
 	}
@@ -139,6 +159,11 @@ func createPost(userID int, title, content string, categories []int, imageFilena
 		}
 	}
 
+	// A new post has no images to remove
+	if _, err := savePostImages(tx, int(postID), images); err != nil {
+		return 0, err
+	}
+
 	return int(postID), tx.Commit()
 }
 
@@ -159,6 +184,32 @@ func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user := CurrentUser(r)
+	loggedIn := user != nil
+	var username string
+	var isAuthor bool
+
+	if loggedIn {
+		username = user.Username
+		isAuthor = user.Username == post.Author
+	}
+
+	if !canViewPost(user, post) {
+		Error404Handler(w, r)
+		return
+	}
+
+	counted := false
+	auth, err := ensureGuestSession(w, r)
+	if err == nil {
+		counted, err = recordPostView(postID, auth.VisitorKey())
+	}
+	if err != nil {
+		log.Printf("Error recording post view: %v", err)
+	} else if counted {
+		post.ViewCount++
+	}
+
 	categories, err := getPostCategories(postID)
 	if err != nil {
 		log.Printf("Error fetching post categories: %v", err)
@@ -166,43 +217,61 @@ func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	comments, err := getCommentsByPostID(postID)
+	comments, err := getCommentTree(postID, user.IsModerator())
 	if err != nil {
 		log.Printf("Error fetching comments: %v", err)
 		comments = []Comment{}
 	}
 
-	user, err := GetUserFromSession(r)
-	loggedIn := err == nil && user != nil
-	var username string
-	var isAuthor bool
-
-	if loggedIn {
-		username = user.Username
-		isAuthor = user.Username == post.Author
-	}
-
-	imageURL := ""
-	if post.ImageFilename != "" {
-		imageURL = GetImageURL(post.ImageFilename)
+	// Moderators get a form to move the post to other categories
+	var allCategories []Category
+	selectedCategories := make(map[int]bool)
+	if user.IsModerator() {
+		allCategories, err = GetAllCategories()
+		if err != nil {
+			log.Printf("Error fetching categories: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		selectedIDs, err := getPostCategoryIDs(postID)
+		if err != nil {
+			log.Printf("Error fetching post categories: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		for _, id := range selectedIDs {
+			selectedCategories[id] = true
+		}
 	}
 
 	data := struct {
-		Post       Post
-		Categories []string
-		Comments   []Comment
-		IsAuthor   bool
-		LoggedIn   bool
-		Username   string
-		ImageURL   string
+		Post               Post
+		Categories         []string
+		Comments           []Comment
+		IsAuthor           bool
+		IsModerator        bool
+		CanComment         bool
+		NeedsVerification  bool
+		AllCategories      []Category
+		SelectedCategories map[int]bool
+		LoggedIn           bool
+		Username           string
+		ReportReasons      []ReportReason
+		Reported           bool
 	}{
-		Post:       post,
-		Categories: categories,
-		Comments:   comments,
-		IsAuthor:   isAuthor,
-		LoggedIn:   loggedIn,
-		Username:   username,
-		ImageURL:   imageURL,
+		Post:               post,
+		Categories:         categories,
+		Comments:           comments,
+		IsAuthor:           isAuthor,
+		IsModerator:        user.IsModerator(),
+		CanComment:         user.CanPost() && (!post.IsLocked || user.IsModerator()),
+		NeedsVerification:  loggedIn && !user.CanPost(),
+		AllCategories:      allCategories,
+		SelectedCategories: selectedCategories,
+		LoggedIn:           loggedIn,
+		Username:           username,
+		ReportReasons:      ReportReasons,
+		Reported:           r.URL.Query().Get("reported") == "1",
 	}
 
 	err = RenderTemplate(w, "view-post.html", data)
@@ -216,11 +285,13 @@ func ViewPostHandler(w http.ResponseWriter, r *http.Request) {
 func getPost(postID int) (Post, error) {
 	var post Post
 	var likes, dislikes sql.NullInt64
-	var imageFilename sql.NullString
+	var updatedAt sql.NullTime
 
 	err := DB.QueryRow(`
-        SELECT p.id, p.title, p.content, u.username, p.created_at, p.image_filename,
-               COALESCE(l.likes, 0) as likes, COALESCE(l.dislikes, 0) as dislikes
+        SELECT p.id, p.title, p.content, u.username, p.created_at, p.updated_at,
+               p.is_hidden, p.is_locked, p.view_count,
+               COALESCE(l.likes, 0) as likes, COALESCE(l.dislikes, 0) as dislikes,
+               (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.is_deleted = 0) as comment_count
         FROM posts p
         JOIN users u ON p.user_id = u.id
         LEFT JOIN (
@@ -233,15 +304,27 @@ func getPost(postID int) (Post, error) {
         ) l ON p.id = l.post_id
         WHERE p.id = ?
     `, postID, postID).Scan(
-		&post.ID, &post.Title, &post.Content, &post.Author, &post.CreatedAt, &imageFilename,
-		&likes, &dislikes,
+		&post.ID, &post.Title, &post.Content, &post.Author, &post.CreatedAt, &updatedAt,
+		&post.IsHidden, &post.IsLocked, &post.ViewCount,
+		&likes, &dislikes, &post.CommentCount,
 	)
 	if err != nil {
 		return post, err
 	}
 
-	if imageFilename.Valid {
-		post.ImageFilename = imageFilename.String
+	post.Images, err = getPostImages(postID)
+	if err != nil {
+		return post, err
+	}
+	post.ImageCount = len(post.Images)
+	if post.ImageCount > 0 {
+		post.CoverImage = post.Images[0].Filename
+		post.CoverAnimated = post.Images[0].Animated
+	}
+
+	post.UpdatedAt = post.CreatedAt
+	if updatedAt.Valid {
+		post.UpdatedAt = updatedAt.Time
 	}
 
 	post.Likes = int(likes.Int64)
@@ -279,8 +362,8 @@ func LikePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		Error400Handler(w, r)
 		return
 	}
@@ -297,6 +380,16 @@ func LikePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkLikeTarget(user, postID, true)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error checking like target: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
 	err = UpsertLike(user.ID, postID, isLike, true)
 	if err != nil {
 		log.Printf("Error upserting like: %v", err)
@@ -324,8 +417,8 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		Error400Handler(w, r)
 		return
 	}
@@ -342,6 +435,16 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkLikeTarget(user, commentID, false)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error checking comment like target: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
 	err = UpsertLike(user.ID, commentID, isLike, false)
 	if err != nil {
 		log.Printf("Error upserting comment like: %v", err)
@@ -363,7 +466,139 @@ func LikeCommentHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func updatePost(postID int, title, content string, categories []int) error {
+func EditPostHandler(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.URL.Path[len("/edit-post/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	post, err := getPost(postID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching post: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	if post.Author != user.Username {
+		Error403Handler(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		displayEditPostForm(w, r, user, post)
+	case http.MethodPost:
+		handleEditPost(w, r, user, post)
+	default:
+		Error404Handler(w, r)
+	}
+}
+
+func displayEditPostForm(w http.ResponseWriter, r *http.Request, user *User, post Post) {
+	categories, err := GetAllCategories()
+	if err != nil {
+		log.Printf("Error fetching categories: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	selectedIDs, err := getPostCategoryIDs(post.ID)
+	if err != nil {
+		log.Printf("Error fetching post categories: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	selected := make(map[int]bool, len(selectedIDs))
+	for _, id := range selectedIDs {
+		selected[id] = true
+	}
+
+	data := struct {
+		Username           string
+		Post               Post
+		Categories         []Category
+		SelectedCategories map[int]bool
+		MaxImages          int
+		LoggedIn           bool
+	}{
+		Username:           user.Username,
+		Post:               post,
+		Categories:         categories,
+		SelectedCategories: selected,
+		MaxImages:          MaxImagesPerPost,
+		LoggedIn:           true,
+	}
+
+	err = RenderTemplate(w, "edit-post.html", data)
+	if err != nil {
+		log.Printf("Error rendering edit-post template: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+}
+
+func handleEditPost(w http.ResponseWriter, r *http.Request, user *User, post Post) {
+	title, content, categories, err := parsePostForm(r)
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	kept, err := parseImageEdits(r, post.Images)
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	// Newly uploaded images are added after the ones the post keeps
+	added, err := saveUploadedImages(r, user, kept)
+	if err != nil {
+		log.Printf("Error handling image upload: %v", err)
+		handleUploadError(w, r, err)
+		return
+	}
+
+	err = updatePost(post.ID, title, content, categories, append(kept, added...))
+	if err != nil {
+		log.Printf("Error updating post: %v", err)
+		releaseImages(added)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
+
+func getPostCategoryIDs(postID int) ([]int, error) {
+	rows, err := DB.Query("SELECT category_id FROM post_categories WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func updatePost(postID int, title, content string, categories []int, images []PostImage) error {
 	tx, err := DB.Begin()
 	if err != nil {
 		return err
@@ -376,7 +611,26 @@ func updatePost(postID int, title, content string, categories []int) error {
 		return err
 	}
 
-	_, err = tx.Exec("DELETE FROM post_categories WHERE post_id = ?", postID)
+	err = setPostCategories(tx, postID, categories)
+	if err != nil {
+		return err
+	}
+
+	unreferenced, err := savePostImages(tx, postID, images)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteUnreferencedImages(unreferenced)
+	return nil
+}
+
+// setPostCategories replaces the categories of a post
+func setPostCategories(tx *sql.Tx, postID int, categories []int) error {
+	_, err := tx.Exec("DELETE FROM post_categories WHERE post_id = ?", postID)
 	if err != nil {
 		return err
 	}
@@ -387,8 +641,7 @@ func updatePost(postID int, title, content string, categories []int) error {
 			return err
 		}
 	}
-
-	return tx.Commit()
+	return nil
 }
 
 func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
@@ -397,8 +650,8 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromSession(r)
-	if err != nil {
+	user := CurrentUser(r)
+	if user == nil {
 		Error400Handler(w, r)
 		return
 	}
@@ -418,11 +671,15 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if authorID != user.ID {
-		Error500Handler(w, r)
-		return
+		if !user.IsModerator() {
+			Error403Handler(w, r)
+			return
+		}
+		// Moderators deleting someone else's post go through the audited path
+		err = moderatePost(user, postID, "delete", nil, "")
+	} else {
+		err = deletePost(postID, nil)
 	}
-
-	err = deletePost(postID)
 	if err != nil {
 		log.Printf("Error deleting post: %v", err)
 		Error500Handler(w, r)
@@ -432,7 +689,35 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func deletePost(postID int) error {
+// recordPostView counts a view of a post by a visitor, as returned by RequestAuth.VisitorKey.
+// Each visitor counts once per post; it reports whether this view was counted.
+func recordPostView(postID int, visitor string) (bool, error) {
+	if visitor == "" {
+		return false, nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT OR IGNORE INTO post_views (post_id, visitor, viewed_at) VALUES (?, ?, ?)",
+		postID, visitor, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE posts SET view_count = view_count + 1 WHERE id = ?", postID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deletePost removes a post with its categories, likes, comments and views. When action is not nil
+// it is recorded in the moderation log in the same transaction.
+func deletePost(postID int, action *ModerationAction) error {
 	tx, err := DB.Begin()
 	if err != nil {
 		return err
@@ -449,14 +734,23 @@ func deletePost(postID int) error {
 		return err
 	}
 
+	_, err = tx.Exec("DELETE FROM likes WHERE comment_id IN (SELECT id FROM comments WHERE post_id = ?)", postID)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec("DELETE FROM comments WHERE post_id = ?", postID)
 	if err != nil {
 		return err
 	}
 
-	var imageFilename string
-	err = tx.QueryRow("SELECT image_filename FROM posts WHERE id = ?", postID).Scan(&imageFilename)
-	if err != nil && err != sql.ErrNoRows {
+	_, err = tx.Exec("DELETE FROM post_views WHERE post_id = ?", postID)
+	if err != nil {
+		return err
+	}
+
+	unreferenced, err := savePostImages(tx, postID, nil)
+	if err != nil {
 		return err
 	}
 
@@ -465,13 +759,21 @@ func deletePost(postID int) error {
 		return err
 	}
 
-	if imageFilename != "" {
-		err = DeleteImage(imageFilename)
-		if err != nil {
-			log.Printf("Error deleting image file: %v", err)
-			// Continue with the deletion process even if image deletion fails
+	var moderatorID int
+	if action != nil {
+		moderatorID = action.ModeratorID
+		if err := logModerationAction(tx, *action); err != nil {
+			return err
 		}
 	}
+	if err := closeReportsForPost(tx, moderatorID, postID); err != nil {
+		return err
+	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Image files are only deleted once the post is gone for good
+	deleteUnreferencedImages(unreferenced)
+	return nil
 }
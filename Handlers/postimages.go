@@ -0,0 +1,190 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MaxImageCaptionLength = 200
+
+// getPostImages returns a post's images in gallery order
+func getPostImages(postID int) ([]PostImage, error) {
+	rows, err := DB.Query(`
+        SELECT p.id, p.post_id, p.filename, p.position, p.caption, p.size, COALESCE(i.animated, 0)
+        FROM post_images p
+        LEFT JOIN images i ON i.filename = p.filename
+        WHERE p.post_id = ?
+        ORDER BY p.position, p.id
+    `, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []PostImage
+	for rows.Next() {
+		var img PostImage
+		if err := rows.Scan(&img.ID, &img.PostID, &img.Filename, &img.Position, &img.Caption, &img.Size, &img.Animated); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// validateImageCaption trims a caption and checks its length
+func validateImageCaption(caption string) (string, error) {
+	caption = strings.TrimSpace(caption)
+	if len(caption) > MaxImageCaptionLength {
+		return "", fmt.Errorf("image captions cannot be longer than %d characters", MaxImageCaptionLength)
+	}
+	return caption, nil
+}
+
+// saveUploadedImages stores the files of the "images" form field, captioned by the "captions"
+// field at the same index. The images a post keeps count towards the per-post limits, and the
+// new files count towards the user's upload rate limit and daily quota.
+// When an upload fails, the images already uploaded for this request are released again.
+func saveUploadedImages(r *http.Request, user *User, kept []PostImage) ([]PostImage, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		return nil, nil
+	}
+	captions := r.MultipartForm.Value["captions"]
+
+	if len(kept)+len(files) > MaxImagesPerPost {
+		return nil, fmt.Errorf("a post can have at most %d images", MaxImagesPerPost)
+	}
+	var keptSize, uploadSize int64
+	for _, img := range kept {
+		keptSize += img.Size
+	}
+	for _, fh := range files {
+		uploadSize += fh.Size
+	}
+	if keptSize+uploadSize > MaxPostImagesSize {
+		return nil, fmt.Errorf("a post's images cannot be larger than %d MB in total", MaxPostImagesSize/(1024*1024))
+	}
+
+	validCaptions := make([]string, len(files))
+	for i := range files {
+		if i < len(captions) {
+			var err error
+			if validCaptions[i], err = validateImageCaption(captions[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := checkUploadLimits(r, user, files); err != nil {
+		return nil, err
+	}
+
+	var saved []PostImage
+	for i, fh := range files {
+		filename, err := storeUpload(user, fh)
+		if err != nil {
+			releaseImages(saved)
+			return nil, err
+		}
+		saved = append(saved, PostImage{Filename: filename, Caption: validCaptions[i], Size: fh.Size})
+	}
+	return saved, nil
+}
+
+// parseImageEdits applies the edit form's captions, order and removals to a post's current images.
+// It returns the images to keep in their new order.
+func parseImageEdits(r *http.Request, images []PostImage) ([]PostImage, error) {
+	remove := make(map[string]bool)
+	for _, id := range r.Form["remove_image"] {
+		remove[id] = true
+	}
+
+	var kept []PostImage
+	for _, img := range images {
+		id := strconv.Itoa(img.ID)
+		if remove[id] {
+			continue
+		}
+		var err error
+		if img.Caption, err = validateImageCaption(r.FormValue("caption_" + id)); err != nil {
+			return nil, err
+		}
+		if position, err := strconv.Atoi(r.FormValue("position_" + id)); err == nil {
+			img.Position = position
+		}
+		kept = append(kept, img)
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].Position < kept[j].Position
+	})
+	return kept, nil
+}
+
+// savePostImages stores a post's gallery in slice order. Images with an ID are updated, new
+// images are inserted with the reference their upload took, and images of the post missing
+// from the slice are removed and their references released. It returns the images left
+// without references, whose files are deleted once tx has committed.
+func savePostImages(tx *sql.Tx, postID int, images []PostImage) ([]string, error) {
+	rows, err := tx.Query("SELECT id, filename FROM post_images WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		current[id] = filename
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keep := make(map[int]bool, len(images))
+	for _, img := range images {
+		keep[img.ID] = true
+	}
+	var removed []string
+	for id, filename := range current {
+		if !keep[id] {
+			if _, err := tx.Exec("DELETE FROM post_images WHERE id = ?", id); err != nil {
+				return nil, err
+			}
+			removed = append(removed, filename)
+		}
+	}
+
+	for i, img := range images {
+		if img.ID != 0 {
+			_, err = tx.Exec("UPDATE post_images SET position = ?, caption = ? WHERE id = ? AND post_id = ?",
+				i, img.Caption, img.ID, postID)
+		} else {
+			_, err = tx.Exec(`
+                INSERT INTO post_images (post_id, filename, position, caption, size, created_at)
+                VALUES (?, ?, ?, ?, ?, ?)
+            `, postID, img.Filename, i, img.Caption, img.Size, time.Now())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return releaseImageRefs(tx, removed)
+}
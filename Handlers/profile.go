@@ -0,0 +1,212 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const MaxBioLength = 500
+
+// profileURL returns the address of a user's profile page
+func profileURL(username string) string {
+	return "/user/" + url.PathEscape(username)
+}
+
+// getProfile loads the public profile of a user; deleted accounts have none. Hidden posts and hidden or deleted
+// comments are left out of the counts, since visitors can't see them either.
+func getProfile(username string) (*Profile, error) {
+	var p Profile
+	var joinedAt sql.NullTime
+	err := DB.QueryRow(`
+        SELECT u.id, u.username, u.role, u.bio, COALESCE(u.avatar, ''), u.created_at,
+               (SELECT COUNT(*) FROM posts WHERE user_id = u.id AND is_hidden = 0),
+               (SELECT COUNT(*) FROM comments WHERE user_id = u.id AND is_deleted = 0 AND is_hidden = 0),
+               (SELECT COUNT(*) FROM likes l
+                WHERE l.is_like = 1
+                  AND (l.post_id IN (SELECT id FROM posts WHERE user_id = u.id)
+                       OR l.comment_id IN (SELECT id FROM comments WHERE user_id = u.id)))
+        FROM users u
+        WHERE u.username = ? AND u.deleted_at IS NULL
+    `, username).Scan(&p.ID, &p.Username, &p.Role, &p.Bio, &p.Avatar, &joinedAt,
+		&p.PostCount, &p.CommentCount, &p.LikesReceived)
+	if err != nil {
+		return nil, err
+	}
+	if joinedAt.Valid {
+		p.JoinedAt = joinedAt.Time
+	}
+	return &p, nil
+}
+
+// validateBio trims a bio and checks its length
+func validateBio(bio string) (string, error) {
+	bio = strings.TrimSpace(bio)
+	if len(bio) > MaxBioLength {
+		return "", fmt.Errorf("bios cannot be longer than %d characters", MaxBioLength)
+	}
+	return bio, nil
+}
+
+// updateProfile saves a user's bio. A non-empty avatar replaces the current avatar, taking over
+// the reference its upload holds; removeAvatar removes the current avatar without a new one.
+func updateProfile(userID int, bio, avatar string, removeAvatar bool) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	if err := tx.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&current); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET bio = ? WHERE id = ?", bio, userID); err != nil {
+		return err
+	}
+
+	var unreferenced []string
+	if avatar != "" || removeAvatar {
+		newAvatar := sql.NullString{String: avatar, Valid: avatar != ""}
+		if _, err := tx.Exec("UPDATE users SET avatar = ? WHERE id = ?", newAvatar, userID); err != nil {
+			return err
+		}
+		if current.Valid && current.String != "" {
+			if unreferenced, err = releaseImageRefs(tx, []string{current.String}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteUnreferencedImages(unreferenced)
+	return nil
+}
+
+// ProfileHandler shows a user's profile with their recent posts (/user/{username})
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		Error404Handler(w, r)
+		return
+	}
+
+	profile, err := getProfile(r.URL.Path[len("/user/"):])
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error fetching profile: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	opts := ParseFeedOptions(r)
+	page, err := GetPostsByUser(profile.ID, opts)
+	if err != nil {
+		if opts.After != "" || opts.Before != "" {
+			// Most likely a malformed or stale cursor
+			Error400Handler(w, r)
+			return
+		}
+		log.Printf("Error fetching posts of %s: %v", profile.Username, err)
+		Error500Handler(w, r)
+		return
+	}
+
+	var nextURL, prevURL string
+	if page.NextCursor != "" {
+		nextURL = profileURL(profile.Username) + "?after=" + url.QueryEscape(page.NextCursor)
+	}
+	if page.PrevCursor != "" {
+		prevURL = profileURL(profile.Username) + "?before=" + url.QueryEscape(page.PrevCursor)
+	}
+
+	user := CurrentUser(r)
+	data := struct {
+		Profile      *Profile
+		Posts        []Post
+		NextURL      string
+		PrevURL      string
+		LoggedIn     bool
+		Username     string
+		IsModerator  bool
+		IsOwnProfile bool
+		MaxBioLength int
+		Updated      bool
+	}{
+		Profile:      profile,
+		Posts:        page.Posts,
+		NextURL:      nextURL,
+		PrevURL:      prevURL,
+		LoggedIn:     user != nil,
+		IsModerator:  user.IsModerator(),
+		IsOwnProfile: user != nil && user.ID == profile.ID,
+		MaxBioLength: MaxBioLength,
+		Updated:      r.URL.Query().Get("updated") == "1",
+	}
+	if user != nil {
+		data.Username = user.Username
+	}
+
+	err = RenderTemplate(w, "profile.html", data)
+	if err != nil {
+		log.Printf("Error rendering profile template: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// EditProfileHandler saves the bio and avatar submitted from the user's own profile page (/profile)
+func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseMultipartForm(MaxImageSize + 1<<20); err != nil && err != http.ErrNotMultipart {
+		Error400Handler(w, r)
+		return
+	}
+
+	bio, err := validateBio(r.FormValue("bio"))
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	// Avatars go through the same image pipeline, limits and quotas as post images
+	var avatar string
+	if r.MultipartForm != nil && len(r.MultipartForm.File["avatar"]) > 0 {
+		files := r.MultipartForm.File["avatar"][:1]
+		if err := checkUploadLimits(r, user, files); err != nil {
+			handleUploadError(w, r, err)
+			return
+		}
+		if avatar, err = storeUpload(user, files[0]); err != nil {
+			log.Printf("Error handling avatar upload: %v", err)
+			handleUploadError(w, r, err)
+			return
+		}
+	}
+
+	err = updateProfile(user.ID, bio, avatar, r.FormValue("remove_avatar") == "1")
+	if err != nil {
+		log.Printf("Error updating profile: %v", err)
+		releaseImageFiles(avatar)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, profileURL(user.Username)+"?updated=1", http.StatusSeeOther)
+}
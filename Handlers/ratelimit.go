@@ -0,0 +1,97 @@
+package RebootForums
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per key, such as an IP address or a user. Every key starts
+// with burst tokens and gains perMinute tokens a minute, up to burst.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes n tokens from the bucket of every key. When one of them has too few tokens,
+// none are taken and allow returns how long until there will be enough. Requests for more
+// than burst tokens can never be allowed and are refused with a zero wait.
+// A limiter with a zero rate allows everything.
+func (l *rateLimiter) allow(n int, keys ...string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	need := float64(n)
+	if need > l.burst {
+		return false, 0
+	}
+
+	now := time.Now()
+	l.prune(now)
+
+	var wait time.Duration
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: l.burst, updated: now}
+			l.buckets[key] = b
+		}
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+		if b.tokens < need {
+			wait = max(wait, time.Duration((need-b.tokens)/l.rate*float64(time.Second)))
+		}
+		buckets[i] = b
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens -= need
+	}
+	return true, 0
+}
+
+// prune forgets buckets that have refilled completely, which behave like new ones
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < 10*time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the IP address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,103 @@
+package RebootForums
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	type call struct {
+		n        int
+		keys     []string
+		want     bool
+		wantWait time.Duration // checked to the second; 0 when the call is allowed or can never be
+	}
+	tests := []struct {
+		name             string
+		perMinute, burst int
+		calls            []call
+	}{
+		{
+			name:      "burst then wait",
+			perMinute: 1, burst: 3,
+			calls: []call{
+				{1, []string{"a"}, true, 0},
+				{2, []string{"a"}, true, 0},
+				{1, []string{"a"}, false, time.Minute},
+				{2, []string{"a"}, false, 2 * time.Minute},
+			},
+		},
+		{
+			name:      "keys are separate",
+			perMinute: 1, burst: 2,
+			calls: []call{
+				{2, []string{"a"}, true, 0},
+				{2, []string{"b"}, true, 0},
+				{1, []string{"a"}, false, time.Minute},
+			},
+		},
+		{
+			name:      "every key must have enough",
+			perMinute: 1, burst: 2,
+			calls: []call{
+				{2, []string{"ip"}, true, 0},
+				{1, []string{"ip", "user"}, false, time.Minute},
+				// Refused calls take nothing from the keys that had enough
+				{2, []string{"user"}, true, 0},
+			},
+		},
+		{
+			name:      "more than the burst is never allowed",
+			perMinute: 1, burst: 3,
+			calls: []call{
+				{4, []string{"a"}, false, 0},
+				{100, []string{"a"}, false, 0},
+				// and takes nothing either
+				{3, []string{"a"}, true, 0},
+			},
+		},
+		{
+			name:      "zero rate allows everything",
+			perMinute: 0, burst: 1,
+			calls: []call{
+				{5, []string{"a"}, true, 0},
+				{5, []string{"a"}, true, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.perMinute, tt.burst)
+			for i, c := range tt.calls {
+				ok, wait := l.allow(c.n, c.keys...)
+				if ok != c.want {
+					t.Fatalf("call %d: allow(%d, %q) = %v, want %v", i, c.n, c.keys, ok, c.want)
+				}
+				if wait < c.wantWait-time.Second || wait > c.wantWait {
+					t.Errorf("call %d: waits %v, want %v", i, wait, c.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(60, 2)
+	if ok, _ := l.allow(2, "a"); !ok {
+		t.Fatal("a full bucket refused its burst")
+	}
+	// Pretend the tokens were taken two seconds ago
+	l.buckets["a"].updated = l.buckets["a"].updated.Add(-2 * time.Second)
+	if ok, wait := l.allow(2, "a"); !ok {
+		t.Errorf("a bucket didn't refill at a token a second, wait %v", wait)
+	}
+	if ok, _ := l.allow(1, "a"); ok {
+		t.Error("a bucket refilled beyond the elapsed time")
+	}
+
+	// Buckets never fill beyond the burst
+	l.buckets["a"].updated = l.buckets["a"].updated.Add(-time.Hour)
+	if ok, _ := l.allow(3, "a"); ok {
+		t.Error("a bucket filled beyond its burst")
+	}
+}
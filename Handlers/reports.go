@@ -0,0 +1,461 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report reason categories
+const (
+	ReportSpam          = "spam"
+	ReportAbuse         = "abuse"
+	ReportInappropriate = "inappropriate"
+	ReportOther         = "other"
+)
+
+// ReportReason is a reason category offered on the report form
+type ReportReason struct {
+	Value string
+	Label string
+}
+
+// ReportReasons lists the reason categories in display order
+var ReportReasons = []ReportReason{
+	{ReportSpam, "Spam or advertising"},
+	{ReportAbuse, "Harassment or hate speech"},
+	{ReportInappropriate, "Inappropriate content or image"},
+	{ReportOther, "Something else"},
+}
+
+// Report statuses; every status except open is a moderator's resolution
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportRemoved   = "removed"
+	ReportWarned    = "warned"
+)
+
+const MaxReportDetailsLength = 500
+
+// errDuplicateReport is returned when a user reports the same content twice
+var errDuplicateReport = errors.New("You have already reported this")
+
+// contentTable returns the table holding a report target
+func contentTable(targetType string) string {
+	if targetType == TargetPost {
+		return "posts"
+	}
+	return "comments"
+}
+
+// validateReport checks the reason category and trims the free text of a report
+func validateReport(reason, details string) (string, error) {
+	valid := false
+	for _, r := range ReportReasons {
+		if r.Value == reason {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", moderationInputError("Please choose a reason for your report")
+	}
+	details = strings.TrimSpace(details)
+	if len(details) > MaxReportDetailsLength {
+		return "", moderationInputError(fmt.Sprintf("Report details cannot be longer than %d characters", MaxReportDetailsLength))
+	}
+	return details, nil
+}
+
+// reportTarget returns the post a report target belongs to and the ID of its author
+func reportTarget(targetType string, targetID int) (postID, authorID int, err error) {
+	if targetType == TargetComment {
+		return getCommentOwner(targetID)
+	}
+	err = DB.QueryRow("SELECT id, user_id FROM posts WHERE id = ?", targetID).Scan(&postID, &authorID)
+	return
+}
+
+// CreateReport records a user's report of a post or comment and hides the content once it
+// has ReportHideThreshold open reports. It returns the post the content belongs to.
+func CreateReport(reporter *User, targetType string, targetID int, reason, details string) (int, error) {
+	details, err := validateReport(reason, details)
+	if err != nil {
+		return 0, err
+	}
+
+	postID, authorID, err := reportTarget(targetType, targetID)
+	if err != nil {
+		return 0, err
+	}
+	if authorID == reporter.ID {
+		return postID, moderationInputError("You cannot report your own content")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var duplicate bool
+	err = tx.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM reports WHERE reporter_id = ? AND target_type = ? AND target_id = ?)
+    `, reporter.ID, targetType, targetID).Scan(&duplicate)
+	if err != nil {
+		return 0, err
+	}
+	if duplicate {
+		return postID, errDuplicateReport
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO reports (reporter_id, target_type, target_id, post_id, reason, details, status, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, reporter.ID, targetType, targetID, postID, reason, details, ReportOpen, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if ReportHideThreshold > 0 {
+		if err := hideIfOverThreshold(tx, targetType, targetID, postID); err != nil {
+			return 0, err
+		}
+	}
+
+	return postID, tx.Commit()
+}
+
+// hideIfOverThreshold hides content with at least ReportHideThreshold open reports until
+// a moderator reviews them
+func hideIfOverThreshold(tx *sql.Tx, targetType string, targetID, postID int) error {
+	var open int
+	err := tx.QueryRow(`
+        SELECT COUNT(*) FROM reports WHERE target_type = ? AND target_id = ? AND status = ?
+    `, targetType, targetID, ReportOpen).Scan(&open)
+	if err != nil || open < ReportHideThreshold {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE "+contentTable(targetType)+" SET is_hidden = 1, auto_hidden = 1 WHERE id = ? AND is_hidden = 0", targetID)
+	if err != nil {
+		return err
+	}
+	if hidden, err := result.RowsAffected(); err != nil || hidden == 0 {
+		return err
+	}
+
+	action := ModAutoHidePost
+	if targetType == TargetComment {
+		action = ModAutoHideComment
+	}
+	return logModerationAction(tx, ModerationAction{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		PostID:     postID,
+		Details:    fmt.Sprintf("Hidden pending review after %d reports", open),
+	})
+}
+
+// closeReports resolves the open reports about one post or comment and returns how many were closed.
+// A zero moderatorID records reports closed because the author removed the content.
+func closeReports(tx *sql.Tx, status string, moderatorID int, targetType string, targetID int) (int64, error) {
+	var resolvedBy sql.NullInt64
+	if moderatorID != 0 {
+		resolvedBy = sql.NullInt64{Int64: int64(moderatorID), Valid: true}
+	}
+	result, err := tx.Exec(`
+        UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ?
+        WHERE status = ? AND target_type = ? AND target_id = ?
+    `, status, resolvedBy, time.Now(), ReportOpen, targetType, targetID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// closeReportsForPost resolves the open reports about a post and all of its comments as removed
+func closeReportsForPost(tx *sql.Tx, moderatorID, postID int) error {
+	var resolvedBy sql.NullInt64
+	if moderatorID != 0 {
+		resolvedBy = sql.NullInt64{Int64: int64(moderatorID), Valid: true}
+	}
+	_, err := tx.Exec(`
+        UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ?
+        WHERE status = ? AND post_id = ?
+    `, ReportRemoved, resolvedBy, time.Now(), ReportOpen, postID)
+	return err
+}
+
+// resolveReports resolves every open report about the content of the given report.
+// Removing deletes the content; dismissing and warning show content again that only the
+// report threshold had hidden, and warning also records a warning for the author.
+// It returns the post the content belonged to.
+func resolveReports(moderator *User, reportID int, resolution, note string) (int, error) {
+	var targetType, status string
+	var targetID, postID int
+	err := DB.QueryRow("SELECT target_type, target_id, post_id, status FROM reports WHERE id = ?", reportID).
+		Scan(&targetType, &targetID, &postID, &status)
+	if err != nil {
+		return 0, err
+	}
+	if status != ReportOpen {
+		return postID, moderationInputError("This report has already been resolved")
+	}
+
+	switch resolution {
+	case ReportRemoved:
+		if targetType == TargetPost {
+			return postID, moderatePost(moderator, targetID, "delete", nil, note)
+		}
+		_, err = moderateComment(moderator, targetID, "delete", note)
+		return postID, err
+	case ReportDismissed, ReportWarned:
+	default:
+		return postID, moderationInputError("Unknown resolution")
+	}
+
+	_, authorID, err := reportTarget(targetType, targetID)
+	if err != nil {
+		return postID, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return postID, err
+	}
+	defer tx.Rollback()
+
+	closed, err := closeReports(tx, resolution, moderator.ID, targetType, targetID)
+	if err != nil {
+		return postID, err
+	}
+
+	_, err = tx.Exec("UPDATE "+contentTable(targetType)+" SET is_hidden = 0, auto_hidden = 0 WHERE id = ? AND auto_hidden = 1", targetID)
+	if err != nil {
+		return postID, err
+	}
+
+	verb := "Dismissed"
+	if resolution == ReportWarned {
+		verb = "Warned the author over"
+		_, err = tx.Exec("INSERT INTO user_warnings (user_id, moderator_id, reason, created_at) VALUES (?, ?, ?, ?)",
+			authorID, moderator.ID, note, time.Now())
+		if err != nil {
+			return postID, err
+		}
+		err = logModerationAction(tx, ModerationAction{
+			ModeratorID: moderator.ID,
+			Action:      ModWarnUser,
+			TargetType:  TargetUser,
+			TargetID:    authorID,
+			PostID:      postID,
+			Details:     moderationDetails("", note),
+		})
+		if err != nil {
+			return postID, err
+		}
+	}
+
+	err = logModerationAction(tx, ModerationAction{
+		ModeratorID: moderator.ID,
+		Action:      ModResolveReports,
+		TargetType:  targetType,
+		TargetID:    targetID,
+		PostID:      postID,
+		Details:     moderationDetails(fmt.Sprintf("%s %d report(s)", verb, closed), note),
+	})
+	if err != nil {
+		return postID, err
+	}
+	return postID, tx.Commit()
+}
+
+// GetReportQueue returns the content with open reports, most recently reported first
+func GetReportQueue() ([]ReportedContent, error) {
+	rows, err := DB.Query(`
+        SELECT r.id, r.reporter_id, u.username, r.target_type, r.target_id, r.post_id,
+               r.reason, r.details, r.status, r.created_at
+        FROM reports r
+        JOIN users u ON u.id = r.reporter_id
+        WHERE r.status = ?
+        ORDER BY r.id DESC
+    `, ReportOpen)
+	if err != nil {
+		return nil, err
+	}
+
+	var queue []ReportedContent
+	index := make(map[string]int)
+	for rows.Next() {
+		var r Report
+		err := rows.Scan(&r.ID, &r.ReporterID, &r.Reporter, &r.TargetType, &r.TargetID, &r.PostID,
+			&r.Reason, &r.Details, &r.Status, &r.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		key := r.TargetType + ":" + strconv.Itoa(r.TargetID)
+		i, ok := index[key]
+		if !ok {
+			i = len(queue)
+			index[key] = i
+			queue = append(queue, ReportedContent{
+				TargetType:   r.TargetType,
+				TargetID:     r.TargetID,
+				PostID:       r.PostID,
+				LastReported: r.CreatedAt,
+			})
+		}
+		queue[i].Reports = append(queue[i].Reports, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range queue {
+		if err := loadReportedContent(&queue[i]); err != nil {
+			return nil, err
+		}
+	}
+	return queue, nil
+}
+
+// loadReportedContent fills in what the review queue shows about a report target
+func loadReportedContent(item *ReportedContent) error {
+	var err error
+	if item.TargetType == TargetPost {
+		err = DB.QueryRow(`
+            SELECT p.title, substr(p.content, 1, 200), u.id, u.username, p.is_hidden, p.auto_hidden
+            FROM posts p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.id = ?
+        `, item.TargetID).Scan(&item.PostTitle, &item.Excerpt, &item.AuthorID, &item.Author, &item.IsHidden, &item.AutoHidden)
+	} else {
+		err = DB.QueryRow(`
+            SELECT p.title, substr(c.content, 1, 200), u.id, u.username, c.is_hidden, c.auto_hidden
+            FROM comments c
+            JOIN posts p ON p.id = c.post_id
+            JOIN users u ON u.id = c.user_id
+            WHERE c.id = ?
+        `, item.TargetID).Scan(&item.PostTitle, &item.Excerpt, &item.AuthorID, &item.Author, &item.IsHidden, &item.AutoHidden)
+	}
+	if err == sql.ErrNoRows {
+		item.Excerpt = "[deleted]"
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return DB.QueryRow("SELECT COUNT(*) FROM user_warnings WHERE user_id = ?", item.AuthorID).Scan(&item.Warnings)
+}
+
+// handleReport records a report submitted from the post page
+func handleReport(w http.ResponseWriter, r *http.Request, targetType string, prefix string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to report content", http.StatusUnauthorized)
+		return
+	}
+
+	targetID, err := strconv.Atoi(r.URL.Path[len(prefix):])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	postID, err := CreateReport(user, targetType, targetID, r.FormValue("reason"), r.FormValue("details"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err == errDuplicateReport {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if isModerationInputError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error creating report: %v", err)
+		http.Error(w, "Error submitting report", http.StatusInternalServerError)
+		return
+	}
+
+	// The report may have hidden the post from the reporter
+	if post, err := getPost(postID); err != nil || !canViewPost(user, post) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	target := fmt.Sprintf("/post/%d?reported=1", postID)
+	if targetType == TargetComment {
+		target += fmt.Sprintf("#comment-%d", targetID)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// ReportPostHandler lets a logged-in user report a post (/report-post/{id})
+func ReportPostHandler(w http.ResponseWriter, r *http.Request) {
+	handleReport(w, r, TargetPost, "/report-post/")
+}
+
+// ReportCommentHandler lets a logged-in user report a comment (/report-comment/{id})
+func ReportCommentHandler(w http.ResponseWriter, r *http.Request) {
+	handleReport(w, r, TargetComment, "/report-comment/")
+}
+
+// ResolveReportHandler resolves the open reports about the content of a report (/mod/report/{id})
+func ResolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsModerator() {
+		Error403Handler(w, r)
+		return
+	}
+
+	reportID, err := strconv.Atoi(r.URL.Path[len("/mod/report/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	note, err := validateModerationReason(r.FormValue("note"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = resolveReports(user, reportID, r.FormValue("resolution"), note)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if isModerationInputError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error resolving report: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/mod#reports", http.StatusSeeOther)
+}
@@ -0,0 +1,166 @@
+package RebootForums
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useReportHideThreshold sets ReportHideThreshold for the rest of the test
+func useReportHideThreshold(t *testing.T, threshold int) {
+	previous := ReportHideThreshold
+	t.Cleanup(func() { ReportHideThreshold = previous })
+	ReportHideThreshold = threshold
+}
+
+// reportTestContent has n new users report a post or comment and returns the first report's ID
+func reportTestContent(t *testing.T, targetType string, targetID, n int) int {
+	t.Helper()
+	var firstID int
+	for i := 0; i < n; i++ {
+		reporter := &User{ID: createTestUser(t, fmt.Sprintf("reporter%d-%d", targetID, i)), Role: RoleMember}
+		if _, err := CreateReport(reporter, targetType, targetID, ReportSpam, ""); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			err := DB.QueryRow("SELECT id FROM reports WHERE reporter_id = ?", reporter.ID).Scan(&firstID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return firstID
+}
+
+// contentHidden returns whether a post or comment is hidden, and whether the report threshold hid it
+func contentHidden(t *testing.T, targetType string, targetID int) (hidden, autoHidden bool) {
+	t.Helper()
+	err := DB.QueryRow("SELECT is_hidden, auto_hidden FROM "+contentTable(targetType)+" WHERE id = ?", targetID).
+		Scan(&hidden, &autoHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hidden, autoHidden
+}
+
+func TestCreateReportHidesAtThreshold(t *testing.T) {
+	for _, targetType := range []string{TargetPost, TargetComment} {
+		t.Run(targetType, func(t *testing.T) {
+			useTestDB(t)
+			useReportHideThreshold(t, 3)
+			author := &User{ID: createTestUser(t, "author"), Role: RoleMember}
+			targetID := createTestPost(t, author.ID, "post", time.Now())
+			if targetType == TargetComment {
+				targetID = createTestComment(t, author.ID, targetID, 0, "comment")
+			}
+
+			reportTestContent(t, targetType, targetID, 2)
+			if hidden, _ := contentHidden(t, targetType, targetID); hidden {
+				t.Fatal("hidden below the threshold")
+			}
+
+			reporter := &User{ID: createTestUser(t, "reporter"), Role: RoleMember}
+			if _, err := CreateReport(reporter, targetType, targetID, ReportAbuse, "rude"); err != nil {
+				t.Fatal(err)
+			}
+			if hidden, autoHidden := contentHidden(t, targetType, targetID); !hidden || !autoHidden {
+				t.Errorf("at the threshold: hidden %v, auto_hidden %v; want both", hidden, autoHidden)
+			}
+			if n := countRows(t, "moderation_log", "target_type = ? AND target_id = ? AND moderator_id IS NULL", targetType, targetID); n != 1 {
+				t.Errorf("%d automatic hide(s) logged, want 1", n)
+			}
+
+			if _, err := CreateReport(reporter, targetType, targetID, ReportSpam, ""); err != errDuplicateReport {
+				t.Errorf("second report by the same user: got %v, want errDuplicateReport", err)
+			}
+			if _, err := CreateReport(author, targetType, targetID, ReportSpam, ""); !isModerationInputError(err) {
+				t.Errorf("reported own content: %v", err)
+			}
+			if n := countRows(t, "reports", "target_type = ? AND target_id = ?", targetType, targetID); n != 3 {
+				t.Errorf("%d reports stored, want 3", n)
+			}
+		})
+	}
+}
+
+func TestResolveReportsUnhidesOnlyAutoHidden(t *testing.T) {
+	tests := []struct {
+		name          string
+		targetType    string
+		moderatorHide bool // a moderator hid the content, before or after the reports
+		hideFirst     bool // the moderator hid it before it was reported
+		resolution    string
+		wantHidden    bool
+	}{
+		{name: "dismissing shows a post again", targetType: TargetPost, resolution: ReportDismissed},
+		{name: "warning shows a comment again", targetType: TargetComment, resolution: ReportWarned},
+		{name: "dismissing keeps a post hidden by a moderator", targetType: TargetPost, moderatorHide: true, hideFirst: true,
+			resolution: ReportDismissed, wantHidden: true},
+		{name: "warning keeps a comment hidden by a moderator", targetType: TargetComment, moderatorHide: true, hideFirst: true,
+			resolution: ReportWarned, wantHidden: true},
+		{name: "a moderator hid it again after the threshold", targetType: TargetPost, moderatorHide: true,
+			resolution: ReportDismissed, wantHidden: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			useReportHideThreshold(t, 2)
+			author := &User{ID: createTestUser(t, "author"), Role: RoleMember}
+			moderator := &User{ID: createTestUser(t, "mod"), Role: RoleModerator}
+			postID := createTestPost(t, author.ID, "post", time.Now())
+			targetID := postID
+			if tt.targetType == TargetComment {
+				targetID = createTestComment(t, author.ID, postID, 0, "comment")
+			}
+			hide := func() {
+				t.Helper()
+				var err error
+				if tt.targetType == TargetPost {
+					err = moderatePost(moderator, targetID, "hide", nil, "")
+				} else {
+					_, err = moderateComment(moderator, targetID, "hide", "")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.moderatorHide && tt.hideFirst {
+				hide()
+			}
+			reportID := reportTestContent(t, tt.targetType, targetID, 2)
+			if tt.moderatorHide && !tt.hideFirst {
+				hide()
+			}
+
+			if hidden, _ := contentHidden(t, tt.targetType, targetID); !hidden {
+				t.Fatal("not hidden before the reports were resolved")
+			}
+
+			gotPostID, err := resolveReports(moderator, reportID, tt.resolution, "note")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotPostID != postID {
+				t.Errorf("returned post %d, want %d", gotPostID, postID)
+			}
+			if hidden, _ := contentHidden(t, tt.targetType, targetID); hidden != tt.wantHidden {
+				t.Errorf("hidden = %v, want %v", hidden, tt.wantHidden)
+			}
+			if n := countRows(t, "reports", "status = ?", tt.resolution); n != 2 {
+				t.Errorf("%d report(s) resolved as %s, want 2", n, tt.resolution)
+			}
+			wantWarnings := 0
+			if tt.resolution == ReportWarned {
+				wantWarnings = 1
+			}
+			if n := countRows(t, "user_warnings", "user_id = ?", author.ID); n != wantWarnings {
+				t.Errorf("%d warning(s) recorded, want %d", n, wantWarnings)
+			}
+
+			if _, err := resolveReports(moderator, reportID, ReportDismissed, ""); !isModerationInputError(err) {
+				t.Errorf("resolved a report twice: %v", err)
+			}
+		})
+	}
+}
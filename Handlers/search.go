@@ -0,0 +1,376 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const SearchResultsPerPage = 20
+
+// Markers wrapped around matched terms by snippet(); they are swapped for <mark> tags after HTML escaping
+const (
+	highlightStart = "\x02"
+	highlightEnd   = "\x03"
+)
+
+// searchEnabled is false when the SQLite driver was built without FTS5 support
+var searchEnabled = true
+
+// SearchResult is a post or comment matching a search query
+type SearchResult struct {
+	PostID    int
+	CommentID int // 0 when the post itself matched
+	Title     string
+	Author    string
+	CreatedAt time.Time
+	Snippet   template.HTML
+}
+
+func (s SearchResult) FormattedCreatedAt() string {
+	return s.CreatedAt.Format("January 2, 2006 at 3:04 PM")
+}
+
+// SearchQuery is a parsed search string
+type SearchQuery struct {
+	Terms    []string // words and quoted phrases to match
+	Author   string
+	Category string
+}
+
+// searchTriggers are the triggers keeping the search indexes in sync with posts and comments
+var searchTriggers = []string{
+	"posts_fts_insert", "posts_fts_delete", "posts_fts_update",
+	"comments_fts_insert", "comments_fts_delete", "comments_fts_update",
+}
+
+// SetupSearchIndex creates the FTS5 indexes over posts and comments and the triggers keeping them in sync.
+// Whenever the triggers weren't in place, the indexes are rebuilt from the current posts and comments.
+func SetupSearchIndex() error {
+	var inSync bool
+	err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = 'posts_fts_insert')").Scan(&inSync)
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+			title, content, content='posts', content_rowid='id'
+		)`,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(
+			content, content='comments', content_rowid='id'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+			INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+			INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF title, content ON posts BEGIN
+			INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+			INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+			INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+			INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+			INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+		END`,
+	}
+
+	for _, query := range queries {
+		_, err := DB.Exec(query)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				log.Println("SQLite was built without FTS5, search is disabled (build with -tags sqlite_fts5)")
+				searchEnabled = false
+				return dropSearchTriggers()
+			}
+			log.Printf("Error executing query: %s\nError: %v", query, err)
+			return err
+		}
+	}
+
+	if !inSync {
+		_, err = DB.Exec("INSERT INTO posts_fts(posts_fts) VALUES ('rebuild')")
+		if err != nil {
+			return fmt.Errorf("error backfilling posts index: %v", err)
+		}
+		_, err = DB.Exec("INSERT INTO comments_fts(comments_fts) VALUES ('rebuild')")
+		if err != nil {
+			return fmt.Errorf("error backfilling comments index: %v", err)
+		}
+		log.Println("Search index backfilled from existing posts and comments")
+	}
+
+	log.Println("Search index ready")
+	return nil
+}
+
+// dropSearchTriggers removes the index triggers, which would otherwise make every write
+// fail on a driver without FTS5. The indexes are rebuilt once FTS5 is available again.
+func dropSearchTriggers() error {
+	for _, trigger := range searchTriggers {
+		_, err := DB.Exec("DROP TRIGGER IF EXISTS " + trigger)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSearchQuery splits a search string into terms, "quoted phrases", author:name and category:name filters
+func ParseSearchQuery(q string) SearchQuery {
+	var query SearchQuery
+	for _, token := range tokenizeSearch(q) {
+		lower := strings.ToLower(token)
+		switch {
+		case strings.HasPrefix(lower, "author:") && len(token) > len("author:"):
+			query.Author = strings.Trim(token[len("author:"):], `"`)
+		case strings.HasPrefix(lower, "category:") && len(token) > len("category:"):
+			query.Category = strings.Trim(token[len("category:"):], `"`)
+		default:
+			term := strings.TrimSpace(strings.Trim(token, `"`))
+			if term != "" {
+				query.Terms = append(query.Terms, term)
+			}
+		}
+	}
+	return query
+}
+
+// tokenizeSearch splits on whitespace while keeping double-quoted sections together
+func tokenizeSearch(q string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// matchExpression builds an FTS5 MATCH expression in which every term is quoted,
+// so user input can't inject FTS5 query syntax
+func (q SearchQuery) matchExpression() string {
+	quoted := make([]string, 0, len(q.Terms))
+	for _, term := range q.Terms {
+		quoted = append(quoted, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// SearchPosts returns posts and comments matching the query, best bm25 matches first
+func SearchPosts(query SearchQuery, page int) ([]SearchResult, bool, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	// Content hidden by moderators never shows up in search
+	filters := []string{"p.is_hidden = 0"}
+	args := []interface{}{}
+	if query.Author != "" {
+		filters = append(filters, "u.username = :author COLLATE NOCASE")
+		args = append(args, sql.Named("author", query.Author))
+	}
+	if query.Category != "" {
+		filters = append(filters, `p.id IN (
+                SELECT pc.post_id FROM post_categories pc
+                JOIN categories c ON c.id = pc.category_id
+                WHERE c.name = :category COLLATE NOCASE)`)
+		args = append(args, sql.Named("category", query.Category))
+	}
+	filter := ""
+	if len(filters) > 0 {
+		filter = " AND " + strings.Join(filters, " AND ")
+	}
+
+	var sqlQuery string
+	if len(query.Terms) == 0 {
+		// Only filters were given, so list the matching posts newest first
+		sqlQuery = `
+            SELECT p.id, 0, p.title, u.username, p.created_at, substr(p.content, 1, 200), 0 AS rank
+            FROM posts p
+            JOIN users u ON u.id = p.user_id
+            WHERE 1 = 1` + filter + `
+            ORDER BY p.created_at DESC
+            LIMIT :limit OFFSET :offset`
+	} else {
+		sqlQuery = `
+            SELECT p.id, 0, p.title, u.username, p.created_at,
+                   snippet(posts_fts, -1, :hl_start, :hl_end, '…', 16), bm25(posts_fts, 10.0, 1.0) AS rank
+            FROM posts_fts
+            JOIN posts p ON p.id = posts_fts.rowid
+            JOIN users u ON u.id = p.user_id
+            WHERE posts_fts MATCH :match` + filter + `
+            UNION ALL
+            SELECT p.id, c.id, p.title, u.username, c.created_at,
+                   snippet(comments_fts, 0, :hl_start, :hl_end, '…', 16), bm25(comments_fts) AS rank
+            FROM comments_fts
+            JOIN comments c ON c.id = comments_fts.rowid
+            JOIN posts p ON p.id = c.post_id
+            JOIN users u ON u.id = c.user_id
+            WHERE comments_fts MATCH :match AND c.is_deleted = 0 AND c.is_hidden = 0` + filter + `
+            ORDER BY rank
+            LIMIT :limit OFFSET :offset`
+		args = append(args,
+			sql.Named("match", query.matchExpression()),
+			sql.Named("hl_start", highlightStart),
+			sql.Named("hl_end", highlightEnd),
+		)
+	}
+	args = append(args,
+		sql.Named("limit", SearchResultsPerPage+1),
+		sql.Named("offset", (page-1)*SearchResultsPerPage),
+	)
+
+	rows, err := DB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var snippet, createdAt string
+		var rank float64
+		err := rows.Scan(&result.PostID, &result.CommentID, &result.Title, &result.Author, &createdAt, &snippet, &rank)
+		if err != nil {
+			return nil, false, err
+		}
+		result.CreatedAt = parseDBTime(createdAt)
+		result.Snippet = highlightSnippet(snippet)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(results) > SearchResultsPerPage
+	if hasMore {
+		results = results[:SearchResultsPerPage]
+	}
+	return results, hasMore, nil
+}
+
+// parseDBTime parses the timestamp formats stored by the Go driver and by CURRENT_TIMESTAMP.
+// Compound SELECTs lose the column's DATETIME type, so timestamps arrive as text.
+func parseDBTime(value string) time.Time {
+	layouts := []string{
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02T15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02 15:04:05",
+		time.RFC3339Nano,
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// highlightSnippet escapes a snippet and turns the match markers into <mark> tags
+func highlightSnippet(snippet string) template.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, highlightEnd, "</mark>")
+	return template.HTML(escaped)
+}
+
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	loggedIn := user != nil
+	var username string
+	if loggedIn {
+		username = user.Username
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	var results []SearchResult
+	var hasMore bool
+	message := ""
+	query := ParseSearchQuery(q)
+
+	switch {
+	case !searchEnabled:
+		message = "Search is currently unavailable."
+	case q == "":
+		message = `Search posts and comments. Use "quotes" for phrases, author:name and category:name to filter.`
+	case len(query.Terms) == 0 && query.Author == "" && query.Category == "":
+		message = "Please enter something to search for."
+	default:
+		results, hasMore, err = SearchPosts(query, page)
+		if err != nil {
+			log.Printf("Error searching posts: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		if len(results) == 0 {
+			message = "No results found."
+		}
+	}
+
+	data := struct {
+		Query    string
+		Results  []SearchResult
+		Message  string
+		Page     int
+		PrevPage int
+		NextPage int
+		LoggedIn bool
+		Username string
+	}{
+		Query:    q,
+		Results:  results,
+		Message:  message,
+		Page:     page,
+		LoggedIn: loggedIn,
+		Username: username,
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if hasMore {
+		data.NextPage = page + 1
+	}
+
+	err = RenderTemplate(w, "search.html", data)
+	if err != nil {
+		log.Printf("Error rendering search template: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+}
@@ -0,0 +1,86 @@
+package RebootForums
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  SearchQuery
+	}{
+		{"", SearchQuery{}},
+		{"go sqlite", SearchQuery{Terms: []string{"go", "sqlite"}}},
+		{`"full text" search`, SearchQuery{Terms: []string{"full text", "search"}}},
+		{"author:alice rust", SearchQuery{Terms: []string{"rust"}, Author: "alice"}},
+		{`Category:"Food" pizza`, SearchQuery{Terms: []string{"pizza"}, Category: "Food"}},
+		{"author: lonely", SearchQuery{Terms: []string{"author:", "lonely"}}},
+		{`"   "`, SearchQuery{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := ParseSearchQuery(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchExpression(t *testing.T) {
+	tests := []struct {
+		name  string
+		terms []string
+		want  string
+	}{
+		{"no terms", nil, ""},
+		{"plain terms", []string{"go", "sqlite"}, `"go" "sqlite"`},
+		{"phrase", []string{"full text"}, `"full text"`},
+		{"embedded quotes", []string{`say "hi"`}, `"say ""hi"""`},
+		{"lone quote", []string{`"`}, `""""`},
+		{"operators", []string{"a", "OR", "b", "NOT", "c", "NEAR"}, `"a" "OR" "b" "NOT" "c" "NEAR"`},
+		{"syntax", []string{"title:x", "pre*", "(a)", "^start", "-neg", "a+b"}, `"title:x" "pre*" "(a)" "^start" "-neg" "a+b"`},
+	}
+
+	useTestDB(t)
+	if _, err := DB.Exec("CREATE VIRTUAL TABLE match_test USING fts5(title, body)"); err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			t.Skip("SQLite was built without FTS5; build with -tags sqlite_fts5")
+		}
+		t.Fatal(err)
+	}
+	_, err := DB.Exec(`INSERT INTO match_test (title, body) VALUES
+		('x', 'a OR b NOT c NEAR'), ('say', 'say "hi" to go and sqlite')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr := SearchQuery{Terms: tt.terms}.matchExpression()
+			if expr != tt.want {
+				t.Errorf("got %s, want %s", expr, tt.want)
+			}
+			if expr == "" {
+				return
+			}
+			// Quoted terms are plain strings to FTS5, whatever they contain
+			var n int
+			if err := DB.QueryRow("SELECT COUNT(*) FROM match_test WHERE match_test MATCH ?", expr).Scan(&n); err != nil {
+				t.Errorf("FTS5 rejected %s: %v", expr, err)
+			}
+		})
+	}
+
+	t.Run("operators match literally", func(t *testing.T) {
+		var n int
+		expr := SearchQuery{Terms: []string{"b", "NOT", "c"}}.matchExpression()
+		if err := DB.QueryRow("SELECT COUNT(*) FROM match_test WHERE match_test MATCH ?", expr).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("%s matched %d rows, want the one containing all three words", expr, n)
+		}
+	})
+}
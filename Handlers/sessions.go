@@ -1,91 +1,201 @@
 package RebootForums
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// authContextKey is the request context key of the RequestAuth stored by SessionMiddleware
+type authContextKey struct{}
+
+// RequestAuth is who made a request, resolved once per request by SessionMiddleware
+type RequestAuth struct {
+	User      *User  // nil for guests
+	SessionID int    // the browser session of the request, guest or not; 0 for access token requests
+	ViaToken  bool   // authenticated with an "Authorization: Bearer" access token instead of the session cookie
+	CSRFToken string // the token forms of the session must send back; empty for access token requests
+}
+
+// VisitorKey identifies whoever made the request for view counts: the user when logged in,
+// otherwise their guest session. It is empty when the request has neither.
+func (a *RequestAuth) VisitorKey() string {
+	switch {
+	case a.User != nil:
+		return "user:" + strconv.Itoa(a.User.ID)
+	case a.SessionID != 0:
+		return "guest:" + strconv.Itoa(a.SessionID)
+	default:
+		return ""
+	}
+}
+
+// SessionMiddleware resolves the user of a request once and stores it in the request context,
+// where handlers read it with CurrentUser. Visitors without a valid session stay anonymous until
+// a page needs to tell them apart, see ensureGuestSession.
 func SessionMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := r.Cookie("session_token")
+		auth, err := resolveRequestAuth(w, r)
 		if err != nil {
-			newToken, err := generateSessionToken()
-			if err != nil {
-				log.Printf("Error generating session token: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
-			expiry := time.Now().Add(24 * time.Hour)
-			err = UpsertSession(nil, newToken, expiry, true)
-			if err != nil {
-				log.Printf("Error creating guest session: %v", err)
-			}
-			http.SetCookie(w, &http.Cookie{
-				Name:    "session_token",
-				Value:   newToken,
-				Expires: expiry,
-			})
-		} else {
-			var exists bool
-			err = DB.QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE token = ?)", token.Value).Scan(&exists)
-			if err != nil || !exists {
-				http.SetCookie(w, &http.Cookie{
-					Name:    "session_token",
-					Value:   "",
-					Expires: time.Now().Add(-1 * time.Hour),
-				})
-				http.Redirect(w, r, "/login", http.StatusSeeOther)
-				return
-			}
-			err = UpdateSessionActivity(token.Value)
-			if err != nil {
-				log.Printf("Error updating session activity: %v", err)
-			}
+			log.Printf("Error resolving session: %v", err)
+			Error500Handler(w, r)
+			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth)))
+	}
+}
+
+// resolveRequestAuth authenticates a request by its access token or session cookie. Requests with
+// neither get an empty RequestAuth.
+func resolveRequestAuth(w http.ResponseWriter, r *http.Request) (*RequestAuth, error) {
+	if bearerToken(r) != "" {
+		user, err := getUserFromBearerToken(r)
+		if err != nil {
+			return nil, err
+		}
+		return &RequestAuth{User: user, ViaToken: true}, nil
+	}
+
+	if c, err := r.Cookie("session_token"); err == nil {
+		auth, err := lookupSession(c.Value)
+		if err != nil || auth != nil {
+			return auth, err
+		}
+	}
+	return &RequestAuth{}, nil
+}
+
+// ensureGuestSession returns the RequestAuth of a request, first giving a visitor without a
+// session an anonymous guest session. Pages call it only when they need one, to render a form
+// with a CSRF token or to count a view, so that requests for images and visits from clients
+// that never come back don't each leave a session behind.
+func ensureGuestSession(w http.ResponseWriter, r *http.Request) (*RequestAuth, error) {
+	auth := currentAuth(r)
+	if auth.ViaToken || auth.SessionID != 0 {
+		return auth, nil
+	}
+	guest, err := startGuestSession(w, r)
+	if err != nil {
+		return nil, err
+	}
+	// The RequestAuth in the context is shared, so the rest of the request sees the new session
+	*auth = *guest
+	return auth, nil
+}
+
+// startGuestSession gives a visitor without a session an anonymous guest session
+func startGuestSession(w http.ResponseWriter, r *http.Request) (*RequestAuth, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := UpsertSession(nil, token, true, false, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return nil, err
+	}
+	var sessionID int
+	err = DB.QueryRow("SELECT id FROM sessions WHERE token_hash = ?", hashSessionToken(token)).Scan(&sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Guests keep their identity across browser restarts, like remembered sessions
+	setSessionCookie(w, r, token, true, expiry)
+	return &RequestAuth{SessionID: sessionID, CSRFToken: csrfTokenFor(token)}, nil
+}
+
+// CurrentUser returns the logged-in user of a request, or nil for guests. Requests carrying an
+// "Authorization: Bearer" access token are authenticated by the token instead of the session cookie.
+func CurrentUser(r *http.Request) *User {
+	return currentAuth(r).User
+}
+
+// sessionUser returns the user of a request logged in with the session cookie. Requests made with
+// an access token have none, for pages such as settings that only a browser session may use.
+func sessionUser(r *http.Request) *User {
+	auth := currentAuth(r)
+	if auth.ViaToken {
+		return nil
 	}
+	return auth.User
 }
-func UpsertSession(userID *int, token string, expiry time.Time, isGuest bool) error {
+
+// currentAuth returns what SessionMiddleware resolved for the request, or an anonymous
+// RequestAuth for requests that didn't pass through it
+func currentAuth(r *http.Request) *RequestAuth {
+	if auth, ok := r.Context().Value(authContextKey{}).(*RequestAuth); ok {
+		return auth
+	}
+	return &RequestAuth{}
+}
+
+// UpsertSession stores a session along with the browser and IP address it was started from,
+// and returns the time it ends at the latest. Only a hash of the token is stored.
+// A user can be logged in on several devices at once, unless SingleSession is set.
+func UpsertSession(userID *int, token string, isGuest, remember bool, userAgent, ip string) (time.Time, error) {
+	idle, maxAge := sessionLifetimes(remember)
+	now := time.Now()
+	absoluteExpiry := now.Add(maxAge)
+	expiry := now.Add(idle)
+	if expiry.After(absoluteExpiry) {
+		expiry = absoluteExpiry
+	}
+
 	tx, err := DB.Begin()
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 	defer tx.Rollback()
-	if userID != nil && !isGuest {
+	if userID != nil && !isGuest && SingleSession {
 		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", *userID)
 		if err != nil {
-			return err
+			return time.Time{}, err
 		}
 	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
 	query := `
-    INSERT INTO sessions (user_id, token, expiry, is_guest, last_activity, created_at)
-    VALUES (?, ?, ?, ?, ?, ?)
-    ON CONFLICT(token) DO UPDATE SET
-    user_id = ?, expiry = ?, is_guest = ?, last_activity = ?
+    INSERT INTO sessions (user_id, token_hash, expiry, absolute_expiry, remember, is_guest, last_activity, created_at, user_agent, ip_address)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT(token_hash) DO UPDATE SET
+    user_id = ?, expiry = ?, absolute_expiry = ?, remember = ?, is_guest = ?, last_activity = ?, user_agent = ?, ip_address = ?
     `
-	now := time.Now()
-	_, err = tx.Exec(query, userID, token, expiry, isGuest, now, now,
-		userID, expiry, isGuest, now)
+	tokenHash := hashSessionToken(token)
+	_, err = tx.Exec(query, userID, tokenHash, expiry, absoluteExpiry, remember, isGuest, now, now, userAgent, ip,
+		userID, expiry, absoluteExpiry, remember, isGuest, now, userAgent, ip)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	return tx.Commit()
+	return absoluteExpiry, tx.Commit()
 }
-func UpdateSessionActivity(token string) error {
-	_, err := DB.Exec("UPDATE sessions SET last_activity = ? WHERE token = ?", time.Now(), token)
+
+// extendSession marks a session as active now and moves its idle expiry forward from now,
+// never past its absolute expiry
+func extendSession(tokenHash string, remember bool, absoluteExpiry time.Time) error {
+	idle, _ := sessionLifetimes(remember)
+	now := time.Now()
+	expiry := now.Add(idle)
+	if expiry.After(absoluteExpiry) {
+		expiry = absoluteExpiry
+	}
+	_, err := DB.Exec("UPDATE sessions SET last_activity = ?, expiry = ? WHERE token_hash = ?", now, expiry, tokenHash)
 	return err
 }
+
+// GetActiveSessions counts the members and guests who were active in the last OnlineWindow.
+// Members logged in on several devices count once.
 func GetActiveSessions() (int, int, error) {
 	var registeredCount, guestCount int
 	err := DB.QueryRow(`
 		SELECT 
-			COUNT(CASE WHEN is_guest = 0 THEN 1 END) as registered_count,
+			COUNT(DISTINCT CASE WHEN is_guest = 0 THEN user_id END) as registered_count,
 			COUNT(CASE WHEN is_guest = 1 THEN 1 END) as guest_count
 		FROM sessions
-		WHERE last_activity > ?
-	`, time.Now().Add(-5*time.Minute)).Scan(&registeredCount, &guestCount)
+		WHERE last_activity > ? AND expiry > ?
+	`, time.Now().Add(-OnlineWindow), time.Now()).Scan(&registeredCount, &guestCount)
 	return registeredCount, guestCount, err
 }
 func CleanupSessions() {
@@ -105,70 +215,65 @@ func init() {
 func GetSessionDuration(token string) (time.Duration, error) {
 	var createdAt time.Time
 	var lastActivity time.Time
-	err := DB.QueryRow("SELECT created_at, last_activity FROM sessions WHERE token = ?", token).Scan(&createdAt, &lastActivity)
+	err := DB.QueryRow("SELECT created_at, last_activity FROM sessions WHERE token_hash = ?", hashSessionToken(token)).Scan(&createdAt, &lastActivity)
 	if err != nil {
 		return 0, err
 	}
 	return lastActivity.Sub(createdAt), nil
 }
 func DeleteSession(token string) error {
-	_, err := DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+	_, err := DB.Exec("DELETE FROM sessions WHERE token_hash = ?", hashSessionToken(token))
 	if err != nil {
 		log.Printf("Error deleting session: %v", err)
 		return err
 	}
 	return nil
 }
-func GetUserFromSession(r *http.Request) (*User, error) {
-	c, err := r.Cookie("session_token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			// No cookie found, which is fine for guest users
-			return nil, nil
-		}
-		// For any other error, log it and return
-		log.Printf("Error getting session cookie: %v", err)
+
+// lookupSession resolves a session token into the session's user, or into a guest session.
+// It returns nil for unknown and expired sessions.
+func lookupSession(token string) (*RequestAuth, error) {
+	tokenHash := hashSessionToken(token)
+	var sessionID, userID int
+	var isGuest, remember bool
+	var expiry, lastActivity, absoluteExpiry time.Time
+	err := DB.QueryRow(`
+        SELECT id, COALESCE(user_id, 0), is_guest, expiry, last_activity, remember, absolute_expiry
+        FROM sessions WHERE token_hash = ?
+    `, tokenHash).Scan(&sessionID, &userID, &isGuest, &expiry, &lastActivity, &remember, &absoluteExpiry)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	sessionToken := c.Value
-	var userID int
-	var isGuest bool
-	err = DB.QueryRow("SELECT user_id, is_guest FROM sessions WHERE token = ?", sessionToken).Scan(&userID, &isGuest)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// Session not found in database, treat as guest
-			log.Printf("Session not found for token: %s", sessionToken)
-			return nil, nil
+	if !time.Now().Before(expiry) {
+		// The session timed out or reached its maximum lifetime; cleanup deletes it later
+		return nil, nil
+	}
+	if time.Since(lastActivity) > sessionTouchInterval {
+		if err := extendSession(tokenHash, remember, absoluteExpiry); err != nil {
+			log.Printf("Error updating session activity: %v", err)
 		}
-		// For any other database error, log it and return
-		log.Printf("Database error when fetching session: %v", err)
-		return nil, err
 	}
 
 	if isGuest {
-		// Guest session, return nil user
-		return nil, nil
+		return &RequestAuth{SessionID: sessionID, CSRFToken: csrfTokenFor(token)}, nil
 	}
-
 	user, err := GetUserByID(userID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// User not found, which shouldn't happen for a valid session
-			log.Printf("User not found for session user_id: %d", userID)
-			return nil, nil
-		}
-		// For any other error getting user, log it and return
-		log.Printf("Error getting user by ID: %v", err)
+	if err == sql.ErrNoRows {
+		// User not found, which shouldn't happen for a valid session
+		log.Printf("User not found for session user_id: %d", userID)
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
-
-	return user, nil
+	return &RequestAuth{User: user, SessionID: sessionID, CSRFToken: csrfTokenFor(token)}, nil
 }
 
 func GetUserByID(id int) (*User, error) {
     var user User
-    err := DB.QueryRow("SELECT id, username, email FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Email)
+    err := DB.QueryRow("SELECT id, username, email, role, email_verified_at IS NOT NULL FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified)
     if err != nil {
         return nil, err
     }
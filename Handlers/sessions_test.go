@@ -0,0 +1,210 @@
+package RebootForums
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Migration 17 hashed the tokens of existing sessions as hex-encoded SHA-256, so they are only
+// found again while hashSessionToken hashes the same way
+func TestHashSessionTokenMatchesMigration(t *testing.T) {
+	sum := sha256.Sum256([]byte("plaintext-token"))
+	if got, want := hashSessionToken("plaintext-token"), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("hashSessionToken = %q, want %q", got, want)
+	}
+}
+
+// sessionExpiries returns the idle and absolute expiry of the session with the given token
+func sessionExpiries(t *testing.T, token string) (expiry, absoluteExpiry time.Time) {
+	t.Helper()
+	err := DB.QueryRow("SELECT expiry, absolute_expiry FROM sessions WHERE token_hash = ?", hashSessionToken(token)).
+		Scan(&expiry, &absoluteExpiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiry, absoluteExpiry
+}
+
+// assertAround fails unless got is within a few seconds of want
+func assertAround(t *testing.T, what string, got, want time.Time) {
+	t.Helper()
+	if d := got.Sub(want); d < -5*time.Second || d > 5*time.Second {
+		t.Errorf("%s = %v, want about %v", what, got, want)
+	}
+}
+
+func TestUpsertSessionLifetimes(t *testing.T) {
+	tests := []struct {
+		name         string
+		remember     bool
+		idle, maxAge time.Duration // the lifetimes of sessions that aren't remembered
+		wantIdle     time.Duration
+		wantMaxAge   time.Duration
+	}{
+		{name: "session", idle: time.Hour, maxAge: 24 * time.Hour, wantIdle: time.Hour, wantMaxAge: 24 * time.Hour},
+		{name: "remember me", remember: true, idle: time.Hour, maxAge: 24 * time.Hour,
+			wantIdle: RememberMeIdleTimeout, wantMaxAge: RememberMeMaxAge},
+		{name: "idle timeout longer than the maximum age", idle: 48 * time.Hour, maxAge: 24 * time.Hour,
+			wantIdle: 24 * time.Hour, wantMaxAge: 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			previousIdle, previousMaxAge := SessionIdleTimeout, SessionMaxAge
+			t.Cleanup(func() { SessionIdleTimeout, SessionMaxAge = previousIdle, previousMaxAge })
+			SessionIdleTimeout, SessionMaxAge = tt.idle, tt.maxAge
+
+			userID := createTestUser(t, "member")
+			now := time.Now()
+			ends, err := UpsertSession(&userID, "token", false, tt.remember, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expiry, absoluteExpiry := sessionExpiries(t, "token")
+			assertAround(t, "expiry", expiry, now.Add(tt.wantIdle))
+			assertAround(t, "absolute expiry", absoluteExpiry, now.Add(tt.wantMaxAge))
+			if !ends.Equal(absoluteExpiry) {
+				t.Errorf("UpsertSession returned %v, want the absolute expiry %v", ends, absoluteExpiry)
+			}
+		})
+	}
+}
+
+func TestExtendSession(t *testing.T) {
+	tests := []struct {
+		name           string
+		remember       bool
+		absoluteExpiry time.Duration // from now
+		wantExpiry     time.Duration // from now
+	}{
+		{"slides forward", false, 30 * 24 * time.Hour, SessionIdleTimeout},
+		{"remembered session slides further", true, 365 * 24 * time.Hour, RememberMeIdleTimeout},
+		{"never past the absolute expiry", false, time.Hour, time.Hour},
+		{"remembered session never past the absolute expiry", true, time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			userID := createTestUser(t, "member")
+			if _, err := UpsertSession(&userID, "token", false, tt.remember, "", ""); err != nil {
+				t.Fatal(err)
+			}
+			// The session has been idle for a while and is about to time out
+			now := time.Now()
+			_, err := DB.Exec("UPDATE sessions SET expiry = ?, last_activity = ? WHERE token_hash = ?",
+				now.Add(time.Minute), now.Add(-time.Hour), hashSessionToken("token"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := extendSession(hashSessionToken("token"), tt.remember, now.Add(tt.absoluteExpiry)); err != nil {
+				t.Fatal(err)
+			}
+			expiry, _ := sessionExpiries(t, "token")
+			assertAround(t, "expiry", expiry, now.Add(tt.wantExpiry))
+		})
+	}
+}
+
+func TestLookupSession(t *testing.T) {
+	useTestDB(t)
+	userID := createTestUser(t, "member")
+	for _, token := range []string{"active", "idle", "timed-out", "ended"} {
+		if _, err := UpsertSession(&userID, token, false, false, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := UpsertSession(nil, "guest", true, false, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	update := func(token, set string, args ...interface{}) {
+		t.Helper()
+		_, err := DB.Exec("UPDATE sessions SET "+set+" WHERE token_hash = ?", append(args, hashSessionToken(token))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("idle", "last_activity = ?, expiry = ?", now.Add(-time.Hour), now.Add(time.Minute))
+	update("timed-out", "expiry = ?", now.Add(-time.Minute))
+	// Reached its absolute expiry, which caps the idle expiry as well
+	update("ended", "expiry = ?, absolute_expiry = ?", now.Add(-time.Second), now.Add(-time.Second))
+
+	tests := []struct {
+		token     string
+		wantUser  bool
+		wantGuest bool
+	}{
+		{token: "active", wantUser: true},
+		{token: "idle", wantUser: true},
+		{token: "guest", wantGuest: true},
+		{token: "timed-out"},
+		{token: "ended"},
+		{token: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			auth, err := lookupSession(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case !tt.wantUser && !tt.wantGuest:
+				if auth != nil {
+					t.Errorf("resolved to %+v, want nil", auth)
+				}
+			case auth == nil || auth.SessionID == 0 || auth.CSRFToken == "":
+				t.Errorf("resolved to %+v, want a session", auth)
+			case tt.wantUser && (auth.User == nil || auth.User.ID != userID):
+				t.Errorf("resolved to user %+v, want %d", auth.User, userID)
+			case tt.wantGuest && auth.User != nil:
+				t.Errorf("guest session resolved to user %+v", auth.User)
+			}
+		})
+	}
+
+	// Looking up the idle session marked it as active and moved its expiry forward
+	expiry, _ := sessionExpiries(t, "idle")
+	assertAround(t, "expiry after lookup", expiry, now.Add(SessionIdleTimeout))
+}
+
+func TestSingleSession(t *testing.T) {
+	useTestDB(t)
+	previous := SingleSession
+	t.Cleanup(func() { SingleSession = previous })
+
+	member := createTestUser(t, "member")
+	other := createTestUser(t, "other")
+	sessions := []struct {
+		userID *int
+		token  string
+		guest  bool
+	}{
+		{&member, "laptop", false},
+		{&member, "phone", false},
+		{&other, "other", false},
+		{nil, "guest", true},
+	}
+	for _, s := range sessions {
+		if _, err := UpsertSession(s.userID, s.token, s.guest, false, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SingleSession = true
+	if _, err := UpsertSession(&member, "desktop", false, false, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]bool{"laptop": false, "phone": false, "desktop": true, "other": true, "guest": true} {
+		var count int
+		err := DB.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", hashSessionToken(token)).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (count == 1) != want {
+			t.Errorf("session %s exists: %v, want %v", token, count == 1, want)
+		}
+	}
+}
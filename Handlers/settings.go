@@ -0,0 +1,228 @@
+package RebootForums
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settingsNotices are the confirmations shown on the settings page after a change, by the value of ?updated=
+var settingsNotices = map[string]string{
+	"password":   "Your password has been changed. Your other sessions have been logged out.",
+	"email-sent": "We sent a confirmation link to your new email address. Your address changes once you open it.",
+	"email":      "Your email address has been changed.",
+}
+
+// renderSettings shows the settings page of a user, with an optional error message
+func renderSettings(w http.ResponseWriter, r *http.Request, user *User, message string) {
+	withPassword, err := hasPassword(user.ID)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	// Users without a password confirm changes by logging in again, see checkPassword
+	recent := true
+	if !withPassword {
+		if recent, err = recentLogin(user.ID, currentAuth(r).SessionID); err != nil {
+			log.Printf("Error checking login time: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	pendingEmail, err := pendingUserToken(user.ID, TokenEmailChange)
+	if err != nil {
+		log.Printf("Error fetching pending email change: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := struct {
+		Username          string
+		LoggedIn          bool
+		IsModerator       bool
+		Email             string
+		EmailVerified     bool
+		PendingEmail      string
+		HasPassword       bool
+		NeedsReauth       bool
+		ReauthMinutes     int
+		MinPasswordLength int
+		RemovesContent    bool
+		Message           string
+		Notice            string
+	}{
+		Username:          user.Username,
+		LoggedIn:          true,
+		IsModerator:       user.IsModerator(),
+		Email:             user.Email,
+		EmailVerified:     user.EmailVerified,
+		PendingEmail:      pendingEmail,
+		HasPassword:       withPassword,
+		NeedsReauth:       !recent,
+		ReauthMinutes:     int(ReauthWindow / time.Minute),
+		MinPasswordLength: MinPasswordLength,
+		RemovesContent:    AccountDeletionMode == DeleteRemove,
+		Message:           message,
+		Notice:            settingsNotices[r.URL.Query().Get("updated")],
+	}
+
+	err = RenderTemplate(w, "settings.html", data)
+	if err != nil {
+		log.Printf("Error rendering settings template: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// settingsUser returns the logged-in user of a settings request, redirecting to the login
+// page when there is none. Like tokens, settings can only be changed from a browser session.
+func settingsUser(w http.ResponseWriter, r *http.Request) *User {
+	user := sessionUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	return user
+}
+
+// handleSettingsError shows the reason a settings change was rejected, or a 500 page for other errors
+func handleSettingsError(w http.ResponseWriter, r *http.Request, user *User, err error) {
+	if isSettingsError(err) {
+		w.WriteHeader(http.StatusBadRequest)
+		renderSettings(w, r, user, err.Error())
+		return
+	}
+	log.Printf("Error updating settings: %v", err)
+	Error500Handler(w, r)
+}
+
+// SettingsHandler shows the account settings page (/settings)
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+	renderSettings(w, r, user, "")
+}
+
+// ChangePasswordHandler changes the password of the logged-in user (/settings/password)
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	c, _ := r.Cookie("session_token")
+	err := ChangePassword(user.ID, currentAuth(r).SessionID, r.FormValue("current_password"), r.FormValue("new_password"),
+		r.FormValue("confirm_password"), c.Value)
+	if err != nil {
+		handleSettingsError(w, r, user, err)
+		return
+	}
+	if err := rotateSession(w, r); err != nil {
+		log.Printf("Error rotating session: %v", err)
+	}
+
+	http.Redirect(w, r, "/settings?updated=password", http.StatusSeeOther)
+}
+
+// ChangeEmailHandler starts changing the email address of the logged-in user (/settings/email).
+// The new address has to be confirmed with the link sent to it.
+func ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	email, err := CheckEmailChange(user, currentAuth(r).SessionID, r.FormValue("current_password"), r.FormValue("email"))
+	if err != nil {
+		handleSettingsError(w, r, user, err)
+		return
+	}
+	if !allowMail(w, r, "user:"+strconv.Itoa(user.ID), "email:"+strings.ToLower(email)) {
+		return
+	}
+	if err := sendEmailChangeEmail(r, user, email); err != nil {
+		log.Printf("Error sending email change confirmation: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?updated=email-sent", http.StatusSeeOther)
+}
+
+// ConfirmEmailHandler applies an email change from the confirmation link (/settings/confirm-email?token=...).
+// The token identifies the account, so the link also works in a browser that isn't logged in.
+func ConfirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		Error404Handler(w, r)
+		return
+	}
+
+	_, err := ConfirmEmailChange(r.URL.Query().Get("token"))
+	if err == ErrInvalidUserToken || isSettingsError(err) {
+		Error400Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error confirming email change: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?updated=email", http.StatusSeeOther)
+}
+
+// DeleteAccountHandler deletes the account of the logged-in user (/settings/delete).
+// The user has to type their username, and their password if they have one; users without
+// a password must have logged in recently instead.
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := checkPassword(user.ID, currentAuth(r).SessionID, r.FormValue("current_password")); err != nil {
+		handleSettingsError(w, r, user, err)
+		return
+	}
+	if r.FormValue("confirm_username") != user.Username {
+		handleSettingsError(w, r, user, settingsError("Type your username to confirm deleting your account"))
+		return
+	}
+
+	if err := DeleteAccount(user.ID, AccountDeletionMode); err != nil {
+		log.Printf("Error deleting account of %s: %v", user.Username, err)
+		Error500Handler(w, r)
+		return
+	}
+	log.Printf("Deleted account of %s (%s)", user.Username, AccountDeletionMode)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(-1 * time.Hour),
+		MaxAge:   -1,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,334 @@
+package RebootForums
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage backends
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// ErrStoredFileNotFound is returned by Storage.Get for keys that don't exist
+var ErrStoredFileNotFound = errors.New("stored file not found")
+
+// StoredFile describes a file listed by a storage backend
+type StoredFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage keeps uploaded files. Keys are plain filenames such as "<hash>_thumb.jpg".
+type Storage interface {
+	// Put stores a file, replacing any file with the same key
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens a stored file; it returns ErrStoredFileNotFound for unknown keys
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes a file. Deleting a missing file is not an error.
+	Delete(key string) error
+	// Exists reports whether a file is stored under key
+	Exists(key string) (bool, error)
+	// URL returns the address browsers load the file from
+	URL(key string) string
+	// List calls fn for every stored file
+	List(fn func(StoredFile) error) error
+}
+
+// Store is the storage backend uploads are written to, chosen by STORAGE_BACKEND
+var Store Storage = NewLocalStorage(UploadDirectory)
+
+// InitStorage sets Store to the backend configured in the environment
+func InitStorage() error {
+	backend, err := NewStorage(envString("STORAGE_BACKEND", StorageLocal))
+	if err != nil {
+		return err
+	}
+	Store = backend
+	return nil
+}
+
+// NewStorage creates a storage backend by name, configured from the environment:
+//
+//	local: UPLOAD_DIR (default ./uploads)
+//	s3:    S3_ENDPOINT, S3_BUCKET, S3_PREFIX, S3_REGION, S3_ACCESS_KEY, S3_SECRET_KEY,
+//	       S3_USE_SSL, S3_URL_MODE (proxy or presign) and S3_PRESIGN_MINUTES
+func NewStorage(name string) (Storage, error) {
+	switch name {
+	case StorageLocal:
+		local := NewLocalStorage(UploadDirectory)
+		if err := os.MkdirAll(local.Dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return local, nil
+	case StorageS3:
+		return NewS3Storage(S3Config{
+			Endpoint:       os.Getenv("S3_ENDPOINT"),
+			Bucket:         os.Getenv("S3_BUCKET"),
+			Prefix:         os.Getenv("S3_PREFIX"),
+			Region:         envString("S3_REGION", "us-east-1"),
+			AccessKey:      os.Getenv("S3_ACCESS_KEY"),
+			SecretKey:      os.Getenv("S3_SECRET_KEY"),
+			UseSSL:         envString("S3_USE_SSL", "true") == "true",
+			Presign:        envString("S3_URL_MODE", "proxy") == "presign",
+			PresignExpires: time.Duration(envInt("S3_PRESIGN_MINUTES", 60)) * time.Minute,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+}
+
+// contentTypeForKey guesses a stored file's content type from its extension
+func contentTypeForKey(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// validStorageKey rejects keys that could escape the upload directory or bucket prefix
+func validStorageKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
+
+// LocalStorage keeps uploads in a directory on the server's disk
+type LocalStorage struct {
+	Dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	if !validStorageKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+func (s *LocalStorage) Put(key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that readers never see a partial file
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrStoredFileNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) Exists(key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return "/uploads/" + key
+}
+
+func (s *LocalStorage) List(fn func(StoredFile) error) error {
+	entries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := fn(StoredFile{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadsHandler serves /uploads/{key} from the configured storage backend. Backends that hand
+// out presigned URLs never send browsers here, but the route still works for old links.
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if !validStorageKey(key) {
+		Error404Handler(w, r)
+		return
+	}
+
+	if local, ok := Store.(*LocalStorage); ok {
+		http.ServeFile(w, r, filepath.Join(local.Dir, key))
+		return
+	}
+
+	file, err := Store.Get(key)
+	if err == ErrStoredFileNotFound {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error reading stored file %s: %v", key, err)
+		Error500Handler(w, r)
+		return
+	}
+	defer file.Close()
+
+	// Keys are unique per upload, so their content never changes
+	w.Header().Set("Content-Type", contentTypeForKey(key))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Error serving stored file %s: %v", key, err)
+	}
+}
+
+// MigrationSummary counts what CopyStorage did
+type MigrationSummary struct {
+	Copied  int
+	Skipped int
+	Filled  int
+}
+
+// CopyStorage copies every file from one backend to another, skipping files the destination
+// already has. Images uploaded before variants were generated only have their full file;
+// copying fills in their missing variants with that file, since remote backends are never
+// asked whether a variant exists.
+func CopyStorage(from, to Storage, dryRun bool, progress func(key string)) (MigrationSummary, error) {
+	var summary MigrationSummary
+	keys := make(map[string]bool)
+	var files []StoredFile
+	err := from.List(func(f StoredFile) error {
+		keys[f.Key] = true
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	// copyFile copies src to dst unless the destination already has dst
+	copyFile := func(src, dst string, size int64) (bool, error) {
+		exists, err := to.Exists(dst)
+		if err != nil || exists {
+			return false, err
+		}
+		if progress != nil {
+			progress(dst)
+		}
+		if dryRun {
+			return true, nil
+		}
+		r, err := from.Get(src)
+		if err != nil {
+			return false, err
+		}
+		defer r.Close()
+		return true, to.Put(dst, r, size, contentTypeForKey(dst))
+	}
+
+	for _, f := range files {
+		copied, err := copyFile(f.Key, f.Key, f.Size)
+		if err != nil {
+			return summary, fmt.Errorf("copying %s: %w", f.Key, err)
+		}
+		if copied {
+			summary.Copied++
+		} else {
+			summary.Skipped++
+		}
+
+		if !isFullVariantKey(f.Key) {
+			continue
+		}
+		for variant := range imageVariantSizes {
+			name := variantFilename(f.Key, variant)
+			if keys[name] {
+				continue
+			}
+			filled, err := copyFile(f.Key, name, f.Size)
+			if err != nil {
+				return summary, fmt.Errorf("copying %s as %s: %w", f.Key, name, err)
+			}
+			if filled {
+				summary.Filled++
+			}
+		}
+	}
+	return summary, nil
+}
+
+// isFullVariantKey reports whether a key names the full variant of an upload rather than a smaller size
+func isFullVariantKey(key string) bool {
+	return imageFilenameForKey(key) == key
+}
+
+// imageFilenameForKey returns the filename of the image a stored variant belongs to
+func imageFilenameForKey(key string) string {
+	ext := path.Ext(key)
+	base := strings.TrimSuffix(key, ext)
+	for variant := range imageVariantSizes {
+		if variant != ImageFull && strings.HasSuffix(base, "_"+string(variant)) {
+			return strings.TrimSuffix(base, "_"+string(variant)) + ext
+		}
+	}
+	return key
+}
@@ -0,0 +1,156 @@
+package RebootForums
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config configures an S3-compatible storage backend
+type S3Config struct {
+	Endpoint  string // host[:port] of the S3 API, e.g. s3.amazonaws.com
+	Bucket    string
+	Prefix    string // prepended to every key, e.g. "forum/uploads"
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Presign makes URL return presigned links to the bucket instead of /uploads/ URLs
+	// proxied through the forum, which suits private buckets without a CDN
+	Presign        bool
+	PresignExpires time.Duration
+}
+
+// S3Storage keeps uploads in a bucket of an S3-compatible object store
+type S3Storage struct {
+	client *minio.Client
+	config S3Config
+}
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("S3 storage needs S3_ENDPOINT and S3_BUCKET")
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to S3: %w", err)
+	}
+	return &S3Storage{client: client, config: config}, nil
+}
+
+// object returns the object name a key is stored under
+func (s *S3Storage) object(key string) (string, error) {
+	if !validStorageKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	if s.config.Prefix == "" {
+		return key, nil
+	}
+	return s.config.Prefix + "/" + key, nil
+}
+
+// isNoSuchKey reports whether an S3 error means the object doesn't exist
+func isNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == minio.NoSuchKey
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, size int64, contentType string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(context.Background(), s.config.Bucket, object, r, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.config.Bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; stat the object so missing keys are reported here rather than on the first read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNoSuchKey(err) {
+			return nil, ErrStoredFileNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	object, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	// S3 doesn't report an error for deleting a missing object
+	return s.client.RemoveObject(context.Background(), s.config.Bucket, object, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Exists(key string) (bool, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.client.StatObject(context.Background(), s.config.Bucket, object, minio.StatObjectOptions{})
+	if isNoSuchKey(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Storage) URL(key string) string {
+	if s.config.Presign {
+		if object, err := s.object(key); err == nil {
+			u, err := s.client.PresignedGetObject(context.Background(), s.config.Bucket, object, s.config.PresignExpires, nil)
+			if err == nil {
+				return u.String()
+			}
+		}
+	}
+	return "/uploads/" + key
+}
+
+func (s *S3Storage) List(fn func(StoredFile) error) error {
+	prefix := ""
+	if s.config.Prefix != "" {
+		prefix = s.config.Prefix + "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for info := range s.client.ListObjects(ctx, s.config.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		key := strings.TrimPrefix(info.Key, prefix)
+		// Skip "directories" below the prefix, which the forum never creates
+		if !validStorageKey(key) {
+			continue
+		}
+		if err := fn(StoredFile{Key: key, Size: info.Size, ModTime: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
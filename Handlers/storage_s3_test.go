@@ -0,0 +1,164 @@
+package RebootForums
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// testS3Storage connects to the S3-compatible store named by S3_TEST_ENDPOINT, e.g. a local
+// MinIO, and returns a storage under a prefix of its own that is emptied after the test.
+// The test is skipped when S3_TEST_ENDPOINT isn't set.
+func testS3Storage(t *testing.T) *S3Storage {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("set S3_TEST_ENDPOINT, S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY to test S3 storage")
+	}
+	store, err := NewS3Storage(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    envString("S3_TEST_BUCKET", "reboot-forums-test"),
+		Prefix:    fmt.Sprintf("test-%d/uploads", time.Now().UnixNano()),
+		Region:    envString("S3_TEST_REGION", "us-east-1"),
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		UseSSL:    envString("S3_TEST_USE_SSL", "false") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exists, err := store.client.BucketExists(ctx, store.config.Bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		if err := store.client.MakeBucket(ctx, store.config.Bucket, minio.MakeBucketOptions{Region: store.config.Region}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, key := range listedKeys(t, store) {
+			if err := store.Delete(key); err != nil {
+				t.Errorf("cleaning up %s: %v", key, err)
+			}
+		}
+	})
+	return store
+}
+
+// listedKeys returns the sorted keys of a storage
+func listedKeys(t *testing.T, s Storage) []string {
+	t.Helper()
+	var keys []string
+	if err := s.List(func(f StoredFile) error {
+		keys = append(keys, f.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readStored returns the content of a stored file
+func readStored(t *testing.T, s Storage, key string) string {
+	t.Helper()
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("getting %s: %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestS3Storage(t *testing.T) {
+	store := testS3Storage(t)
+
+	for _, key := range []string{"a.png", "b.txt"} {
+		if err := store.Put(key, strings.NewReader("content of "+key), int64(len("content of "+key)), contentTypeForKey(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readStored(t, store, "a.png"); got != "content of a.png" {
+		t.Errorf("Get = %q", got)
+	}
+	if exists, err := store.Exists("a.png"); err != nil || !exists {
+		t.Errorf("Exists(a.png) = %v, %v", exists, err)
+	}
+	if keys := listedKeys(t, store); !reflect.DeepEqual(keys, []string{"a.png", "b.txt"}) {
+		t.Errorf("List = %q, want only the keys under the prefix", keys)
+	}
+
+	if err := store.Delete("a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.Exists("a.png"); err != nil || exists {
+		t.Errorf("Exists after Delete = %v, %v", exists, err)
+	}
+	if _, err := store.Get("a.png"); err != ErrStoredFileNotFound {
+		t.Errorf("Get of a missing key = %v, want ErrStoredFileNotFound", err)
+	}
+	if err := store.Delete("a.png"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+	if err := store.Put("../escape.png", strings.NewReader(""), 0, "image/png"); err == nil {
+		t.Error("stored a key outside the prefix")
+	}
+}
+
+func TestCopyStorageToS3AndBack(t *testing.T) {
+	store := testS3Storage(t)
+	local := NewLocalStorage(t.TempDir())
+	// An image uploaded before variants were generated, and one with every variant
+	for _, key := range []string{"old.png", "new.png", "new_thumb.png", "new_feed.png"} {
+		if err := local.Put(key, strings.NewReader("content of "+key), int64(len("content of "+key)), contentTypeForKey(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := CopyStorage(local, store, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MigrationSummary{Copied: 4, Filled: 2}); summary != want {
+		t.Errorf("copying to S3: %+v, want %+v", summary, want)
+	}
+	// Copying again skips what is already there
+	if summary, err := CopyStorage(local, store, false, nil); err != nil || summary != (MigrationSummary{Skipped: 4}) {
+		t.Errorf("copying to S3 again: %+v, %v", summary, err)
+	}
+
+	back := NewLocalStorage(t.TempDir())
+	if summary, err := CopyStorage(store, back, false, nil); err != nil || summary != (MigrationSummary{Copied: 6}) {
+		t.Errorf("copying back: %+v, %v", summary, err)
+	}
+	want := map[string]string{
+		"old.png":       "content of old.png",
+		"old_thumb.png": "content of old.png",
+		"old_feed.png":  "content of old.png",
+		"new.png":       "content of new.png",
+		"new_thumb.png": "content of new_thumb.png",
+		"new_feed.png":  "content of new_feed.png",
+	}
+	got := map[string]string{}
+	for _, key := range listedKeys(t, back) {
+		got[key] = readStored(t, back, key)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after the round trip:\n got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,368 @@
+package RebootForums
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenPrefix        = "rfpat_"
+	MaxAccessTokenNameLength = 50
+)
+
+// Access token scopes. Read access is implied by every token; write allows creating
+// posts, comments and likes; moderate allows moderation actions for users with a moderator role.
+const (
+	ScopeRead     = "read"
+	ScopeWrite    = "write"
+	ScopeModerate = "moderate"
+)
+
+// AccessTokenScopes lists the scopes a token can be given, in display order
+var AccessTokenScopes = []string{ScopeRead, ScopeWrite, ScopeModerate}
+
+// accessTokenExpiryDays are the lifetimes offered on the tokens page; 0 means the token never expires
+var accessTokenExpiryDays = []int{7, 30, 90, 365, 0}
+
+// generateAccessToken returns a new random personal access token
+func generateAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return accessTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// hashAccessToken returns the SHA-256 hash stored in place of a token
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes validates the submitted scopes and returns them in canonical order.
+// Read is always included.
+func parseScopes(values []string) ([]string, bool) {
+	requested := map[string]bool{ScopeRead: true}
+	for _, v := range values {
+		valid := false
+		for _, scope := range AccessTokenScopes {
+			if v == scope {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, false
+		}
+		requested[v] = true
+	}
+
+	var scopes []string
+	for _, scope := range AccessTokenScopes {
+		if requested[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, true
+}
+
+// CreateAccessToken stores the hash of a new token for the user and returns the token itself,
+// which is never shown again. A zero expiresAt creates a token that doesn't expire.
+func CreateAccessToken(userID int, name string, scopes []string, expiresAt time.Time) (string, error) {
+	token, err := generateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	var expiry sql.NullTime
+	if !expiresAt.IsZero() {
+		expiry = sql.NullTime{Time: expiresAt, Valid: true}
+	}
+	_, err = DB.Exec(`
+        INSERT INTO access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, userID, name, hashAccessToken(token), strings.Join(scopes, ","), time.Now(), expiry)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeAccessToken revokes one of the user's tokens. Revoking a token twice is not an error.
+func RevokeAccessToken(userID, tokenID int) error {
+	result, err := DB.Exec(`
+        UPDATE access_tokens SET revoked_at = COALESCE(revoked_at, ?)
+        WHERE id = ? AND user_id = ?
+    `, time.Now(), tokenID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// scanAccessToken reads a row selected with the columns of accessTokenColumns
+func scanAccessToken(row interface{ Scan(...interface{}) error }) (AccessToken, error) {
+	var t AccessToken
+	var scopes string
+	var lastUsed, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &lastUsed, &expiresAt, &revokedAt)
+	if err != nil {
+		return t, err
+	}
+	if scopes != "" {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	t.LastUsedAt = lastUsed.Time
+	t.ExpiresAt = expiresAt.Time
+	t.RevokedAt = revokedAt.Time
+	return t, nil
+}
+
+const accessTokenColumns = "id, user_id, name, scopes, created_at, last_used_at, expires_at, revoked_at"
+
+// GetAccessTokens lists a user's tokens, newest first
+func GetAccessTokens(userID int) ([]AccessToken, error) {
+	rows, err := DB.Query(`
+        SELECT `+accessTokenColumns+`
+        FROM access_tokens
+        WHERE user_id = ?
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []AccessToken
+	for rows.Next() {
+		t, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, if any
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[len("Bearer "):])
+}
+
+// GetUserFromAccessToken resolves the user and token of the request's bearer token.
+// It returns a nil user when the request carries no token or the token is unknown, expired or revoked.
+func GetUserFromAccessToken(r *http.Request) (*User, *AccessToken, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil, nil
+	}
+
+	row := DB.QueryRow("SELECT "+accessTokenColumns+" FROM access_tokens WHERE token_hash = ?", hashAccessToken(token))
+	accessToken, err := scanAccessToken(row)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	} else if err != nil {
+		log.Printf("Database error when fetching access token: %v", err)
+		return nil, nil, err
+	}
+	if !accessToken.IsActive() {
+		return nil, nil, nil
+	}
+
+	_, err = DB.Exec("UPDATE access_tokens SET last_used_at = ? WHERE id = ?", time.Now(), accessToken.ID)
+	if err != nil {
+		log.Printf("Error updating access token usage: %v", err)
+	}
+
+	user, err := GetUserByID(accessToken.UserID)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	applyTokenScopes(user, &accessToken)
+	return user, &accessToken, nil
+}
+
+// requiredScope is the scope a token needs to make a request to the website:
+// the moderation pages need moderate, reading other pages needs read, and anything
+// that changes data needs write
+func requiredScope(r *http.Request) string {
+	if r.URL.Path == "/mod" || strings.HasPrefix(r.URL.Path, "/mod/") {
+		return ScopeModerate
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	default:
+		return ScopeWrite
+	}
+}
+
+// getUserFromBearerToken is the bearer-token counterpart of the session cookie lookup.
+// A token without the scope the request needs authenticates no one.
+func getUserFromBearerToken(r *http.Request) (*User, error) {
+	user, token, err := GetUserFromAccessToken(r)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if !token.HasScope(requiredScope(r)) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// applyTokenScopes limits a token-authenticated user to what the token grants:
+// without the moderate scope, moderators and admins act as regular members
+func applyTokenScopes(user *User, token *AccessToken) {
+	if !token.HasScope(ScopeModerate) {
+		user.Role = RoleMember
+	}
+}
+
+// TokensHandler lets a logged-in user list and create personal access tokens.
+// Tokens can only be managed from a browser session, never with another token.
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := sessionUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var newToken, message string
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		newToken, message, err = handleCreateToken(r, user)
+		if err != nil {
+			log.Printf("Error creating access token: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	default:
+		Error404Handler(w, r)
+		return
+	}
+
+	tokens, err := GetAccessTokens(user.ID)
+	if err != nil {
+		log.Printf("Error fetching access tokens: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := struct {
+		Username   string
+		LoggedIn   bool
+		Tokens     []AccessToken
+		Scopes     []string
+		ExpiryDays []int
+		NewToken   string
+		Message    string
+	}{
+		Username:   user.Username,
+		LoggedIn:   true,
+		Tokens:     tokens,
+		Scopes:     AccessTokenScopes,
+		ExpiryDays: accessTokenExpiryDays,
+		NewToken:   newToken,
+		Message:    message,
+	}
+
+	err = RenderTemplate(w, "tokens.html", data)
+	if err != nil {
+		log.Printf("Error rendering tokens template: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+}
+
+// handleCreateToken validates the create form and returns the new token,
+// or a message explaining why the form was rejected
+func handleCreateToken(r *http.Request, user *User) (token, message string, err error) {
+	if err := r.ParseForm(); err != nil {
+		return "", "Invalid form submission", nil
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > MaxAccessTokenNameLength {
+		return "", "Token name must be between 1 and 50 characters", nil
+	}
+
+	scopes, ok := parseScopes(r.Form["scopes"])
+	if !ok {
+		return "", "Unknown token scope", nil
+	}
+
+	days, err := strconv.Atoi(r.FormValue("expires_in_days"))
+	validExpiry := err == nil
+	if validExpiry {
+		validExpiry = false
+		for _, d := range accessTokenExpiryDays {
+			if d == days {
+				validExpiry = true
+				break
+			}
+		}
+	}
+	if !validExpiry {
+		return "", "Invalid token expiry", nil
+	}
+	var expiresAt time.Time
+	if days > 0 {
+		expiresAt = time.Now().AddDate(0, 0, days)
+	}
+
+	token, err = CreateAccessToken(user.ID, name, scopes, expiresAt)
+	return token, "", err
+}
+
+// RevokeTokenHandler revokes one of the logged-in user's tokens (/tokens/revoke/{id})
+func RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := sessionUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(r.URL.Path[len("/tokens/revoke/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	err = RevokeAccessToken(user.ID, tokenID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error revoking access token: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+}
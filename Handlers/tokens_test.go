@@ -0,0 +1,143 @@
+package RebootForums
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+		ok     bool
+	}{
+		{"read is implied", nil, []string{ScopeRead}, true},
+		{"write", []string{ScopeWrite}, []string{ScopeRead, ScopeWrite}, true},
+		{"canonical order", []string{ScopeModerate, ScopeRead, ScopeWrite}, []string{ScopeRead, ScopeWrite, ScopeModerate}, true},
+		{"duplicates", []string{ScopeWrite, ScopeWrite}, []string{ScopeRead, ScopeWrite}, true},
+		{"unknown scope", []string{ScopeWrite, "admin"}, nil, false},
+		{"case matters", []string{"Write"}, nil, false},
+		{"empty scope", []string{""}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseScopes(tt.values)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseScopes(%q) = %q, %v; want %q, %v", tt.values, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/", ScopeRead},
+		{"HEAD", "/post/1", ScopeRead},
+		{"OPTIONS", "/api/posts", ScopeRead},
+		{"POST", "/create-post", ScopeWrite},
+		{"PUT", "/api/posts/1", ScopeWrite},
+		{"DELETE", "/api/comments/1", ScopeWrite},
+		{"GET", "/mod", ScopeModerate},
+		{"POST", "/mod/reports/1", ScopeModerate},
+		{"GET", "/moderators", ScopeRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := requiredScope(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyTokenScopes(t *testing.T) {
+	tests := []struct {
+		role   string
+		scopes []string
+		want   string
+	}{
+		{RoleMember, []string{ScopeRead}, RoleMember},
+		{RoleMember, []string{ScopeRead, ScopeModerate}, RoleMember},
+		{RoleModerator, []string{ScopeRead, ScopeWrite}, RoleMember},
+		{RoleModerator, []string{ScopeRead, ScopeModerate}, RoleModerator},
+		{RoleAdmin, []string{ScopeRead}, RoleMember},
+		{RoleAdmin, []string{ScopeRead, ScopeWrite, ScopeModerate}, RoleAdmin},
+	}
+	for _, tt := range tests {
+		user := &User{Role: tt.role}
+		applyTokenScopes(user, &AccessToken{Scopes: tt.scopes})
+		if user.Role != tt.want {
+			t.Errorf("a %s with scopes %q acts as a %s, want %s", tt.role, tt.scopes, user.Role, tt.want)
+		}
+	}
+}
+
+func TestGetUserFromBearerToken(t *testing.T) {
+	useTestDB(t)
+	userID := createTestUser(t, "mod")
+	if _, err := DB.Exec("UPDATE users SET role = ? WHERE id = ?", RoleModerator, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := func(scopes []string, expiresAt time.Time) string {
+		token, err := CreateAccessToken(userID, "test", scopes, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	read := newToken([]string{ScopeRead}, time.Time{})
+	write := newToken([]string{ScopeRead, ScopeWrite}, time.Now().Add(time.Hour))
+	moderate := newToken([]string{ScopeRead, ScopeModerate}, time.Time{})
+	expired := newToken([]string{ScopeRead, ScopeWrite}, time.Now().Add(-time.Minute))
+	revoked := newToken([]string{ScopeRead, ScopeWrite}, time.Time{})
+	var revokedID int
+	if err := DB.QueryRow("SELECT id FROM access_tokens WHERE token_hash = ?", hashAccessToken(revoked)).Scan(&revokedID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeAccessToken(userID, revokedID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		method, path string
+		wantRole     string // empty when the request must not be authenticated
+	}{
+		{"read token reads", read, "GET", "/", RoleMember},
+		{"read token can't write", read, "POST", "/create-post", ""},
+		{"write token writes", write, "POST", "/create-post", RoleMember},
+		{"write token can't moderate", write, "GET", "/mod", ""},
+		{"moderate token moderates", moderate, "POST", "/mod/reports/1", RoleModerator},
+		{"moderate token can't write", moderate, "POST", "/create-post", ""},
+		{"expired token", expired, "GET", "/", ""},
+		{"revoked token", revoked, "GET", "/", ""},
+		{"unknown token", "rf_unknown", "GET", "/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			user, err := getUserFromBearerToken(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.wantRole == "" && user != nil:
+				t.Errorf("authenticated %s", user.Username)
+			case tt.wantRole != "" && user == nil:
+				t.Errorf("not authenticated")
+			case user != nil && user.Role != tt.wantRole:
+				t.Errorf("acts as a %s, want %s", user.Role, tt.wantRole)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// uploadLimiter limits how many files each IP address and each user can upload a minute
+var uploadLimiter = newRateLimiter(UploadRatePerMinute, UploadRateBurst)
+
+// uploadLimitError is returned when an upload is refused by a rate limit or quota
+type uploadLimitError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *uploadLimitError) Error() string {
+	return e.message
+}
+
+// checkUploadLimits checks that a user may upload files right now: each file must be an image
+// type ImageHandler accepts within MaxImageSize, the files must fit the user's daily quota and
+// the upload rate limit. The rate limit is charged last, so uploads that are refused for any
+// other reason don't use it up.
+func checkUploadLimits(r *http.Request, user *User, files []*multipart.FileHeader) error {
+	var size int64
+	for _, fh := range files {
+		if err := checkUploadFile(fh); err != nil {
+			return err
+		}
+		size += fh.Size
+	}
+	if err := checkUploadQuota(user.ID, len(files), size); err != nil {
+		return err
+	}
+
+	ok, wait := uploadLimiter.allow(len(files), "ip:"+clientIP(r), "user:"+strconv.Itoa(user.ID))
+	if !ok && wait == 0 {
+		return fmt.Errorf("at most %d files can be uploaded at once", UploadRateBurst)
+	}
+	if !ok {
+		return &uploadLimitError{
+			message:    "You are uploading files too quickly.",
+			retryAfter: wait,
+		}
+	}
+	return nil
+}
+
+// checkUploadFile checks an uploaded file's size and, from the start of its content, its type
+// before it is handed to ImageHandler
+func checkUploadFile(fh *multipart.FileHeader) error {
+	if fh.Size > MaxImageSize {
+		return fmt.Errorf("image is too large (max %d MB)", MaxImageSize/(1024*1024))
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	_, err = detectImageType(head[:n])
+	return err
+}
+
+// checkUploadQuota checks a user's uploads of the past 24 hours against the daily quotas
+func checkUploadQuota(userID, count int, size int64) error {
+	if DailyUploadCount <= 0 && DailyUploadBytes <= 0 {
+		return nil
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	var used int
+	var usedBytes int64
+	err := DB.QueryRow(`
+        SELECT COUNT(*), COALESCE(SUM(size), 0) FROM upload_log WHERE user_id = ? AND created_at > ?
+    `, userID, since).Scan(&used, &usedBytes)
+	if err != nil {
+		return err
+	}
+
+	var message string
+	if DailyUploadCount > 0 && used+count > DailyUploadCount {
+		message = fmt.Sprintf("You can upload at most %d images a day, and have uploaded %d.", DailyUploadCount, used)
+	} else if DailyUploadBytes > 0 && usedBytes+size > DailyUploadBytes {
+		message = fmt.Sprintf("You can upload at most %d MB a day, and have uploaded %.1f MB.",
+			DailyUploadBytes/(1024*1024), float64(usedBytes)/(1024*1024))
+	} else {
+		return nil
+	}
+
+	// Room frees up as the oldest upload of the window drops out of it
+	retryAfter := 24 * time.Hour
+	var oldest time.Time
+	err = DB.QueryRow(`
+        SELECT created_at FROM upload_log WHERE user_id = ? AND created_at > ? ORDER BY created_at LIMIT 1
+    `, userID, since).Scan(&oldest)
+	if err == nil {
+		retryAfter = time.Until(oldest.Add(24 * time.Hour))
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return &uploadLimitError{message: message, retryAfter: retryAfter}
+}
+
+// storeUpload runs an uploaded file through ImageHandler and counts it towards the user's
+// daily quota. The caller owns the reference ImageHandler takes to the image.
+func storeUpload(user *User, fh *multipart.FileHeader) (string, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	filename, err := ImageHandler(file, fh)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := recordUpload(user.ID, filename, fh.Size); err != nil {
+		releaseImageFiles(filename)
+		return "", err
+	}
+	return filename, nil
+}
+
+// recordUpload counts an upload towards a user's daily quota
+func recordUpload(userID int, filename string, size int64) error {
+	_, err := DB.Exec("INSERT INTO upload_log (user_id, filename, size, created_at) VALUES (?, ?, ?, ?)",
+		userID, filename, size, time.Now())
+	return err
+}
+
+// handleUploadError serves the error page for a failed upload
+func handleUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var limitErr *uploadLimitError
+	if errors.As(err, &limitErr) {
+		Error429Handler(w, r, limitErr.message, limitErr.retryAfter)
+		return
+	}
+	Error400Handler(w, r)
+}
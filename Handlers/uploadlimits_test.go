@@ -0,0 +1,86 @@
+package RebootForums
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+// testUploads returns the headers of files uploaded with the given contents, as a handler sees them
+func testUploads(t *testing.T, contents ...[]byte) []*multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, content := range contents {
+		part, err := mw.CreateFormFile("images", "upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	mw.Close()
+
+	form, err := multipart.NewReader(&body, mw.Boundary()).ReadForm(32 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["images"]
+}
+
+func TestCheckUploadLimits(t *testing.T) {
+	useTestDB(t)
+	for _, setting := range []*int{&UploadRateBurst, &DailyUploadCount} {
+		previous := *setting
+		t.Cleanup(func() { *setting = previous })
+	}
+	previousLimiter := uploadLimiter
+	t.Cleanup(func() { uploadLimiter = previousLimiter })
+	UploadRateBurst = 2
+	DailyUploadCount = 3
+	uploadLimiter = newRateLimiter(1, UploadRateBurst)
+
+	uploader := createTestUser(t, "uploader")
+	quotaUsed := createTestUser(t, "busy")
+	for i := 0; i < DailyUploadCount; i++ {
+		if err := recordUpload(quotaUsed, "old.png", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	image := testPNG(t, color.White)
+	text := []byte("just some text")
+
+	// Every step uploads from the same IP address, so each refused step would use up the
+	// address's burst if it were charged
+	tests := []struct {
+		name      string
+		user      int
+		files     [][]byte
+		wantLimit bool // refused by the quota or rate limit rather than as invalid
+		wantErr   bool
+	}{
+		{name: "not an image", user: uploader, files: [][]byte{text}, wantErr: true},
+		{name: "one file not an image", user: uploader, files: [][]byte{image, text}, wantErr: true},
+		{name: "over the daily quota", user: quotaUsed, files: [][]byte{image, image}, wantLimit: true, wantErr: true},
+		{name: "more than the burst at once", user: uploader, files: [][]byte{image, image, image}, wantErr: true},
+		{name: "the whole burst", user: uploader, files: [][]byte{image, image}},
+		{name: "rate limited", user: uploader, files: [][]byte{image}, wantLimit: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/create-post", nil)
+		err := checkUploadLimits(r, &User{ID: tt.user}, testUploads(t, tt.files...))
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: got error %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+		var limitErr *uploadLimitError
+		if isLimit := errors.As(err, &limitErr); isLimit != tt.wantLimit {
+			t.Errorf("%s: got %v, want a quota or rate limit error: %v", tt.name, err, tt.wantLimit)
+		} else if isLimit && limitErr.retryAfter <= 0 {
+			t.Errorf("%s: no time to retry after", tt.name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUserAgentLength is how much of a browser's User-Agent header is stored with its session
+const maxUserAgentLength = 512
+
+// sessionTouchInterval is how often a session's activity is written back, so that every
+// request doesn't have to update the database
+const sessionTouchInterval = time.Minute
+
+// hashSessionToken returns the SHA-256 hash stored in place of a session token
+func hashSessionToken(token string) string {
+	return hashAccessToken(token)
+}
+
+// sessionLifetimes returns how long a session lasts without activity, and how long it lasts at most
+func sessionLifetimes(remember bool) (idle, maxAge time.Duration) {
+	if remember {
+		return RememberMeIdleTimeout, RememberMeMaxAge
+	}
+	return SessionIdleTimeout, SessionMaxAge
+}
+
+// setSessionCookie sets the session cookie. Remembered sessions get a cookie that lasts until the
+// session's absolute expiry; other sessions end when the browser is closed.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, remember bool, expiry time.Time) {
+	cookie := &http.Cookie{
+		Name:     "session_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil, // Set Secure flag if using HTTPS
+		// Lax keeps the user logged in when following links from other sites, but the cookie
+		// isn't sent with cross-site form posts
+		SameSite: http.SameSiteLaxMode,
+	}
+	if remember {
+		cookie.Expires = expiry
+	}
+	http.SetCookie(w, cookie)
+}
+
+// startSession logs a user in: it creates a session for the browser of the request and sets
+// the session cookie. A session the browser already had is ended, so a token planted in the
+// browser before logging in never gains the user's privileges.
+func startSession(w http.ResponseWriter, r *http.Request, userID int, remember bool) error {
+	if c, err := r.Cookie("session_token"); err == nil {
+		if err := DeleteSession(c.Value); err != nil {
+			return err
+		}
+	}
+
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+	expiry, err := UpsertSession(&userID, sessionToken, false, remember, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, sessionToken, remember, expiry)
+	return nil
+}
+
+// rotateSession gives the session of the request a new token and updates the cookie, so that
+// a copy of the old token stops working once the user's privileges change
+func rotateSession(w http.ResponseWriter, r *http.Request) error {
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return err
+	}
+	newToken, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+
+	var remember bool
+	var absoluteExpiry time.Time
+	err = DB.QueryRow("SELECT remember, absolute_expiry FROM sessions WHERE token_hash = ?",
+		hashSessionToken(c.Value)).Scan(&remember, &absoluteExpiry)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec("UPDATE sessions SET token_hash = ? WHERE token_hash = ?", hashSessionToken(newToken), hashSessionToken(c.Value))
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, newToken, remember, absoluteExpiry)
+	return nil
+}
+
+// GetUserSessions lists the unexpired sessions of a user, most recently active first.
+// The session with the token current is marked as the current one.
+func GetUserSessions(userID int, current string) ([]Session, error) {
+	rows, err := DB.Query(`
+        SELECT id, token_hash, user_agent, ip_address, created_at, last_activity
+        FROM sessions
+        WHERE user_id = ? AND is_guest = 0 AND expiry > ?
+        ORDER BY last_activity DESC
+    `, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		var tokenHash string
+		if err := rows.Scan(&s.ID, &tokenHash, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastActivity); err != nil {
+			return nil, err
+		}
+		s.Current = tokenHash == hashSessionToken(current)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession logs out one of the user's sessions
+func RevokeSession(userID, sessionID int) error {
+	result, err := DB.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs out every session of the user except the one with the token keep
+func RevokeOtherSessions(userID int, keep string) error {
+	_, err := DB.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", userID, hashSessionToken(keep))
+	return err
+}
+
+// userAgentBrowsers and userAgentSystems map User-Agent fragments to names, checked in order:
+// Edge and Opera also claim to be Chrome, and Chrome also claims to be Safari
+var userAgentBrowsers = []struct{ fragment, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var userAgentSystems = []struct{ fragment, name string }{
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+// describeUserAgent turns a User-Agent header into a short description such as "Firefox on Windows"
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	browser, system := "", ""
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(userAgent, b.fragment) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range userAgentSystems {
+		if strings.Contains(userAgent, s.fragment) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return "Browser on " + system
+	default:
+		return "Unknown browser"
+	}
+}
+
+// SessionsHandler lists the logged-in user's sessions (/settings/sessions)
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	c, _ := r.Cookie("session_token")
+	sessions, err := GetUserSessions(user.ID, c.Value)
+	if err != nil {
+		log.Printf("Error fetching sessions: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	data := struct {
+		Username      string
+		LoggedIn      bool
+		IsModerator   bool
+		Sessions      []Session
+		SingleSession bool
+		Revoked       bool
+	}{
+		Username:      user.Username,
+		LoggedIn:      true,
+		IsModerator:   user.IsModerator(),
+		Sessions:      sessions,
+		SingleSession: SingleSession,
+		Revoked:       r.URL.Query().Get("revoked") == "1",
+	}
+
+	err = RenderTemplate(w, "sessions.html", data)
+	if err != nil {
+		log.Printf("Error rendering sessions template: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// RevokeSessionHandler logs out one of the logged-in user's sessions (/settings/sessions/revoke/{id})
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	sessionID, err := strconv.Atoi(r.URL.Path[len("/settings/sessions/revoke/"):])
+	if err != nil {
+		Error400Handler(w, r)
+		return
+	}
+
+	err = RevokeSession(user.ID, sessionID)
+	if err == sql.ErrNoRows {
+		Error404Handler(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions?revoked=1", http.StatusSeeOther)
+}
+
+// RevokeOtherSessionsHandler logs out every session of the logged-in user except the current one
+// (/settings/sessions/revoke-others)
+func RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+	user := settingsUser(w, r)
+	if user == nil {
+		return
+	}
+
+	c, _ := r.Cookie("session_token")
+	if err := RevokeOtherSessions(user.ID, c.Value); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions?revoked=1", http.StatusSeeOther)
+}
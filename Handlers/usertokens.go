@@ -0,0 +1,102 @@
+package RebootForums
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Purposes of the single-use tokens sent to users by email
+const (
+	TokenEmailChange   = "email_change"
+	TokenVerifyEmail   = "verify_email"
+	TokenPasswordReset = "password_reset"
+)
+
+// ErrInvalidUserToken is returned for tokens that are unknown, already used or expired
+var ErrInvalidUserToken = errors.New("invalid or expired token")
+
+// generateUserToken returns a new random token for a confirmation link
+func generateUserToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createUserToken issues a token for purpose that expires after ttl. Unused tokens the user
+// already has for the same purpose stop working. Like access tokens, only a hash is stored.
+func createUserToken(db execer, userID int, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := generateUserToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = db.Exec("DELETE FROM user_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`
+        INSERT INTO user_tokens (user_id, purpose, token_hash, email, expires_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, userID, purpose, hashAccessToken(token), email, now.Add(ttl), now)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupUserToken returns the user and email address of a valid token for purpose without using it up
+func lookupUserToken(token, purpose string) (userID int, email string, err error) {
+	err = DB.QueryRow(`
+        SELECT user_id, email FROM user_tokens
+        WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+    `, hashAccessToken(token), purpose, time.Now()).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrInvalidUserToken
+	}
+	return userID, email, err
+}
+
+// consumeUserToken marks a token for purpose as used and returns the user and email address it
+// was issued for. A token can only be consumed once.
+func consumeUserToken(tx *sql.Tx, token, purpose string) (userID int, email string, err error) {
+	var id int
+	err = tx.QueryRow(`
+        SELECT id, user_id, email FROM user_tokens
+        WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+    `, hashAccessToken(token), purpose, time.Now()).Scan(&id, &userID, &email)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrInvalidUserToken
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	result, err := tx.Exec("UPDATE user_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), id)
+	if err != nil {
+		return 0, "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return 0, "", err
+	} else if affected == 0 {
+		return 0, "", ErrInvalidUserToken
+	}
+	return userID, email, nil
+}
+
+// pendingUserToken returns the email address of the user's newest unused and unexpired token for purpose
+func pendingUserToken(userID int, purpose string) (string, error) {
+	var email string
+	err := DB.QueryRow(`
+        SELECT email FROM user_tokens
+        WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+        ORDER BY created_at DESC LIMIT 1
+    `, userID, purpose, time.Now()).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
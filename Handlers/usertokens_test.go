@@ -0,0 +1,148 @@
+package RebootForums
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// consumeTestToken consumes a token in a transaction of its own
+func consumeTestToken(t *testing.T, token, purpose string) (int, string, error) {
+	t.Helper()
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	userID, email, err := consumeUserToken(tx, token, purpose)
+	if err == nil {
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return userID, email, err
+}
+
+func TestConsumeUserToken(t *testing.T) {
+	useTestDB(t)
+	userID := createTestUser(t, "member")
+	issue := func(purpose string, ttl time.Duration) string {
+		t.Helper()
+		token, err := createUserToken(DB, userID, purpose, "new@example.com", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	token := issue(TokenEmailChange, time.Hour)
+	if _, _, err := consumeTestToken(t, token, TokenVerifyEmail); err != ErrInvalidUserToken {
+		t.Errorf("consumed for another purpose: %v", err)
+	}
+	if gotUser, email, err := consumeTestToken(t, token, TokenEmailChange); err != nil || gotUser != userID || email != "new@example.com" {
+		t.Fatalf("consume = %d, %q, %v; want %d, new@example.com", gotUser, email, err, userID)
+	}
+	if _, _, err := consumeTestToken(t, token, TokenEmailChange); err != ErrInvalidUserToken {
+		t.Errorf("second consume: got %v, want ErrInvalidUserToken", err)
+	}
+
+	expired := issue(TokenVerifyEmail, -time.Minute)
+	if _, _, err := consumeTestToken(t, expired, TokenVerifyEmail); err != ErrInvalidUserToken {
+		t.Errorf("expired token: got %v, want ErrInvalidUserToken", err)
+	}
+	if _, _, err := lookupUserToken(expired, TokenVerifyEmail); err != ErrInvalidUserToken {
+		t.Errorf("looked up an expired token: %v", err)
+	}
+
+	if _, _, err := consumeTestToken(t, "unknown", TokenVerifyEmail); err != ErrInvalidUserToken {
+		t.Errorf("unknown token: got %v, want ErrInvalidUserToken", err)
+	}
+}
+
+func TestCreateUserTokenReplacesUnusedTokens(t *testing.T) {
+	useTestDB(t)
+	userID := createTestUser(t, "member")
+	other := createTestUser(t, "other")
+
+	older, err := createUserToken(DB, userID, TokenPasswordReset, "member@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify, err := createUserToken(DB, userID, TokenVerifyEmail, "member@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	othersReset, err := createUserToken(DB, other, TokenPasswordReset, "other@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := createUserToken(DB, userID, TokenPasswordReset, "member@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := lookupUserToken(older, TokenPasswordReset); err != ErrInvalidUserToken {
+		t.Errorf("the older reset token still works: %v", err)
+	}
+	for _, tt := range []struct{ token, purpose string }{
+		{newer, TokenPasswordReset},
+		{verify, TokenVerifyEmail},
+		{othersReset, TokenPasswordReset},
+	} {
+		if _, _, err := lookupUserToken(tt.token, tt.purpose); err != nil {
+			t.Errorf("a %s token stopped working: %v", tt.purpose, err)
+		}
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	useTestDB(t)
+	userID := createTestUser(t, "member")
+	other := createTestUser(t, "other")
+	for _, s := range []struct {
+		userID int
+		token  string
+	}{{userID, "laptop"}, {userID, "phone"}, {other, "other"}} {
+		if _, err := UpsertSession(&s.userID, s.token, false, false, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := createUserToken(DB, userID, TokenPasswordReset, "member@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResetPassword(token, "short", "short"); !isSettingsError(err) {
+		t.Fatalf("accepted a short password: %v", err)
+	}
+	if err := ResetPassword(token, "new password", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetPassword(token, "another password", "another password"); err != ErrInvalidUserToken {
+		t.Errorf("reset twice with one token: %v", err)
+	}
+
+	var hashed string
+	var verified bool
+	err = DB.QueryRow("SELECT password, email_verified_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&hashed, &verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte("new password")) != nil {
+		t.Error("the password wasn't changed")
+	}
+	if !verified {
+		t.Error("resetting by email didn't verify the email address")
+	}
+
+	for token, want := range map[string]bool{"laptop": false, "phone": false, "other": true} {
+		auth, err := lookupSession(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (auth != nil) != want {
+			t.Errorf("session %s logged in: %v, want %v", token, auth != nil, want)
+		}
+	}
+}
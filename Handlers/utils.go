@@ -1,25 +1,71 @@
 package RebootForums
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"strings"
 )
 
+// templateFuncs are the helper functions available to every template
+var templateFuncs = template.FuncMap{
+	"dict":       dict,
+	"imageURL":   imageURL,
+	"profileURL": profileURL,
+}
+
+// dict builds a map from alternating keys and values, so templates can pass several values to a sub-template
+func dict(values ...interface{}) (map[string]interface{}, error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("dict requires an even number of arguments")
+	}
+	m := make(map[string]interface{}, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		key, ok := values[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict keys must be strings")
+		}
+		m[key] = values[i+1]
+	}
+	return m, nil
+}
+
+// imageURL is GetImageURL for templates, e.g. {{imageURL .CoverImage "feed"}}
+func imageURL(filename, variant string) string {
+	return GetImageURL(filename, ImageVariant(variant))
+}
+
+// absoluteURL turns a path on this site into a full URL, based on SiteURL or the request
+func absoluteURL(r *http.Request, path string) string {
+	if SiteURL != "" {
+		return strings.TrimSuffix(SiteURL, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
 // RenderTemplate renders a template with the given data
 func RenderTemplate(w http.ResponseWriter, tmplName string, data interface{}) error {
-	tmpl, err := template.ParseFiles("templates/" + tmplName)
+	tmpl, err := template.New(tmplName).Funcs(templateFuncs).Funcs(csrfTemplateFuncs(w)).ParseFiles("templates/" + tmplName)
 	if err != nil {
 		log.Printf("Error parsing template: %v", err)
 		return fmt.Errorf("error parsing template: %v", err)
 	}
 
-	err = tmpl.Execute(w, data)
+	// Render the whole page before writing it, so templates can still set cookies,
+	// and a failing template doesn't leave half a page behind
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
 	if err != nil {
 		log.Printf("Error executing template: %v", err)
 		return fmt.Errorf("error executing template: %v", err)
 	}
 
-	return nil
+	_, err = buf.WriteTo(w)
+	return err
 }
@@ -0,0 +1,345 @@
+package RebootForums
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mailLimiter limits how many emails each IP address, user and recipient can trigger:
+// a burst of 3, then one a minute
+var mailLimiter = newRateLimiter(1, 3)
+
+// sendTokenEmail creates a token for purpose and emails the link to it. The link points
+// to path with the token in the query string.
+func sendTokenEmail(r *http.Request, userID int, purpose, email string, ttl time.Duration, path, subject, body string) error {
+	token, err := createUserToken(DB, userID, purpose, email, ttl)
+	if err != nil {
+		return err
+	}
+	link := absoluteURL(r, path+"?token="+url.QueryEscape(token))
+	return Mail.Send(Email{
+		To:      email,
+		Subject: subject,
+		Body:    strings.ReplaceAll(body, "{link}", link),
+	})
+}
+
+// sendVerificationEmail emails a new account the link that verifies its address
+func sendVerificationEmail(r *http.Request, user *User) error {
+	return sendTokenEmail(r, user.ID, TokenVerifyEmail, user.Email, VerifyEmailTTL, "/verify-email",
+		"Verify your email address",
+		fmt.Sprintf("Hi %s,\n\nWelcome to Reboot Forums! Open this link to verify your email address:\n\n{link}\n\n"+
+			"The link is valid for %s. Until you verify your address you can read the forum, but not post or comment.\n",
+			user.Username, formatWait(VerifyEmailTTL)))
+}
+
+// sendEmailChangeEmail emails the link that confirms a change of address to the new address
+func sendEmailChangeEmail(r *http.Request, user *User, email string) error {
+	return sendTokenEmail(r, user.ID, TokenEmailChange, email, EmailChangeTTL, "/settings/confirm-email",
+		"Confirm your new email address",
+		fmt.Sprintf("Hi %s,\n\nOpen this link to use this address for your Reboot Forums account:\n\n{link}\n\n"+
+			"The link is valid for %s. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, formatWait(EmailChangeTTL)))
+}
+
+// sendPasswordResetEmail emails a user the link that lets them choose a new password
+func sendPasswordResetEmail(r *http.Request, userID int, username, email string) error {
+	return sendTokenEmail(r, userID, TokenPasswordReset, email, PasswordResetTTL, "/reset-password",
+		"Reset your password",
+		fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your Reboot Forums account. "+
+			"Open this link to choose a new password:\n\n{link}\n\n"+
+			"The link is valid for %s and works once. If you didn't ask for this, you can ignore this email.\n",
+			username, formatWait(PasswordResetTTL)))
+}
+
+// allowMail checks the email rate limit for the request and writes a 429 page when it is exceeded
+func allowMail(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	ok, wait := mailLimiter.allow(1, append(keys, "ip:"+clientIP(r))...)
+	if !ok {
+		Error429Handler(w, r, "Too many emails have been requested.", wait)
+	}
+	return ok
+}
+
+// VerifyEmail uses an email verification token and marks the address it was sent to as verified.
+// Tokens sent to an address the user has since changed no longer verify anything.
+func VerifyEmail(token string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := consumeUserToken(tx, token, TokenVerifyEmail)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+        UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?)
+        WHERE id = ? AND email = ? AND deleted_at IS NULL
+    `, time.Now(), userID, email)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrInvalidUserToken
+	}
+	return tx.Commit()
+}
+
+// ResetPassword uses a password reset token to set a new password. Every session of the user is
+// logged out, and the address the link was sent to counts as verified.
+func ResetPassword(token, password, confirm string) error {
+	hashed, err := hashNewPassword(password, confirm)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := consumeUserToken(tx, token, TokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+        UPDATE users SET password = ?, email_verified_at = COALESCE(email_verified_at, ?)
+        WHERE id = ? AND email = ? AND deleted_at IS NULL
+    `, hashed, time.Now(), userID, email)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrInvalidUserToken
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// renderVerifyEmail shows the email verification page
+func renderVerifyEmail(w http.ResponseWriter, r *http.Request, user *User, verified bool, message string) {
+	data := struct {
+		LoggedIn      bool
+		Username      string
+		IsModerator   bool
+		Email         string
+		EmailVerified bool
+		Verified      bool
+		Sent          bool
+		Message       string
+	}{
+		LoggedIn:      user != nil,
+		IsModerator:   user.IsModerator(),
+		EmailVerified: user.CanPost(),
+		Verified:      verified,
+		Sent:          r.URL.Query().Get("sent") == "1",
+		Message:       message,
+	}
+	if user != nil {
+		data.Username = user.Username
+		data.Email = user.Email
+	}
+
+	err := RenderTemplate(w, "verify-email.html", data)
+	if err != nil {
+		log.Printf("Error rendering verify-email template: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// verifyEmailRequired tells a user who hasn't verified their email address yet that they can't post
+func verifyEmailRequired(w http.ResponseWriter, r *http.Request, user *User) {
+	w.WriteHeader(http.StatusForbidden)
+	renderVerifyEmail(w, r, user, false, "Please verify your email address before posting.")
+}
+
+// VerifyEmailHandler verifies an email address from the link sent to it (/verify-email?token=...).
+// Without a token it shows the logged-in user whether their address is verified.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		Error404Handler(w, r)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token != "" {
+		err := VerifyEmail(token)
+		if err == ErrInvalidUserToken {
+			w.WriteHeader(http.StatusBadRequest)
+			renderVerifyEmail(w, r, CurrentUser(r), false, "This link is invalid or has expired.")
+			return
+		} else if err != nil {
+			log.Printf("Error verifying email: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+
+	user := sessionUser(r)
+	if user == nil && token == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user != nil && token != "" {
+		// Reload the user, who may have just verified their own address
+		var err error
+		user, err = GetUserByID(user.ID)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+	}
+	renderVerifyEmail(w, r, user, token != "", "")
+}
+
+// ResendVerificationHandler sends the logged-in user a new verification link (/verify-email/resend)
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		Error404Handler(w, r)
+		return
+	}
+
+	user := sessionUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.EmailVerified {
+		http.Redirect(w, r, "/verify-email", http.StatusSeeOther)
+		return
+	}
+	if !allowMail(w, r, "user:"+strconv.Itoa(user.ID)) {
+		return
+	}
+
+	if err := sendVerificationEmail(r, user); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		Error500Handler(w, r)
+		return
+	}
+	http.Redirect(w, r, "/verify-email?sent=1", http.StatusSeeOther)
+}
+
+// ForgotPasswordHandler emails a password reset link to the account with the submitted address
+// (/forgot-password). The page looks the same whether or not an account uses the address.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Sent    bool
+		Message string
+	}{}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		email := strings.TrimSpace(r.FormValue("email"))
+		if email == "" {
+			data.Message = "Please enter your email address"
+			break
+		}
+		if !allowMail(w, r, "email:"+strings.ToLower(email)) {
+			return
+		}
+
+		var userID int
+		var username string
+		err := DB.QueryRow("SELECT id, username FROM users WHERE email = ? AND deleted_at IS NULL", email).Scan(&userID, &username)
+		if err == nil {
+			err = sendPasswordResetEmail(r, userID, username, email)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error sending password reset email: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		data.Sent = true
+	default:
+		Error404Handler(w, r)
+		return
+	}
+
+	err := RenderTemplate(w, "forgot-password.html", data)
+	if err != nil {
+		log.Printf("Error rendering forgot-password template: %v", err)
+		Error500Handler(w, r)
+	}
+}
+
+// ResetPasswordHandler lets a user choose a new password with the link from a password reset
+// email (/reset-password?token=...)
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	data := struct {
+		Token             string
+		Username          string
+		MinPasswordLength int
+		Message           string
+	}{
+		Token:             token,
+		MinPasswordLength: MinPasswordLength,
+	}
+
+	userID, _, err := lookupUserToken(token, TokenPasswordReset)
+	if err == ErrInvalidUserToken {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Token = ""
+		data.Message = "This link is invalid or has expired. You can ask for a new one below."
+	} else if err != nil {
+		log.Printf("Error looking up password reset token: %v", err)
+		Error500Handler(w, r)
+		return
+	} else {
+		user, err := GetUserByID(userID)
+		if err != nil {
+			log.Printf("Error fetching user: %v", err)
+			Error500Handler(w, r)
+			return
+		}
+		data.Username = user.Username
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			err := ResetPassword(token, r.FormValue("new_password"), r.FormValue("confirm_password"))
+			if err == nil {
+				http.Redirect(w, r, "/login?reset=true", http.StatusSeeOther)
+				return
+			} else if err == ErrInvalidUserToken {
+				w.WriteHeader(http.StatusBadRequest)
+				data.Token = ""
+				data.Message = "This link is invalid or has expired. You can ask for a new one below."
+			} else if isSettingsError(err) {
+				w.WriteHeader(http.StatusBadRequest)
+				data.Message = err.Error()
+			} else {
+				log.Printf("Error resetting password: %v", err)
+				Error500Handler(w, r)
+				return
+			}
+		default:
+			Error404Handler(w, r)
+			return
+		}
+	}
+
+	err = RenderTemplate(w, "reset-password.html", data)
+	if err != nil {
+		log.Printf("Error rendering reset-password template: %v", err)
+		Error500Handler(w, r)
+	}
+}
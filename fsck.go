@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	RebootForums "RebootForums/Handlers"
+	"RebootForums/migrations"
+)
+
+const fsckUsage = `usage: forum fsck [-db path] [-grace duration] [-quarantine | -delete]
+
+Compares the stored uploads with the images the database refers to. It lists
+files nothing refers to, images whose uploads were never saved with a post,
+and images posts refer to whose file is missing.
+
+By default nothing is changed. With -quarantine, orphaned files older than the
+grace period are moved to the .quarantine directory (or key prefix) of the
+storage backend; with -delete they are deleted.
+
+flags:
+`
+
+// runFsckCommand implements the "fsck" subcommand
+func runFsckCommand(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	dbPath := fs.String("db", "./forum.db", "path to the SQLite database")
+	grace := fs.Duration("grace", RebootForums.UploadGCGrace, "leave orphans younger than this alone")
+	quarantine := fs.Bool("quarantine", false, "move orphaned files to quarantine")
+	del := fs.Bool("delete", false, "delete orphaned files")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, fsckUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || (*quarantine && *del) {
+		fs.Usage()
+		return fmt.Errorf("expected at most one of -quarantine and -delete")
+	}
+
+	mode := RebootForums.GCReport
+	if *quarantine {
+		mode = RebootForums.GCQuarantine
+	} else if *del {
+		mode = RebootForums.GCDelete
+	}
+
+	if err := RebootForums.InitDB(*dbPath); err != nil {
+		return err
+	}
+	defer RebootForums.DB.Close()
+	if err := migrations.Up(RebootForums.DB); err != nil {
+		return err
+	}
+	if err := RebootForums.InitStorage(); err != nil {
+		return err
+	}
+
+	result, err := RebootForums.CheckUploads(mode, *grace)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range result.Orphans {
+		fmt.Printf("orphaned file   %s (%d bytes, %s)\n", f.Key, f.Size, f.ModTime.Format("2006-01-02 15:04"))
+	}
+	for _, filename := range result.Unattached {
+		fmt.Printf("unattached      %s\n", filename)
+	}
+	for _, missing := range result.Missing {
+		fmt.Printf("missing file    %s (posts %v, avatar of users %v)\n", missing.Filename, missing.PostIDs, missing.UserIDs)
+	}
+	fmt.Println(result.Summary())
+	return nil
+}
@@ -8,17 +8,43 @@ import (
 	"path/filepath"
 
 	RebootForums "RebootForums/Handlers"
+	"RebootForums/migrations"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// makeHandler wraps a page handler in the session middleware, which resolves the user of each
+// request before the handler runs, and the CSRF middleware, which checks every form submission
 func makeHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		fn(w, r)
-	}
+	return RebootForums.SessionMiddleware(RebootForums.CSRFMiddleware(fn))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if err := runRoleCommand(os.Args[2:]); err != nil {
+			log.Fatal("Setting role failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		if err := runFsckCommand(os.Args[2:]); err != nil {
+			log.Fatal("Checking uploads failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "storage" {
+		if err := runStorageCommand(os.Args[2:]); err != nil {
+			log.Fatal("Storage migration failed: ", err)
+		}
+		return
+	}
+
 	// Initialize database
 	err := RebootForums.InitDB("./forum.db")
 	if err != nil {
@@ -26,24 +52,39 @@ func main() {
 	}
 	defer RebootForums.DB.Close()
 
-	// Create tables
-	err = RebootForums.CreateTables()
+	// Apply any pending schema migrations
+	err = migrations.Up(RebootForums.DB)
+	if err != nil {
+		log.Fatal("Failed to apply migrations:", err)
+	}
+
+	// Create the full-text search index and backfill it for existing posts and comments
+	err = RebootForums.SetupSearchIndex()
+	if err != nil {
+		log.Fatal("Failed to set up search index:", err)
+	}
+
+	// Set up the storage backend uploads are kept in
+	err = RebootForums.InitStorage()
 	if err != nil {
-		log.Fatal("Failed to create tables:", err)
+		log.Fatal("Failed to set up upload storage:", err)
 	}
 
-	// Add this line to ensure the updated_at column exists
-	err = RebootForums.AddUpdatedAtColumn()
+	// Find the images uploaded before variants were generated
+	err = RebootForums.LoadImageVariants()
 	if err != nil {
-		log.Fatal("Failed to add updated_at column:", err)
+		log.Fatal("Failed to load image variants:", err)
 	}
 
-	// Add this line to ensure the image_filename column exists
-	err = RebootForums.AddImageFilenameToPostsTable()
+	// Set up the mailer verification and password reset emails are sent with
+	err = RebootForums.InitMailer()
 	if err != nil {
-		log.Fatal("Failed to add image_filename column:", err)
+		log.Fatal("Failed to set up mailer:", err)
 	}
 
+	// Clean up orphaned uploads in the background
+	RebootForums.StartUploadGC()
+
 	// Get the absolute path to the templates directory
 	templatesDir, err := filepath.Abs("./templates")
 	if err != nil {
@@ -58,24 +99,56 @@ func main() {
 	mux := http.NewServeMux()
 
 	// Set up routes
-	mux.HandleFunc("/", RebootForums.HomeHandler)
+	mux.HandleFunc("/", makeHandler(RebootForums.HomeHandler))
 	mux.HandleFunc("/register", makeHandler(RebootForums.RegisterHandler))
 	mux.HandleFunc("/login", makeHandler(RebootForums.LoginHandler))
 	mux.HandleFunc("/logout", makeHandler(RebootForums.LogoutHandler))
+	mux.HandleFunc("/search", makeHandler(RebootForums.SearchHandler))
 	// Post-related routes
 	mux.HandleFunc("/create-post", makeHandler(RebootForums.CreatePostFormHandler))
 	mux.HandleFunc("/post/", makeHandler(RebootForums.ViewPostHandler))
+	mux.HandleFunc("/edit-post/", makeHandler(RebootForums.EditPostHandler))
 	mux.HandleFunc("/delete-post/", makeHandler(RebootForums.DeletePostHandler))
 	mux.HandleFunc("/like-post", makeHandler(RebootForums.LikePostHandler))
 	mux.HandleFunc("/like-comment", makeHandler(RebootForums.LikeCommentHandler))
 	mux.HandleFunc("/add-comment", makeHandler(RebootForums.AddCommentHandler))
+	mux.HandleFunc("/reply-comment/", makeHandler(RebootForums.ReplyCommentHandler))
+	mux.HandleFunc("/edit-comment/", makeHandler(RebootForums.EditCommentHandler))
+	mux.HandleFunc("/delete-comment/", makeHandler(RebootForums.DeleteCommentHandler))
+	mux.HandleFunc("/tokens", makeHandler(RebootForums.TokensHandler))
+	mux.HandleFunc("/tokens/revoke/", makeHandler(RebootForums.RevokeTokenHandler))
+	mux.HandleFunc("/user/", makeHandler(RebootForums.ProfileHandler))
+	mux.HandleFunc("/profile", makeHandler(RebootForums.EditProfileHandler))
+	mux.HandleFunc("/settings", makeHandler(RebootForums.SettingsHandler))
+	mux.HandleFunc("/settings/password", makeHandler(RebootForums.ChangePasswordHandler))
+	mux.HandleFunc("/settings/email", makeHandler(RebootForums.ChangeEmailHandler))
+	mux.HandleFunc("/settings/confirm-email", makeHandler(RebootForums.ConfirmEmailHandler))
+	mux.HandleFunc("/settings/delete", makeHandler(RebootForums.DeleteAccountHandler))
+	mux.HandleFunc("/settings/sessions", makeHandler(RebootForums.SessionsHandler))
+	mux.HandleFunc("/settings/sessions/revoke/", makeHandler(RebootForums.RevokeSessionHandler))
+	mux.HandleFunc("/settings/sessions/revoke-others", makeHandler(RebootForums.RevokeOtherSessionsHandler))
+	mux.HandleFunc("/verify-email", makeHandler(RebootForums.VerifyEmailHandler))
+	mux.HandleFunc("/verify-email/resend", makeHandler(RebootForums.ResendVerificationHandler))
+	mux.HandleFunc("/forgot-password", makeHandler(RebootForums.ForgotPasswordHandler))
+	mux.HandleFunc("/reset-password", makeHandler(RebootForums.ResetPasswordHandler))
+	mux.HandleFunc("/mod", makeHandler(RebootForums.ModerationDashboardHandler))
+	mux.HandleFunc("/mod/post/", makeHandler(RebootForums.ModeratePostHandler))
+	mux.HandleFunc("/mod/comment/", makeHandler(RebootForums.ModerateCommentHandler))
+	mux.HandleFunc("/mod/set-role", makeHandler(RebootForums.SetRoleHandler))
+	mux.HandleFunc("/mod/report/", makeHandler(RebootForums.ResolveReportHandler))
+	mux.HandleFunc("/report-post/", makeHandler(RebootForums.ReportPostHandler))
+	mux.HandleFunc("/report-comment/", makeHandler(RebootForums.ReportCommentHandler))
+
+	// JSON API, authenticated with personal access tokens
+	mux.Handle("/api/v1/", RebootForums.APIHandler())
 	// Google and Github login Routes
-	mux.HandleFunc("/auth/google/login", RebootForums.GoogleLoginHandler)
-	mux.HandleFunc("/auth/google/callback", RebootForums.GoogleCallbackHandler)
-	mux.HandleFunc("/auth/github/login", RebootForums.GithubLoginHandler)
-	mux.HandleFunc("/auth/github/callback", RebootForums.GithubCallbackHandler)
+	mux.HandleFunc("/auth/google/login", makeHandler(RebootForums.GoogleLoginHandler))
+	mux.HandleFunc("/auth/google/callback", makeHandler(RebootForums.GoogleCallbackHandler))
+	mux.HandleFunc("/auth/github/login", makeHandler(RebootForums.GithubLoginHandler))
+	mux.HandleFunc("/auth/github/callback", makeHandler(RebootForums.GithubCallbackHandler))
 	// Explicit error routes
 	mux.HandleFunc("/400", RebootForums.Error400Handler)
+	mux.HandleFunc("/403", RebootForums.Error403Handler)
 	mux.HandleFunc("/404", RebootForums.Error404Handler)
 	mux.HandleFunc("/500", RebootForums.Error500Handler)
 
@@ -83,16 +156,9 @@ func main() {
 	fs := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads"
-	err = os.MkdirAll(uploadsDir, os.ModePerm)
-	if err != nil {
-		log.Fatal("Failed to create uploads directory:", err)
-	}
-
-	// Serve uploaded files
-	uploadFS := http.FileServer(http.Dir(uploadsDir))
-	mux.Handle("/uploads/", http.StripPrefix("/uploads/", uploadFS))
+	// Serve uploaded files from the storage backend. Like static files, they don't need to know
+	// who is asking, so they skip the session middleware.
+	mux.HandleFunc("/uploads/", RebootForums.UploadsHandler)
 
 	// Start the server
 	fmt.Println("Server is running on http://localhost:8080")
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	RebootForums "RebootForums/Handlers"
+	"RebootForums/migrations"
+)
+
+const migrateUsage = `usage: forum migrate [-db path] <command>
+
+commands:
+  status        list migrations and whether they have been applied
+  up [version]  apply pending migrations, optionally only up to version
+  down [steps]  revert the most recent migration, or the given number of migrations
+`
+
+// runMigrateCommand implements the "migrate" subcommand
+func runMigrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dbPath := fs.String("db", "./forum.db", "path to the SQLite database")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, migrateUsage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing migrate command")
+	}
+
+	if err := RebootForums.InitDB(*dbPath); err != nil {
+		return err
+	}
+	defer RebootForums.DB.Close()
+	db := RebootForums.DB
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "status":
+		return printMigrationStatus(db)
+	case "up":
+		target, err := optionalIntArg(rest, 0)
+		if err != nil {
+			return err
+		}
+		if err := migrations.UpTo(db, target); err != nil {
+			return err
+		}
+		return printMigrationStatus(db)
+	case "down":
+		steps, err := optionalIntArg(rest, 1)
+		if err != nil {
+			return err
+		}
+		if err := migrations.Down(db, steps); err != nil {
+			return err
+		}
+		return printMigrationStatus(db)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate command %q", command)
+	}
+}
+
+func optionalIntArg(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", args[0])
+	}
+	return n, nil
+}
+
+func printMigrationStatus(db *sql.DB) error {
+	statuses, err := migrations.GetStatus(db)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-30s %s\n", s.Version, s.Name, state)
+	}
+	return nil
+}
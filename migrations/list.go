@@ -0,0 +1,611 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+)
+
+// defaultCategories are seeded into new databases
+var defaultCategories = []string{
+	"General Discussion",
+	"Technology",
+	"Sports",
+	"Entertainment",
+	"Science",
+	"Politics",
+	"Health",
+	"Education",
+	"Travel",
+	"Food",
+}
+
+// all is the ordered list of schema migrations. New migrations are appended with the next version number;
+// released migrations must never be edited.
+var all = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up: func(tx *sql.Tx) error {
+			err := execAll(tx,
+				`CREATE TABLE IF NOT EXISTS users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					username TEXT UNIQUE NOT NULL,
+					email TEXT UNIQUE NOT NULL,
+					password TEXT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS posts (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER,
+					title TEXT NOT NULL,
+					content TEXT NOT NULL,
+					image_filename TEXT,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS comments (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					post_id INTEGER,
+					user_id INTEGER,
+					content TEXT NOT NULL,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS categories (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT UNIQUE NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS post_categories (
+					post_id INTEGER,
+					category_id INTEGER,
+					PRIMARY KEY (post_id, category_id),
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					FOREIGN KEY (category_id) REFERENCES categories(id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS likes (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					post_id INTEGER,
+					comment_id INTEGER,
+					is_like BOOLEAN NOT NULL,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (post_id) REFERENCES posts(id),
+					FOREIGN KEY (comment_id) REFERENCES comments(id),
+					UNIQUE(user_id, post_id, comment_id)
+				)`,
+				`CREATE TABLE IF NOT EXISTS sessions (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER,
+					token TEXT UNIQUE NOT NULL,
+					expiry DATETIME NOT NULL,
+					is_guest BOOLEAN NOT NULL DEFAULT 0,
+					last_activity DATETIME NOT NULL,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+			)
+			if err != nil {
+				return err
+			}
+			// Databases created by early versions of the forum predate these columns
+			if err := addColumnIfMissing(tx, "posts", "updated_at", "DATETIME"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "posts", "image_filename", "TEXT"); err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "likes", "created_at", "DATETIME")
+		},
+		Down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				"DROP TABLE IF EXISTS sessions",
+				"DROP TABLE IF EXISTS likes",
+				"DROP TABLE IF EXISTS post_categories",
+				"DROP TABLE IF EXISTS categories",
+				"DROP TABLE IF EXISTS comments",
+				"DROP TABLE IF EXISTS posts",
+				"DROP TABLE IF EXISTS users",
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "default_categories",
+		Up: func(tx *sql.Tx) error {
+			for _, category := range defaultCategories {
+				if _, err := tx.Exec("INSERT OR IGNORE INTO categories (name) VALUES (?)", category); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *sql.Tx) error {
+			// Categories that posts still use are kept
+			for _, category := range defaultCategories {
+				_, err := tx.Exec(`
+					DELETE FROM categories
+					WHERE name = ? AND id NOT IN (SELECT category_id FROM post_categories)
+				`, category)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "comment_threading",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "comments", "parent_id", "INTEGER"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "comments", "is_deleted", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_comments_parent_id ON comments(parent_id)")
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP INDEX IF EXISTS idx_comments_parent_id"); err != nil {
+				return err
+			}
+			if err := dropColumnIfExists(tx, "comments", "is_deleted"); err != nil {
+				return err
+			}
+			return dropColumnIfExists(tx, "comments", "parent_id")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "access_tokens",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS access_tokens (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					last_used_at DATETIME,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens(user_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execAll(tx, "DROP TABLE IF EXISTS access_tokens")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "access_token_scopes",
+		Up: func(tx *sql.Tx) error {
+			// Tokens created before scopes existed keep the read and write access they already had
+			if err := addColumnIfMissing(tx, "access_tokens", "scopes", "TEXT NOT NULL DEFAULT 'read,write'"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "access_tokens", "expires_at", "DATETIME"); err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "access_tokens", "revoked_at", "DATETIME")
+		},
+		Down: func(tx *sql.Tx) error {
+			for _, column := range []string{"revoked_at", "expires_at", "scopes"} {
+				if err := dropColumnIfExists(tx, "access_tokens", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 6,
+		Name:    "moderation",
+		Up: func(tx *sql.Tx) error {
+			columns := []struct{ table, column, definition string }{
+				{"users", "role", "TEXT NOT NULL DEFAULT 'member'"},
+				{"posts", "is_hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+				{"posts", "is_locked", "BOOLEAN NOT NULL DEFAULT 0"},
+				{"comments", "is_hidden", "BOOLEAN NOT NULL DEFAULT 0"},
+			}
+			for _, c := range columns {
+				if err := addColumnIfMissing(tx, c.table, c.column, c.definition); err != nil {
+					return err
+				}
+			}
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS moderation_log (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					moderator_id INTEGER, -- NULL for changes made from the command line
+					action TEXT NOT NULL,
+					target_type TEXT NOT NULL,
+					target_id INTEGER NOT NULL,
+					post_id INTEGER,
+					details TEXT NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (moderator_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_moderation_log_created_at ON moderation_log(created_at)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP TABLE IF EXISTS moderation_log"); err != nil {
+				return err
+			}
+			columns := []struct{ table, column string }{
+				{"comments", "is_hidden"},
+				{"posts", "is_locked"},
+				{"posts", "is_hidden"},
+				{"users", "role"},
+			}
+			for _, c := range columns {
+				if err := dropColumnIfExists(tx, c.table, c.column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "reports",
+		Up: func(tx *sql.Tx) error {
+			// auto_hidden marks content hidden by the report threshold rather than by a moderator,
+			// so that reviewing the reports can show it again
+			if err := addColumnIfMissing(tx, "posts", "auto_hidden", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "comments", "auto_hidden", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS reports (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					reporter_id INTEGER NOT NULL,
+					target_type TEXT NOT NULL,
+					target_id INTEGER NOT NULL,
+					post_id INTEGER NOT NULL,
+					reason TEXT NOT NULL,
+					details TEXT NOT NULL DEFAULT '',
+					status TEXT NOT NULL DEFAULT 'open',
+					resolved_by INTEGER,
+					resolved_at DATETIME,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					UNIQUE(reporter_id, target_type, target_id),
+					FOREIGN KEY (reporter_id) REFERENCES users(id),
+					FOREIGN KEY (resolved_by) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_reports_status ON reports(status, target_type, target_id)",
+				`CREATE TABLE IF NOT EXISTS user_warnings (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					moderator_id INTEGER NOT NULL,
+					reason TEXT NOT NULL DEFAULT '',
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (moderator_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_user_warnings_user_id ON user_warnings(user_id)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP TABLE IF EXISTS user_warnings", "DROP TABLE IF EXISTS reports"); err != nil {
+				return err
+			}
+			if err := dropColumnIfExists(tx, "comments", "auto_hidden"); err != nil {
+				return err
+			}
+			return dropColumnIfExists(tx, "posts", "auto_hidden")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "post_images",
+		Up: func(tx *sql.Tx) error {
+			err := execAll(tx,
+				`CREATE TABLE IF NOT EXISTS post_images (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					post_id INTEGER NOT NULL,
+					filename TEXT NOT NULL,
+					position INTEGER NOT NULL DEFAULT 0,
+					caption TEXT NOT NULL DEFAULT '',
+					size INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (post_id) REFERENCES posts(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_post_images_post_id ON post_images(post_id, position)",
+				`INSERT INTO post_images (post_id, filename, position, created_at)
+					SELECT id, image_filename, 0, created_at FROM posts
+					WHERE image_filename IS NOT NULL AND image_filename != ''`,
+			)
+			if err != nil {
+				return err
+			}
+			// posts.image_filename stays in place but is no longer read or written. Dropping it would
+			// rebuild the posts schema, which fails on binaries built without FTS5 support.
+			_, err = tx.Exec("UPDATE posts SET image_filename = NULL")
+			return err
+		},
+		Down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`UPDATE posts SET image_filename = (
+					SELECT filename FROM post_images i WHERE i.post_id = posts.id ORDER BY position LIMIT 1
+				)`,
+				"DROP TABLE IF EXISTS post_images",
+			)
+		},
+	},
+	{
+		Version: 9,
+		Name:    "images",
+		Up: func(tx *sql.Tx) error {
+			// Images uploaded before content hashing keep their random names and have no hash,
+			// so they are never shared with new uploads
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS images (
+					filename TEXT PRIMARY KEY,
+					hash TEXT UNIQUE,
+					size INTEGER NOT NULL DEFAULT 0,
+					ref_count INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				`INSERT OR IGNORE INTO images (filename, size, ref_count, created_at)
+					SELECT filename, MAX(size), COUNT(*), MIN(created_at) FROM post_images GROUP BY filename`,
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execAll(tx, "DROP TABLE IF EXISTS images")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "images_acquired_at",
+		Up: func(tx *sql.Tx) error {
+			// acquired_at is when an upload last took a reference to the image. The upload check
+			// leaves images no post uses alone until their last upload is older than its grace period.
+			if err := addColumnIfMissing(tx, "images", "acquired_at", "DATETIME"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("UPDATE images SET acquired_at = created_at WHERE acquired_at IS NULL")
+			return err
+		},
+		Down: func(tx *sql.Tx) error {
+			return dropColumnIfExists(tx, "images", "acquired_at")
+		},
+	},
+	{
+		Version: 11,
+		Name:    "images_animated",
+		Up: func(tx *sql.Tx) error {
+			// GIFs uploaded before this migration are not marked; only their full file is stored,
+			// so they are shown animated everywhere anyway
+			return addColumnIfMissing(tx, "images", "animated", "INTEGER NOT NULL DEFAULT 0")
+		},
+		Down: func(tx *sql.Tx) error {
+			return dropColumnIfExists(tx, "images", "animated")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "upload_log",
+		Up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS upload_log (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					filename TEXT NOT NULL,
+					size INTEGER NOT NULL DEFAULT 0,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_upload_log_user_id ON upload_log(user_id, created_at)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			return execAll(tx, "DROP TABLE IF EXISTS upload_log")
+		},
+	},
+	{
+		Version: 13,
+		Name:    "user_profiles",
+		Up: func(tx *sql.Tx) error {
+			for _, column := range []struct{ name, definition string }{
+				{"created_at", "DATETIME"},
+				{"bio", "TEXT NOT NULL DEFAULT ''"},
+				{"avatar", "TEXT"},
+			} {
+				if err := addColumnIfMissing(tx, "users", column.name, column.definition); err != nil {
+					return err
+				}
+			}
+			// Existing users never recorded when they joined; their first post or comment is the best guess
+			_, err := tx.Exec(`
+				UPDATE users SET created_at = (
+					SELECT MIN(created_at) FROM (
+						SELECT created_at FROM posts WHERE user_id = users.id
+						UNION ALL
+						SELECT created_at FROM comments WHERE user_id = users.id
+					)
+				)
+				WHERE created_at IS NULL`)
+			return err
+		},
+		Down: func(tx *sql.Tx) error {
+			for _, column := range []string{"avatar", "bio", "created_at"} {
+				if err := dropColumnIfExists(tx, "users", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 14,
+		Name:    "account_settings",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "users", "deleted_at", "DATETIME"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS user_tokens (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					purpose TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					email TEXT NOT NULL DEFAULT '',
+					expires_at DATETIME NOT NULL,
+					used_at DATETIME,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens(user_id, purpose)",
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP TABLE IF EXISTS user_tokens"); err != nil {
+				return err
+			}
+			return dropColumnIfExists(tx, "users", "deleted_at")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "email_verification",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "users", "email_verified_at", "DATETIME"); err != nil {
+				return err
+			}
+			// Accounts from before verification existed keep being able to post
+			_, err := tx.Exec("UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE deleted_at IS NULL")
+			return err
+		},
+		Down: func(tx *sql.Tx) error {
+			return dropColumnIfExists(tx, "users", "email_verified_at")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "session_devices",
+		Up: func(tx *sql.Tx) error {
+			for _, column := range []string{"user_agent", "ip_address"} {
+				if err := addColumnIfMissing(tx, "sessions", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+					return err
+				}
+			}
+			return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)")
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP INDEX IF EXISTS idx_sessions_user_id"); err != nil {
+				return err
+			}
+			for _, column := range []string{"ip_address", "user_agent"} {
+				if err := dropColumnIfExists(tx, "sessions", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 17,
+		Name:    "hashed_session_tokens",
+		Up: func(tx *sql.Tx) error {
+			err := execAll(tx, "ALTER TABLE sessions RENAME COLUMN token TO token_hash")
+			if err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "sessions", "absolute_expiry", "DATETIME"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "sessions", "remember", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE sessions SET absolute_expiry = expiry"); err != nil {
+				return err
+			}
+
+			// Replace the plaintext tokens of existing sessions with their hashes, so nobody is logged out
+			rows, err := tx.Query("SELECT id, token_hash FROM sessions")
+			if err != nil {
+				return err
+			}
+			tokens := map[int]string{}
+			for rows.Next() {
+				var id int
+				var token string
+				if err := rows.Scan(&id, &token); err != nil {
+					rows.Close()
+					return err
+				}
+				tokens[id] = token
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for id, token := range tokens {
+				sum := sha256.Sum256([]byte(token))
+				if _, err := tx.Exec("UPDATE sessions SET token_hash = ? WHERE id = ?", hex.EncodeToString(sum[:]), id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *sql.Tx) error {
+			// Hashes can't be turned back into tokens, so every session ends
+			err := execAll(tx,
+				"DELETE FROM sessions",
+				"ALTER TABLE sessions RENAME COLUMN token_hash TO token",
+			)
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"remember", "absolute_expiry"} {
+				if err := dropColumnIfExists(tx, "sessions", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 18,
+		Name:    "post_views",
+		Up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "posts", "view_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS post_views (
+					post_id INTEGER NOT NULL,
+					visitor TEXT NOT NULL,
+					viewed_at DATETIME NOT NULL,
+					PRIMARY KEY (post_id, visitor),
+					FOREIGN KEY (post_id) REFERENCES posts(id)
+				)`,
+			)
+		},
+		Down: func(tx *sql.Tx) error {
+			if err := execAll(tx, "DROP TABLE IF EXISTS post_views"); err != nil {
+				return err
+			}
+			return dropColumnIfExists(tx, "posts", "view_count")
+		},
+	},
+	{
+		Version: 19,
+		Name:    "images_variants",
+		Up: func(tx *sql.Tx) error {
+			// variants records whether an image's smaller variants are stored. Existing images are
+			// left NULL and checked against the storage backend the next time the server starts.
+			return addColumnIfMissing(tx, "images", "variants", "INTEGER")
+		},
+		Down: func(tx *sql.Tx) error {
+			return dropColumnIfExists(tx, "images", "variants")
+		},
+	},
+}
@@ -0,0 +1,228 @@
+// Package migrations applies and reverts the forum's numbered database schema migrations.
+//
+// Each migration runs in its own transaction together with the schema_migrations row
+// recording it, so a failed migration leaves the database at the previous version.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Migration is one numbered, reversible schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error // nil when the migration cannot be reverted
+}
+
+// Status describes whether a migration has been applied
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+func sortedMigrations() []Migration {
+	sorted := make([]Migration, len(all))
+	copy(sorted, all)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// appliedVersions returns the time each applied migration version was recorded
+func appliedVersions(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// CurrentVersion returns the highest applied migration version, or 0 for an empty database
+func CurrentVersion(db *sql.DB) (int, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// GetStatus lists every known migration and whether it has been applied
+func GetStatus(db *sql.DB) ([]Status, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []Status
+	for _, m := range sortedMigrations() {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, Status{Migration: m, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// Up applies every pending migration in version order
+func Up(db *sql.DB) error {
+	return UpTo(db, 0)
+}
+
+// UpTo applies pending migrations up to and including target; a target of 0 applies all of them
+func UpTo(db *sql.DB, target int) error {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range sortedMigrations() {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := run(db, m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down reverts the given number of most recently applied migrations
+func Down(db *sql.DB, steps int) error {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	migrations := sortedMigrations()
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be reverted", m.Version, m.Name)
+		}
+		if err := run(db, m, false); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+// run applies or reverts a single migration inside a transaction
+func run(db *sql.DB, m Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	direction := "up"
+	step := m.Up
+	if !up {
+		direction = "down"
+		step = m.Down
+	}
+
+	if err := step(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) %s failed: %v", m.Version, m.Name, direction, err)
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Migration %d (%s) %s", m.Version, m.Name, direction)
+	return nil
+}
+
+// execAll runs each query in order, stopping at the first error
+func execAll(tx *sql.Tx, queries ...string) error {
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("%v\nquery: %s", err, query)
+		}
+	}
+	return nil
+}
+
+// hasColumn reports whether a table already has the named column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumnIfMissing adds a column unless an older, pre-migration schema already created it
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// dropColumnIfExists drops a column when it is present
+func dropColumnIfExists(tx *sql.Tx, table, column string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column))
+	return err
+}
@@ -0,0 +1,244 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB opens an empty in-memory database. It is limited to one connection, since every
+// connection to ":memory:" would get a database of its own.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schemaOf lists every table with its columns and every index, apart from schema_migrations
+func schemaOf(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT type, name FROM sqlite_master
+		WHERE name != 'schema_migrations' AND name NOT LIKE 'sqlite_%'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables, schema []string
+	for rows.Next() {
+		var kind, name string
+		if err := rows.Scan(&kind, &name); err != nil {
+			t.Fatal(err)
+		}
+		if kind == "table" {
+			tables = append(tables, name)
+		} else {
+			schema = append(schema, kind+" "+name)
+		}
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		var columns []string
+		rows, err := db.Query("SELECT name, type FROM pragma_table_info(?)", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var name, kind string
+			if err := rows.Scan(&name, &kind); err != nil {
+				t.Fatal(err)
+			}
+			columns = append(columns, name+" "+kind)
+		}
+		rows.Close()
+		sort.Strings(columns)
+		schema = append(schema, fmt.Sprintf("table %s %v", table, columns))
+	}
+	sort.Strings(schema)
+	return schema
+}
+
+func latestVersion() int {
+	latest := 0
+	for _, m := range all {
+		latest = max(latest, m.Version)
+	}
+	return latest
+}
+
+func TestUpAndDownAll(t *testing.T) {
+	db := openTestDB(t)
+
+	if err := Up(db); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if version, err := CurrentVersion(db); err != nil || version != latestVersion() {
+		t.Fatalf("version after Up = %d, %v; want %d", version, err, latestVersion())
+	}
+	migrated := schemaOf(t, db)
+
+	// Up is a no-op once everything is applied
+	if err := Up(db); err != nil {
+		t.Fatalf("second Up: %v", err)
+	}
+
+	if err := Down(db, len(all)); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if version, err := CurrentVersion(db); err != nil || version != 0 {
+		t.Fatalf("version after Down = %d, %v; want 0", version, err)
+	}
+	if schema := schemaOf(t, db); len(schema) != 0 {
+		t.Errorf("schema left after reverting every migration: %v", schema)
+	}
+
+	if err := Up(db); err != nil {
+		t.Fatalf("Up after Down: %v", err)
+	}
+	if schema := schemaOf(t, db); !reflect.DeepEqual(schema, migrated) {
+		t.Errorf("schema after Down and Up differs:\n got %v\nwant %v", schema, migrated)
+	}
+}
+
+// TestEachMigrationReverts checks that every migration's Down undoes exactly what its Up did
+func TestEachMigrationReverts(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, m := range sortedMigrations() {
+		t.Run(fmt.Sprintf("%d_%s", m.Version, m.Name), func(t *testing.T) {
+			before := schemaOf(t, db)
+			if err := UpTo(db, m.Version); err != nil {
+				t.Fatalf("up: %v", err)
+			}
+			after := schemaOf(t, db)
+
+			if err := Down(db, 1); err != nil {
+				t.Fatalf("down: %v", err)
+			}
+			if version, err := CurrentVersion(db); err != nil || version >= m.Version {
+				t.Fatalf("version after down = %d, %v; want below %d", version, err, m.Version)
+			}
+			if schema := schemaOf(t, db); !reflect.DeepEqual(schema, before) {
+				t.Errorf("down left a different schema:\n got %v\nwant %v", schema, before)
+			}
+
+			if err := UpTo(db, m.Version); err != nil {
+				t.Fatalf("up again: %v", err)
+			}
+			if schema := schemaOf(t, db); !reflect.DeepEqual(schema, after) {
+				t.Errorf("up again gave a different schema:\n got %v\nwant %v", schema, after)
+			}
+		})
+	}
+}
+
+func TestDefaultCategoriesSeeded(t *testing.T) {
+	db := openTestDB(t)
+	if err := Up(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM categories").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(defaultCategories) {
+		t.Errorf("got %d categories, want %d", count, len(defaultCategories))
+	}
+}
+
+func TestSessionTokensHashed(t *testing.T) {
+	db := openTestDB(t)
+	if err := UpTo(db, 16); err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	_, err := db.Exec("INSERT INTO sessions (token, expiry, is_guest, last_activity) VALUES (?, ?, 1, ?)",
+		"plaintext-token", expiry, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpTo(db, 17); err != nil {
+		t.Fatal(err)
+	}
+	var tokenHash string
+	var absoluteExpiry time.Time
+	if err := db.QueryRow("SELECT token_hash, absolute_expiry FROM sessions").Scan(&tokenHash, &absoluteExpiry); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("plaintext-token"))
+	if want := hex.EncodeToString(sum[:]); tokenHash != want {
+		t.Errorf("token_hash = %q, want %q", tokenHash, want)
+	}
+	if !absoluteExpiry.Equal(expiry) {
+		t.Errorf("absolute_expiry = %v, want the session's expiry %v", absoluteExpiry, expiry)
+	}
+}
+
+func TestPostImagesMigrated(t *testing.T) {
+	db := openTestDB(t)
+	if err := UpTo(db, 7); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"INSERT INTO users (id, username, email, password) VALUES (1, 'member', 'member@example.com', '')",
+		"INSERT INTO posts (id, user_id, title, content, image_filename) VALUES (1, 1, 'with image', '', 'photo.png')",
+		"INSERT INTO posts (id, user_id, title, content) VALUES (2, 1, 'without image', '')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := UpTo(db, 9); err != nil {
+		t.Fatal(err)
+	}
+	var postID, position, refCount int
+	var filename string
+	if err := db.QueryRow("SELECT post_id, filename, position FROM post_images").Scan(&postID, &filename, &position); err != nil {
+		t.Fatal(err)
+	}
+	if postID != 1 || filename != "photo.png" || position != 0 {
+		t.Errorf("post_images row = %d, %q, %d; want 1, photo.png, 0", postID, filename, position)
+	}
+	if err := db.QueryRow("SELECT ref_count FROM images WHERE filename = 'photo.png'").Scan(&refCount); err != nil {
+		t.Fatal(err)
+	}
+	if refCount != 1 {
+		t.Errorf("ref_count = %d, want 1", refCount)
+	}
+
+	if err := Down(db, 2); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT id, COALESCE(image_filename, '') FROM posts ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var restored []string
+	for rows.Next() {
+		var id int
+		var image string
+		if err := rows.Scan(&id, &image); err != nil {
+			t.Fatal(err)
+		}
+		restored = append(restored, fmt.Sprintf("%d:%s", id, image))
+	}
+	if want := []string{"1:photo.png", "2:"}; !reflect.DeepEqual(restored, want) {
+		t.Errorf("image_filename after Down = %v, want %v", restored, want)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	RebootForums "RebootForums/Handlers"
+	"RebootForums/migrations"
+)
+
+const roleUsage = `usage: forum role [-db path] <username> <member|moderator|admin>
+
+Sets a user's role. Use it to appoint the first admin, who can then manage
+roles from the /mod dashboard.
+`
+
+// runRoleCommand implements the "role" subcommand
+func runRoleCommand(args []string) error {
+	fs := flag.NewFlagSet("role", flag.ContinueOnError)
+	dbPath := fs.String("db", "./forum.db", "path to the SQLite database")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, roleUsage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a username and a role")
+	}
+
+	if err := RebootForums.InitDB(*dbPath); err != nil {
+		return err
+	}
+	defer RebootForums.DB.Close()
+	if err := migrations.Up(RebootForums.DB); err != nil {
+		return err
+	}
+
+	username, role := fs.Arg(0), fs.Arg(1)
+	err := RebootForums.SetUserRole(nil, username, role)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %q", username)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now a %s\n", username, role)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	RebootForums "RebootForums/Handlers"
+)
+
+const storageUsage = `usage: forum storage migrate [-dry-run] -from <local|s3> -to <local|s3>
+
+Copies every uploaded file from one storage backend to another. Both backends
+are configured from the environment (UPLOAD_DIR for local storage, S3_* for
+S3), and files the destination already has are skipped, so an interrupted
+migration can simply be run again. Switch STORAGE_BACKEND once it is done.
+`
+
+// runStorageCommand implements the "storage" subcommand
+func runStorageCommand(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprint(os.Stderr, storageUsage)
+		return fmt.Errorf("expected the migrate command")
+	}
+
+	fs := flag.NewFlagSet("storage migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "backend to copy files from")
+	to := fs.String("to", "", "backend to copy files to")
+	dryRun := fs.Bool("dry-run", false, "list the files that would be copied without copying them")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, storageUsage) }
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("expected -from and -to")
+	}
+	if *from == *to {
+		return fmt.Errorf("source and destination are both %s", *from)
+	}
+
+	source, err := RebootForums.NewStorage(*from)
+	if err != nil {
+		return err
+	}
+	destination, err := RebootForums.NewStorage(*to)
+	if err != nil {
+		return err
+	}
+
+	summary, err := RebootForums.CopyStorage(source, destination, *dryRun, func(key string) {
+		fmt.Println(key)
+	})
+	verb := "Copied"
+	if *dryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("%s %d file(s), skipped %d already present, filled in %d missing variant(s)\n",
+		verb, summary.Copied, summary.Skipped, summary.Filled)
+	return err
+}